@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+var errUnitPaused = errors.New("unit paused")
+
+// adminHandler serves operator endpoints, all requiring the -admin-secret
+// as X-Receiver-Token or "Authorization: Bearer {secret}":
+//
+// POST /admin/units/{name}/pause  stores stop, posts get 503
+// POST /admin/units/{name}/resume
+// GET /admin/config               loaded unit configs, secrets redacted
+// GET /status                     JSON state of each unit
+type adminHandler struct {
+	rs     *receiverServer
+	secret string
+}
+
+func (ah *adminHandler) authOK(request *http.Request) bool {
+	return tokenOK(request, ah.secret)
+}
+
+func (ah *adminHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	if !ah.authOK(request) {
+		http.Error(out, "nope", http.StatusForbidden)
+		return
+	}
+	parts := splitPath(request.URL.Path)
+	if len(parts) == 1 && parts[0] == "status" {
+		ah.status(out, request)
+		return
+	}
+	if len(parts) == 2 && parts[0] == "admin" && parts[1] == "config" {
+		ah.config(out, request)
+		return
+	}
+	if len(parts) == 4 && parts[0] == "admin" && parts[1] == "units" {
+		ah.unitAction(out, request, parts[2], parts[3])
+		return
+	}
+	http.Error(out, "nope", http.StatusNotFound)
+}
+
+func (ah *adminHandler) unitAction(out http.ResponseWriter, request *http.Request, name, action string) {
+	cfg, some := ah.rs.units()[name]
+	if !some {
+		http.Error(out, "no such unit", http.StatusNotFound)
+		return
+	}
+	if action != "pause" && action != "resume" {
+		http.Error(out, "nope", http.StatusNotFound)
+		return
+	}
+	if request.Method != "POST" {
+		out.Header().Set("Allow", "POST")
+		http.Error(out, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	paused := action == "pause"
+	cfg.paused.Store(paused)
+	slog.Info("admin", "cfg", name, "paused", paused)
+	out.Header().Set("Content-Type", "text/plain")
+	out.WriteHeader(http.StatusOK)
+	out.Write([]byte("ok\n"))
+}
+
+type unitStatus struct {
+	Name    string `json:"name"`
+	Paused  bool   `json:"paused"`
+	Aborted uint64 `json:"aborted"`
+	// Silent is set while over MaxSilence
+	Silent bool `json:"silent,omitempty"`
+}
+
+type serverStatus struct {
+	Units []unitStatus `json:"units"`
+}
+
+func (ah *adminHandler) status(out http.ResponseWriter, request *http.Request) {
+	var st serverStatus
+	for name, cfg := range ah.rs.units() {
+		st.Units = append(st.Units, unitStatus{
+			Name:    name,
+			Paused:  cfg.paused.Load(),
+			Aborted: cfg.aborted.Load(),
+			Silent:  cfg.silent.Load(),
+		})
+	}
+	sort.Slice(st.Units, func(i, j int) bool { return st.Units[i].Name < st.Units[j].Name })
+	out.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(out).Encode(st)
+}
+
+const redacted = "REDACTED"
+
+// redacted returns a copy safe to show, with secrets and keys replaced
+func (ruc ReceiverUnitConfig) redacted() ReceiverUnitConfig {
+	if ruc.Secret != "" {
+		ruc.Secret = redacted
+	}
+	if ruc.HMACSecret != "" {
+		ruc.HMACSecret = redacted
+	}
+	if ruc.EncryptKey != "" {
+		ruc.EncryptKey = redacted
+	}
+	return ruc
+}
+
+func (ah *adminHandler) config(out http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		out.Header().Set("Allow", "GET")
+		http.Error(out, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	current := ah.rs.units()
+	units := make(map[string]ReceiverUnitConfig, len(current))
+	for name, cfg := range current {
+		units[name] = cfg.ReceiverUnitConfig.redacted()
+	}
+	out.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	enc.Encode(units)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// adminRequest is a request to the admin endpoints with token
+func adminRequest(method, target, token string) *http.Request {
+	request := testRequest(method, target, "", nil)
+	if token != "" {
+		request.Header.Set("X-Receiver-Token", token)
+	}
+	return request
+}
+
+// serveHandler runs one request through handler, e.g. the whole server's mux
+func serveHandler(handler http.Handler, request *http.Request) *httptest.ResponseRecorder {
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, request)
+	return out
+}
+
+// unitStatuses is GET /status by name
+func unitStatuses(t *testing.T, handler http.Handler) map[string]unitStatus {
+	t.Helper()
+	out := serveHandler(handler, adminRequest("GET", "/status", "adm"))
+	wantStatus(t, out, 200)
+	var st serverStatus
+	err := json.Unmarshal(out.Body.Bytes(), &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]unitStatus)
+	for _, us := range st.Units {
+		byName[us.Name] = us
+	}
+	return byName
+}
+
+func TestPauseResume(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", AppendPath: filepath.Join(dir, "b.cbor")}},
+	})
+	handler := rs.newHTTPServer("", "adm", false).Handler
+
+	wantStatus(t, serveHandler(handler, adminRequest("POST", "/admin/units/a/pause", "")), 403)
+	wantStatus(t, serveHandler(handler, adminRequest("POST", "/admin/units/a/pause", "wrong")), 403)
+	wantStatus(t, serveHandler(handler, adminRequest("GET", "/admin/units/a/pause", "adm")), 405)
+	wantStatus(t, serveHandler(handler, adminRequest("POST", "/admin/units/nope/pause", "adm")), 404)
+	wantStatus(t, serveHandler(handler, adminRequest("POST", "/admin/units/a/stop", "adm")), 404)
+
+	wantStatus(t, post(rs, "/a/sa", "1"), 200)
+	wantStatus(t, serveHandler(handler, adminRequest("POST", "/admin/units/a/pause", "adm")), 200)
+	if st := unitStatuses(t, handler); !st["a"].Paused || st["b"].Paused {
+		t.Errorf("status after pause %+v", st)
+	}
+	wantStatus(t, post(rs, "/a/sa", "2"), 503)
+	wantStatus(t, post(rs, "/b/sb", "other unit"), 200)
+	wantStatus(t, serveHandler(handler, adminRequest("POST", "/admin/units/a/resume", "adm")), 200)
+	if st := unitStatuses(t, handler); st["a"].Paused {
+		t.Errorf("status after resume %+v", st)
+	}
+	wantStatus(t, post(rs, "/a/sa", "3"), 200)
+
+	rs.configs["a"].retire()
+	recs := readRecords(t, filepath.Join(dir, "a.cbor"))
+	if len(recs) != 2 || string(recs[0].Data) != "1" || string(recs[1].Data) != "3" {
+		t.Fatalf("stored %d records", len(recs))
+	}
+}
+
+func TestAdminConfigRedacted(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "secret-a", HMACSecret: "hmac-a", AppendPath: filepath.Join(dir, "a.cbor"), EncryptKey: key}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "secret-b", AppendPath: filepath.Join(dir, "b.cbor"), MaxSize: 1234}},
+	})
+	handler := rs.newHTTPServer("", "adm", false).Handler
+	wantStatus(t, serveHandler(handler, adminRequest("GET", "/admin/config", "")), 403)
+	wantStatus(t, serveHandler(handler, adminRequest("POST", "/admin/config", "adm")), 405)
+	out := serveHandler(handler, adminRequest("GET", "/admin/config", "adm"))
+	wantStatus(t, out, 200)
+	for _, secret := range []string{"secret-a", "hmac-a", key, "secret-b"} {
+		if strings.Contains(out.Body.String(), secret) {
+			t.Errorf("config dump has %q", secret)
+		}
+	}
+	var units map[string]ReceiverUnitConfig
+	err := json.Unmarshal(out.Body.Bytes(), &units)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := units["a"], units["b"]
+	if a.Secret != redacted || a.HMACSecret != redacted || a.EncryptKey != redacted || b.Secret != redacted {
+		t.Errorf("not redacted: %+v %+v", a, b)
+	}
+	// the rest is shown as running
+	if a.AppendPath != filepath.Join(dir, "a.cbor") || b.MaxSize != 1234 || b.HMACSecret != "" {
+		t.Errorf("config %+v %+v", a, b)
+	}
+	// the running units keep their secrets
+	if rs.configs["a"].Secret != "secret-a" {
+		t.Error("redacted the running config")
+	}
+}
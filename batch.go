@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// batchItem is one record in a POST /{name}/batch body, which is a JSON
+// array of them
+type batchItem struct {
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"dataBase64"`
+}
+
+// batchResult is the response for one batchItem, in the same order
+type batchResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// serveBatch stores each item of a JSON array as its own record.
+// The response is 200 with a batchResult per item; items fail or
+// succeed independently.
+func (rs *receiverServer) serveBatch(out http.ResponseWriter, request *http.Request, cfg *ReceiverUnit) {
+	if cfg.paused.Load() {
+		cfg.setRetryAfter(out, 0)
+		http.Error(out, errUnitPaused.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	maxSize := cfg.MaxBatchBytes
+	if maxSize == 0 {
+		maxSize = cfg.MaxSize
+	}
+	reader, err := cfg.bodyReader(out, request, maxSize)
+	if errors.Is(err, errUnsupportedEncoding) {
+		http.Error(out, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(out, err.Error(), 400)
+		return
+	}
+	body, err := readBody(reader, cfg.ReadBufferSize, maxSize)
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) || errors.Is(err, errCompressionRatio) {
+		http.Error(out, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(out, err.Error(), 500)
+		return
+	}
+	if !cfg.bodyAuthOK(request, body, rs.clock()) {
+		rs.denyAuth(out, request, cfg)
+		return
+	}
+	var items []batchItem
+	err = json.Unmarshal(body, &items)
+	if err != nil {
+		http.Error(out, "bad batch: "+err.Error(), 400)
+		return
+	}
+	// the same request context for every item
+	shared := ReceiverRecord{
+		Headers: cfg.captureHeaders(request.Header),
+		Query:   cfg.captureQuery(request.URL.Query()),
+		Path:    cfg.capturePath(splitPath(request.URL.Path)),
+	}
+	if cfg.CaptureRemote {
+		shared.RemoteAddr = rs.clientIP(request)
+	}
+	results := make([]batchResult, len(items))
+	for i, item := range items {
+		results[i] = rs.storeBatchItem(cfg, item, request.Method, &shared)
+	}
+	out.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(out).Encode(results)
+}
+
+func (rs *receiverServer) storeBatchItem(cfg *ReceiverUnit, item batchItem, method string, shared *ReceiverRecord) batchResult {
+	contentType := cfg.contentTypeOrDefault(item.ContentType)
+	if !cfg.contentTypeOK(contentType) {
+		return batchResult{Status: 400, Error: "unacceptable content-type"}
+	}
+	if int64(len(item.Data)) > cfg.maxSizeFor(contentType) {
+		return batchResult{Status: http.StatusRequestEntityTooLarge, Error: "too large"}
+	}
+	if cfg.ValidateJSON && isJSONContentType(contentType) && !json.Valid(item.Data) {
+		return batchResult{Status: 400, Error: "invalid JSON"}
+	}
+	now := rs.clock()
+	rec := ReceiverRecord{
+		When:        cfg.recordWhen(now),
+		Data:        item.Data,
+		ContentType: contentType,
+		Headers:     shared.Headers,
+		Query:       shared.Query,
+		Path:        shared.Path,
+		RemoteAddr:  shared.RemoteAddr,
+	}
+	err := rs.commitRecord(cfg, &rec, cfg.defaultFormat(), method, now)
+	if errors.Is(err, errWriteQueueFull) || errors.Is(err, errUnitPaused) {
+		return batchResult{Status: http.StatusServiceUnavailable, Error: err.Error()}
+	}
+	if errors.Is(err, errFileExists) {
+		return batchResult{Status: http.StatusConflict, Error: err.Error()}
+	}
+	if err != nil && !errors.Is(err, errUnchanged) {
+		slog.Debug("batch store", "err", err)
+		return batchResult{Status: 500, Error: err.Error()}
+	}
+	return batchResult{Status: 200}
+}
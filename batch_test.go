@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), AllowBatch: true, MaxSize: 8, MaxBatchBytes: 400, ValidateJSON: true, CaptureRemote: true}},
+		"n": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sn", AppendPath: filepath.Join(dir, "n.cbor")}},
+	})
+	// "aGVsbG8=" is "hello", "e30=" is "{}", "ew==" is "{", and
+	// "MDEyMzQ1Njc4OQ==" is ten bytes, over MaxSize
+	body := `[
+{"contentType": "text/plain", "dataBase64": "aGVsbG8="},
+{"contentType": "application/json", "dataBase64": "e30="},
+{"contentType": "application/json", "dataBase64": "ew=="},
+{"contentType": "text/plain", "dataBase64": "MDEyMzQ1Njc4OQ=="}
+]`
+	out := serve(rs, testRequest("POST", "/a/sa/batch", "application/json", []byte(body)))
+	wantStatus(t, out, 200)
+	want := `[{"status":200},{"status":200},{"status":400,"error":"invalid JSON"},{"status":413,"error":"too large"}]`
+	if got := strings.TrimSpace(out.Body.String()); got != want {
+		t.Fatalf("results %s, want %s", got, want)
+	}
+
+	// the whole body is held to MaxBatchBytes
+	big := `[{"contentType": "text/plain", "dataBase64": "` + strings.Repeat("A", 400) + `"}]`
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa/batch", "application/json", []byte(big))), 413)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa/batch", "application/json", []byte(`{"not":"an array"}`))), 400)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/wrong/batch", "application/json", []byte(body))), 403)
+	// without AllowBatch "batch" is only part of the path, the body one record
+	wantStatus(t, serve(rs, testRequest("POST", "/n/sn/batch", "application/json", []byte(body))), 200)
+
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	if recs := readRecords(t, filepath.Join(dir, "n.cbor")); len(recs) != 1 || string(recs[0].Data) != body {
+		t.Errorf("unit without AllowBatch stored %d records", len(recs))
+	}
+	recs := readRecords(t, filepath.Join(dir, "a.cbor"))
+	if len(recs) != 2 || string(recs[0].Data) != "hello" || string(recs[1].Data) != "{}" || recs[1].ContentType != "application/json" {
+		t.Fatalf("stored %+v", recs)
+	}
+	if recs[0].RemoteAddr != "192.0.2.1" {
+		t.Errorf("batch record RemoteAddr %q", recs[0].RemoteAddr)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// requestBudget allows each client IP a fixed number of requests per
+// window, then nothing until that window ends
+type requestBudget struct {
+	l sync.Mutex
+
+	limit  int
+	window time.Duration
+
+	counts    map[string]*budgetCount
+	lastPrune time.Time
+}
+
+type budgetCount struct {
+	start time.Time
+	n     int
+}
+
+func newRequestBudget(limit int, window time.Duration) *requestBudget {
+	return &requestBudget{
+		limit:  limit,
+		window: window,
+		counts: make(map[string]*budgetCount),
+	}
+}
+
+// allow counts a request from ip. If over budget it returns false and
+// how long until the window resets.
+func (rb *requestBudget) allow(ip string, now time.Time) (bool, time.Duration) {
+	rb.l.Lock()
+	defer rb.l.Unlock()
+	if now.Sub(rb.lastPrune) > rb.window {
+		for k, bc := range rb.counts {
+			if now.Sub(bc.start) >= rb.window {
+				delete(rb.counts, k)
+			}
+		}
+		rb.lastPrune = now
+	}
+	bc, some := rb.counts[ip]
+	if !some || now.Sub(bc.start) >= rb.window {
+		bc = &budgetCount{start: now}
+		rb.counts[ip] = bc
+	}
+	if bc.n >= rb.limit {
+		return false, bc.start.Add(rb.window).Sub(now)
+	}
+	bc.n++
+	return true, 0
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRequestBudget(t *testing.T) {
+	rb := newRequestBudget(3, time.Minute)
+	t0 := time.Unix(1772600000, 0)
+	for i := range 3 {
+		if ok, _ := rb.allow("a", t0.Add(time.Duration(i)*time.Second)); !ok {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	ok, wait := rb.allow("a", t0.Add(10*time.Second))
+	if ok || wait != 50*time.Second {
+		t.Fatalf("over budget: ok %v, wait %s", ok, wait)
+	}
+	// other IPs have their own
+	if ok, _ := rb.allow("b", t0.Add(10*time.Second)); !ok {
+		t.Fatal("b refused")
+	}
+	if ok, _ := rb.allow("a", t0.Add(time.Minute)); !ok {
+		t.Fatal("refused after the window")
+	}
+	// stale entries are dropped
+	rb.allow("c", t0.Add(5*time.Minute))
+	if len(rb.counts) != 1 {
+		t.Fatalf("%d entries kept", len(rb.counts))
+	}
+}
+
+func TestRequestBudgetHTTP(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), RequestBudget: 2, BudgetWindow: Duration(time.Minute)}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	wantStatus(t, post(rs, "/a/sa", "1"), 200)
+	wantStatus(t, post(rs, "/a/sa", "2"), 200)
+	out := post(rs, "/a/sa", "3")
+	wantStatus(t, out, 429)
+	if got := out.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After %q", got)
+	}
+	request := testRequest("POST", "/a/sa", "text/plain", []byte("other ip"))
+	request.RemoteAddr = "192.0.2.2:1234"
+	wantStatus(t, serve(rs, request), 200)
+	when = when.Add(time.Minute)
+	wantStatus(t, post(rs, "/a/sa", "4"), 200)
+	rs.configs["a"].retire()
+	if n := len(readRecords(t, filepath.Join(dir, "a.cbor"))); n != 4 {
+		t.Fatalf("stored %d records, want 4", n)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bolson.org/receiver/data"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	cbor "github.com/brianolson/cbor_go"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Concatenate CBOR append files, dropping records whose body was
+// already seen, for sources that resend.
+//
+// receiver_dedupe -o all.cbor day1.cbor day2.cbor.gz
+//
+// The first record with a given body is kept, with its time. Encrypted
+// records can't be compared, every one has a fresh nonce.
+
+// must match receiver's tempSuffix
+const tempSuffix = ".receiver-tmp"
+
+type dedupe struct {
+	seen map[[sha256.Size]byte]bool
+
+	records int
+	dropped int
+}
+
+// openRecords opens a plain or gzipped CBOR file past any data.FileHeader
+func openRecords(fin io.Reader) (*bufio.Reader, error) {
+	br := bufio.NewReader(fin)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gz)
+	}
+	start, _ := br.Peek(len(data.FileHeaderMagic))
+	if data.IsFileHeader(start) {
+		_, err := br.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+	}
+	return br, nil
+}
+
+// copyFile copies the records of path not seen before to out
+func (d *dedupe) copyFile(path string, out io.Writer) error {
+	fin, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	br, err := openRecords(fin)
+	if err != nil {
+		return err
+	}
+	dec := cbor.NewDecoder(br)
+	for {
+		var rec data.ReceiverRecord
+		err = dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", d.records, err)
+		}
+		d.records++
+		sum := sha256.Sum256(rec.Data)
+		if d.seen[sum] {
+			d.dropped++
+			continue
+		}
+		d.seen[sum] = true
+		blob, err := rec.MarshalCBOR()
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(blob)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// run writes the deduplicated records of paths to outPath, or stdout.
+// A file is written to a temp name and renamed so that a failure leaves
+// no partial output.
+func (d *dedupe) run(outPath string, paths []string) error {
+	if outPath == "" {
+		bw := bufio.NewWriter(os.Stdout)
+		for _, path := range paths {
+			err := d.copyFile(path, bw)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		return bw.Flush()
+	}
+	for _, path := range paths {
+		if filepath.Clean(path) == filepath.Clean(outPath) {
+			return fmt.Errorf("%s: -o is also an input", outPath)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(outPath), filepath.Base(outPath)+".*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	bw := bufio.NewWriter(tmp)
+	for _, path := range paths {
+		err = d.copyFile(path, bw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	// CreateTemp makes 0600 files
+	err = tmp.Chmod(0644)
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), outPath)
+}
+
+func main() {
+	var outPath string
+	flag.StringVar(&outPath, "o", "", "write here, default stdout")
+	flag.Parse()
+	paths := flag.Args()
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: receiver_dedupe [-o out.cbor] in.cbor...\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	d := dedupe{seen: make(map[[sha256.Size]byte]bool)}
+	err := d.run(outPath, paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%d records, %d duplicates removed\n", d.records, d.dropped)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"bolson.org/receiver/data"
+	cbor "github.com/brianolson/cbor_go"
+)
+
+func encodeRecords(t *testing.T, recs ...data.ReceiverRecord) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for i := range recs {
+		blob, err := recs[i].MarshalCBOR()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(blob)
+	}
+	return buf.Bytes()
+}
+
+func writeFile(t *testing.T, path string, blob []byte) {
+	t.Helper()
+	err := os.WriteFile(path, blob, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func textRecord(when int64, d string) data.ReceiverRecord {
+	return data.ReceiverRecord{When: when, Data: []byte(d), ContentType: "text/plain"}
+}
+
+func TestDedupe(t *testing.T) {
+	dir := t.TempDir()
+	header, err := (&data.FileHeader{Version: data.FileHeaderVersion, Unit: "a"}).MarshalLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(dir, "a.cbor")
+	writeFile(t, a, append(header, encodeRecords(t, textRecord(1, "one"), textRecord(2, "two"), textRecord(3, "one"))...))
+	var gzbuf bytes.Buffer
+	gz := gzip.NewWriter(&gzbuf)
+	gz.Write(encodeRecords(t, textRecord(4, "two"), textRecord(5, "three")))
+	gz.Close()
+	b := filepath.Join(dir, "b.cbor.gz")
+	writeFile(t, b, gzbuf.Bytes())
+
+	out := filepath.Join(dir, "out.cbor")
+	d := dedupe{seen: make(map[[sha256.Size]byte]bool)}
+	err = d.run(out, []string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.records != 5 || d.dropped != 2 {
+		t.Errorf("%d records, %d dropped, want 5, 2", d.records, d.dropped)
+	}
+	fin, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fin.Close()
+	dec := cbor.NewDecoder(fin)
+	var got []data.ReceiverRecord
+	for {
+		var rec data.ReceiverRecord
+		err = dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, rec)
+	}
+	// the first of each is kept, with its time
+	want := []data.ReceiverRecord{textRecord(1, "one"), textRecord(2, "two"), textRecord(5, "three")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDedupeErrors(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.cbor")
+	writeFile(t, a, encodeRecords(t, textRecord(1, "one")))
+	d := dedupe{seen: make(map[[sha256.Size]byte]bool)}
+	err := d.run(a, []string{a})
+	if err == nil || !strings.Contains(err.Error(), "also an input") {
+		t.Errorf("-o an input: %v", err)
+	}
+
+	// a bad input leaves no output, not even a temp file
+	out := filepath.Join(dir, "out.cbor")
+	err = d.run(out, []string{a, filepath.Join(dir, "missing.cbor")})
+	if err == nil {
+		t.Fatal("missing input accepted")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"a.cbor"}) {
+		t.Errorf("left %v", names)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"bolson.org/receiver/data"
+)
+
+// Offline housekeeping for receiver output directories.
+//
+// receiver_maint -min-age 2h -match '*.cbor*' /data/receiver
+//
+// For each file that hasn't been modified in -min-age (so the server
+// has rotated away from it): gzip it to {name}.gz, add the .gz to
+// MANIFEST.sha256 in that directory, optionally run -upload-cmd on it,
+// and remove the original.
+
+// manifestName is sha256sum(1) format, check with `sha256sum -c MANIFEST.sha256`
+const manifestName = "MANIFEST.sha256"
+
+// must match receiver's tempSuffix
+const tempSuffix = ".receiver-tmp"
+
+type maint struct {
+	minAge    time.Duration
+	match     string
+	uploadCmd string
+	keep      bool
+	dryRun    bool
+	verbose   bool
+}
+
+func (m *maint) logf(format string, args ...interface{}) {
+	if m.verbose {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+// skipName is true for files that are never compressed: the manifest,
+// what is already compressed, sidecars, and temp files
+func skipName(name string) bool {
+	if name == manifestName || strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, data.RawMetaSuffix) || strings.HasSuffix(name, tempSuffix) {
+		return true
+	}
+	for _, suffix := range data.ChecksumSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns the files in dir that are ready to compress
+func (m *maint) candidates(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-m.minAge)
+	var out []string
+	for _, ent := range entries {
+		name := ent.Name()
+		if !ent.Type().IsRegular() {
+			// skips directories and the "latest" symlink
+			continue
+		}
+		if skipName(name) {
+			continue
+		}
+		if m.match != "" {
+			ok, err := filepath.Match(m.match, name)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		fi, err := ent.Info()
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(cutoff) {
+			continue
+		}
+		out = append(out, filepath.Join(dir, name))
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// compress writes path+".gz" and returns its sha256
+func compress(path string) (string, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fin.Close()
+	fi, err := fin.Stat()
+	if err != nil {
+		return "", err
+	}
+	gzpath := path + ".gz"
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(gzpath)+".*"+tempSuffix)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	hash := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(tmp, hash))
+	gz.Name = filepath.Base(path)
+	gz.ModTime = fi.ModTime()
+	_, err = io.Copy(gz, fin)
+	if err != nil {
+		return "", err
+	}
+	err = gz.Close()
+	if err != nil {
+		return "", err
+	}
+	err = tmp.Chmod(fi.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmp.Name(), gzpath)
+	if err != nil {
+		return "", err
+	}
+	os.Chtimes(gzpath, fi.ModTime(), fi.ModTime())
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func appendManifest(dir, sum, name string) error {
+	fout, err := os.OpenFile(filepath.Join(dir, manifestName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fout, "%s  %s\n", sum, name)
+	cerr := fout.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// upload runs uploadCmd with "{}" replaced by path
+func (m *maint) upload(path string) error {
+	args := strings.Fields(m.uploadCmd)
+	for i, arg := range args {
+		args[i] = strings.ReplaceAll(arg, "{}", path)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (m *maint) processFile(path string) error {
+	if m.dryRun {
+		fmt.Println(path)
+		return nil
+	}
+	sum, err := compress(path)
+	if err != nil {
+		return err
+	}
+	gzpath := path + ".gz"
+	err = appendManifest(filepath.Dir(path), sum, filepath.Base(gzpath))
+	if err != nil {
+		return err
+	}
+	if m.uploadCmd != "" {
+		err = m.upload(gzpath)
+		if err != nil {
+			return fmt.Errorf("upload: %w", err)
+		}
+	}
+	if !m.keep {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	m.logf("%s -> %s\n", path, gzpath)
+	return nil
+}
+
+func main() {
+	var m maint
+	flag.DurationVar(&m.minAge, "min-age", time.Hour, "only process files not modified for this long")
+	flag.StringVar(&m.match, "match", "", "only process file names matching this glob, e.g. '*.cbor*'")
+	flag.StringVar(&m.uploadCmd, "upload-cmd", "", "run for each .gz, {} is replaced by the path, e.g. 'aws s3 cp {} s3://bucket/receiver/'")
+	flag.BoolVar(&m.keep, "keep", false, "keep originals after compressing")
+	flag.BoolVar(&m.dryRun, "n", false, "dry run, print files that would be processed")
+	flag.BoolVar(&m.verbose, "v", false, "verbose")
+	flag.Parse()
+	dirs := flag.Args()
+	if len(dirs) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: receiver_maint [flags] dir...\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	failed := false
+	for _, dir := range dirs {
+		paths, err := m.candidates(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", dir, err)
+			failed = true
+			continue
+		}
+		for _, path := range paths {
+			err = m.processFile(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+				failed = true
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
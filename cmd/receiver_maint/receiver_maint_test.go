@@ -0,0 +1,171 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSkipName(t *testing.T) {
+	for _, name := range []string{
+		"MANIFEST.sha256", "a.cbor.gz", "a.cbor.1.gz", "f.bin.meta",
+		"f.bin.sha256", "f.bin.sha512", "f.bin.sha1", "f.bin.blake2b",
+		"a.cbor.123.receiver-tmp",
+	} {
+		if !skipName(name) {
+			t.Errorf("%s not skipped", name)
+		}
+	}
+	for _, name := range []string{"a.cbor", "a.1.cbor", "f.bin", "sha256.cbor"} {
+		if skipName(name) {
+			t.Errorf("%s skipped", name)
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-3 * time.Hour)
+	for _, name := range []string{"a.cbor", "a.1.cbor", "a.cbor.1.gz", "f.bin", "f.bin.sha512", "f.bin.blake2b", "f.bin.meta", "new.cbor"} {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "new.cbor" {
+			os.Chtimes(path, old, old)
+		}
+	}
+	m := &maint{minAge: 2 * time.Hour}
+	got, err := m.candidates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, path := range got {
+		names = append(names, filepath.Base(path))
+	}
+	want := []string{"a.1.cbor", "a.cbor", "f.bin"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("candidates %v, want %v", names, want)
+	}
+}
+
+// writeOld writes files into dir with mtimes age ago
+func writeOld(t *testing.T, dir string, age time.Duration, names ...string) {
+	t.Helper()
+	when := time.Now().Add(-age)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(strings.Repeat(name, 100)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, when, when)
+	}
+}
+
+func gunzipFile(t *testing.T, path string) string {
+	t.Helper()
+	fin, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fin.Close()
+	gz, err := gzip.NewReader(fin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(blob)
+}
+
+func TestProcessDir(t *testing.T) {
+	dir := t.TempDir()
+	uploaded := t.TempDir()
+	writeOld(t, dir, 3*time.Hour, "a.cbor", "a.1.cbor", "b.jsonl")
+	writeOld(t, dir, time.Minute, "current.cbor")
+	m := &maint{minAge: 2 * time.Hour, match: "*.cbor", uploadCmd: "cp {} " + uploaded}
+	paths, err := m.candidates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		err = m.processFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	want := []string{manifestName, "a.1.cbor.gz", "a.cbor.gz", "b.jsonl", "current.cbor"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("files %v, want %v", names, want)
+	}
+	for _, name := range []string{"a.cbor", "a.1.cbor"} {
+		if got := gunzipFile(t, filepath.Join(dir, name+".gz")); got != strings.Repeat(name, 100) {
+			t.Errorf("%s.gz holds %q", name, got)
+		}
+		if _, err := os.Stat(filepath.Join(uploaded, name+".gz")); err != nil {
+			t.Errorf("not uploaded: %s", err)
+		}
+	}
+	// the manifest checks as sha256sum -c would
+	manifest, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(manifest)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("manifest %q", manifest)
+	}
+	for _, line := range lines {
+		sum, name, _ := strings.Cut(line, "  ")
+		blob, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sha256.Sum256(blob); hex.EncodeToString(got[:]) != sum {
+			t.Errorf("%s: manifest sum doesn't match", name)
+		}
+	}
+	// nothing left to do
+	paths, err = m.candidates(dir)
+	if err != nil || len(paths) != 0 {
+		t.Fatalf("second pass %v, err %v", paths, err)
+	}
+}
+
+func TestProcessKeepAndDryRun(t *testing.T) {
+	dir := t.TempDir()
+	writeOld(t, dir, 3*time.Hour, "a.cbor")
+	path := filepath.Join(dir, "a.cbor")
+	err := (&maint{dryRun: true}).processFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".gz"); !os.IsNotExist(err) {
+		t.Fatalf("dry run compressed: %v", err)
+	}
+	err = (&maint{keep: true}).processFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.cbor", "a.cbor.gz"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
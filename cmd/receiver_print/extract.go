@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"bolson.org/receiver/data"
+)
+
+// extensions for -extract file names, by media type
+var extensions = map[string]string{
+	"application/cbor":         ".cbor",
+	"application/gzip":         ".gz",
+	"application/json":         ".json",
+	"application/octet-stream": ".bin",
+	"application/pdf":          ".pdf",
+	"application/xml":          ".xml",
+	"application/zip":          ".zip",
+	"audio/mpeg":               ".mp3",
+	"audio/wav":                ".wav",
+	"image/gif":                ".gif",
+	"image/jpeg":               ".jpg",
+	"image/png":                ".png",
+	"image/svg+xml":            ".svg",
+	"image/webp":               ".webp",
+	"text/csv":                 ".csv",
+	"text/html":                ".html",
+	"text/plain":               ".txt",
+	"text/xml":                 ".xml",
+	"video/mp4":                ".mp4",
+}
+
+// extensionFor is the file extension for a Content-Type, ".bin" if unknown
+func extensionFor(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		if ext, ok := extensions[mediaType]; ok {
+			return ext
+		}
+	}
+	return ".bin"
+}
+
+// extractor writes each record's data to its own file, for -extract
+type extractor struct {
+	dir string
+
+	// files is how many have been written
+	files int
+}
+
+// extract writes the records of fin to dir/<When><ext>. Records with the
+// same When get "-1", "-2"... rather than replacing each other.
+func (ex *extractor) extract(fin io.Reader) error {
+	rr := newRecordReader(fin)
+	var rec data.ReceiverRecord
+	for {
+		err := rr.Next(&rec)
+		if err != nil {
+			return err
+		}
+		if len(rec.Nonce) != 0 {
+			fmt.Fprintf(os.Stderr, "record t=%d: encrypted, skipped, see -key\n", rec.When)
+			continue
+		}
+		err = ex.write(&rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// write puts one record's data in dir/<When><ext>
+func (ex *extractor) write(rec *data.ReceiverRecord) error {
+	name := strconv.FormatInt(rec.When, 10)
+	ext := extensionFor(rec.ContentType)
+	fpath := filepath.Join(ex.dir, name+ext)
+	var err error
+	for seq := 1; ; seq++ {
+		err = writeNewFile(fpath, rec.Data)
+		if !os.IsExist(err) {
+			break
+		}
+		fpath = filepath.Join(ex.dir, name+"-"+strconv.Itoa(seq)+ext)
+	}
+	if err != nil {
+		return err
+	}
+	ex.files++
+	return nil
+}
+
+// writeNewFile is os.WriteFile that fails if fpath exists
+func writeNewFile(fpath string, blob []byte) error {
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(blob)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// readRawMeta reads the data.RawMeta sidecar of a raw file, if it has one
+func readRawMeta(path string) (data.RawMeta, bool) {
+	var meta data.RawMeta
+	blob, err := os.ReadFile(path + data.RawMetaSuffix)
+	if err != nil {
+		return meta, false
+	}
+	err = json.Unmarshal(blob, &meta)
+	return meta, err == nil
+}
+
+// extractRaw copies a raw unit's file, which holds one record's bytes
+// with no framing, as extract would that record
+func (ex *extractor) extractRaw(path string, meta data.RawMeta) error {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ex.write(&data.ReceiverRecord{When: meta.When, Data: blob, ContentType: meta.ContentType})
+}
@@ -2,26 +2,316 @@ package main
 
 import (
 	"bolson.org/receiver/data"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	cbor "github.com/brianolson/cbor_go"
+	"github.com/klauspost/compress/zstd"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type PrintableReceiverRecord struct {
-	When        int64  `json:"t"`
-	Data        string `json:"d"`
-	ContentType string `json:"Content-Type"`
+	When        int64               `json:"t"`
+	Time        string              `json:"time"`
+	Data        string              `json:"d"`
+	ContentType string              `json:"Content-Type"`
+	Name        string              `json:"name,omitempty"`
+	Headers     map[string]string   `json:"headers,omitempty"`
+	Query       map[string][]string `json:"query,omitempty"`
+	Path        string              `json:"path,omitempty"`
+	RemoteAddr  string              `json:"remote,omitempty"`
+	Tags        map[string]string   `json:"tags,omitempty"`
 }
 
 type JSONReceiverRecord struct {
-	When        int64          `json:"t"`
-	Data        map[string]any `json:"d"`
-	ContentType string         `json:"Content-Type"`
+	When        int64               `json:"t"`
+	Time        string              `json:"time"`
+	Data        any                 `json:"d"`
+	ContentType string              `json:"Content-Type"`
+	Name        string              `json:"name,omitempty"`
+	Headers     map[string]string   `json:"headers,omitempty"`
+	Query       map[string][]string `json:"query,omitempty"`
+	Path        string              `json:"path,omitempty"`
+	RemoteAddr  string              `json:"remote,omitempty"`
+	Tags        map[string]string   `json:"tags,omitempty"`
+}
+
+// timedRecord is a record printed as it is, plus "time"
+type timedRecord struct {
+	*data.ReceiverRecord
+	Time string `json:"time"`
+}
+
+// recordTime is RFC3339 for "time", whatever the unit's TimePrecision
+func recordTime(rec *data.ReceiverRecord) string {
+	return rec.Time().UTC().Format(time.RFC3339Nano)
+}
+
+// printOptions are set from flags in main()
+type printOptions struct {
+	// framing around each record, see ReceiverUnitConfig.BlobPrefix
+	blobPrefix []byte
+	blobSuffix []byte
+
+	// skip records before minTime and from maxTime on, if set
+	minTime time.Time
+	maxTime time.Time
+
+	// decrypt records, from -key
+	aead cipher.AEAD
+
+	// print data.FileHeader lines instead of skipping them
+	showHeader bool
+
+	// formatCBOR or formatJSON, or "" to detect from each file
+	format string
+
+	// skip past CBOR records that don't decode instead of stopping
+	skipErrors bool
+
+	// JSON keys renamed by the unit's FieldNames, from -field-names
+	fieldNames map[string]string
+
+	// only records with a Content-Type starting with one of these, or
+	// with invertContentTypes none of them
+	contentTypes       stringList
+	invertContentTypes bool
+}
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(v string) error {
+	*sl = append(*sl, v)
+	return nil
+}
+
+// contentTypeWanted applies -content-type and -v
+func contentTypeWanted(contentType string) bool {
+	if len(opts.contentTypes) == 0 {
+		return true
+	}
+	for _, prefix := range opts.contentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return !opts.invertContentTypes
+		}
+	}
+	return opts.invertContentTypes
+}
+
+// parseTimeArg parses -since and -until, RFC3339 or unix milliseconds
+func parseTimeArg(arg string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339Nano, arg)
+}
+
+// parseFieldNames parses -field-names "t=timestamp,d=payload"
+func parseFieldNames(arg string) (map[string]string, error) {
+	names := make(map[string]string)
+	for _, pair := range strings.Split(arg, ",") {
+		field, rename, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%#v: want field=name", pair)
+		}
+		names[field] = rename
+	}
+	return names, data.CheckFieldNames(names)
+}
+
+// record formats, as in the receiver's format setting
+const (
+	formatCBOR = "cbor"
+	formatJSON = "json"
+
+	// formatJSONL is another name for formatJSON
+	formatJSONL = "jsonl"
+)
+
+var opts printOptions
+
+// recordReader decodes a stream of ReceiverRecord, stripping any
+// framing configured in opts
+type recordReader struct {
+	in  io.Reader
+	dec *cbor.Decoder
+
+	// jdec is set instead of dec for JSON records, one per line or
+	// in a JSON array
+	jdec      *json.Decoder
+	jsonArray bool
+
+	// header is the data.FileHeader line the file started with, if any
+	header []byte
+
+	// resync is set for -skip-errors, under in and dec
+	resync *resyncReader
+
+	// err is returned by next() for a file that can't be read
+	err error
+}
+
+func newRecordReader(fin io.Reader) *recordReader {
+	br := bufio.NewReader(fin)
+	rr := &recordReader{in: br}
+	start, _ := br.Peek(len(data.FileHeaderMagic))
+	if data.IsFileHeader(start) {
+		rr.header, _ = br.ReadBytes('\n')
+	}
+	format := opts.format
+	first := firstNonSpace(br)
+	if format == "" {
+		format = formatCBOR
+		if first == '{' || first == '[' {
+			format = formatJSON
+		}
+	}
+	if format == formatCBOR {
+		if opts.skipErrors {
+			rr.resync = &resyncReader{r: br}
+			rr.in = rr.resync
+		}
+		rr.dec = cbor.NewDecoder(rr.in)
+		return rr
+	}
+	if len(opts.blobPrefix) != 0 || len(opts.blobSuffix) != 0 {
+		rr.err = errors.New("-blob-prefix and -blob-suffix are only for CBOR records")
+		return rr
+	}
+	rr.jdec = json.NewDecoder(br)
+	if first == '[' {
+		_, rr.err = rr.jdec.Token()
+		rr.jsonArray = true
+	}
+	return rr
+}
+
+// firstNonSpace peeks at the first byte after any whitespace, 0 if none
+func firstNonSpace(br *bufio.Reader) byte {
+	start, _ := br.Peek(512)
+	trimmed := bytes.TrimLeft(start, " \t\r\n")
+	if len(trimmed) == 0 {
+		return 0
+	}
+	return trimmed[0]
+}
+
+// writeHeader copies the file header to out if -header was given
+func (rr *recordReader) writeHeader(out io.Writer) error {
+	if !opts.showHeader || len(rr.header) == 0 {
+		return nil
+	}
+	_, err := out.Write(rr.header)
+	return err
+}
+
+// expectBytes reads len(expected) bytes which must match.
+// Clean EOF before any bytes is io.EOF.
+func expectBytes(fin io.Reader, expected []byte, what string) error {
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(fin, buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, expected) {
+		return fmt.Errorf("bad %s, got %q", what, buf)
+	}
+	return nil
+}
+
+// Next reads the next record that passes the filters in opts
+func (rr *recordReader) Next(rec *data.ReceiverRecord) error {
+	for {
+		err := rr.next(rec)
+		if err != nil {
+			return err
+		}
+		if !opts.minTime.IsZero() && rec.Time().Before(opts.minTime) {
+			continue
+		}
+		if !opts.maxTime.IsZero() && !rec.Time().Before(opts.maxTime) {
+			continue
+		}
+		if !contentTypeWanted(rec.ContentType) {
+			continue
+		}
+		if len(rec.Nonce) != 0 && opts.aead != nil {
+			err = rec.Decrypt(opts.aead)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "record t=%d: decrypt: %s\n", rec.When, err)
+				continue
+			}
+		}
+		return nil
+	}
+}
+
+func (rr *recordReader) next(rec *data.ReceiverRecord) error {
+	// the decoder only sets fields present, clear any from the last record
+	*rec = data.ReceiverRecord{}
+	if rr.err != nil {
+		return rr.err
+	}
+	if rr.jdec != nil {
+		if rr.jsonArray && !rr.jdec.More() {
+			return io.EOF
+		}
+		if opts.fieldNames == nil {
+			return rr.jdec.Decode(rec)
+		}
+		var blob json.RawMessage
+		err := rr.jdec.Decode(&blob)
+		if err != nil {
+			return err
+		}
+		return data.UnmarshalJSONFields(blob, opts.fieldNames, rec)
+	}
+	if rr.resync != nil {
+		return rr.nextResync(rec)
+	}
+	// e.g. -format cbor over a JSON file is an error, not a crash
+	return rr.nextCBORSafe(rec)
+}
+
+// nextCBOR reads a CBOR record and any framing around it
+func (rr *recordReader) nextCBOR(rec *data.ReceiverRecord) error {
+	if len(opts.blobPrefix) != 0 {
+		err := expectBytes(rr.in, opts.blobPrefix, "blob prefix")
+		if err != nil {
+			return err
+		}
+	}
+	err := rr.dec.Decode(rec)
+	if err != nil {
+		return err
+	}
+	if len(opts.blobSuffix) != 0 {
+		err = expectBytes(rr.in, opts.blobSuffix, "blob suffix")
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func isPrintableContentType(contentType string) bool {
@@ -34,113 +324,477 @@ func isPrintableContentType(contentType string) bool {
 	return false
 }
 
+// printPretty writes one record as indented JSON, with text and JSON
+// bodies shown readably. Encode ends it with the only newline, records
+// are not separated by blank lines.
+func printPretty(enc *json.Encoder, rec *data.ReceiverRecord) error {
+	var err error
+	if len(rec.Nonce) != 0 {
+		// still encrypted, no -key
+		err = enc.Encode(timedRecord{rec, recordTime(rec)})
+	} else if strings.HasPrefix(rec.ContentType, "text/") {
+		prec := PrintableReceiverRecord{
+			When:        rec.When,
+			Time:        recordTime(rec),
+			Data:        string(rec.Data),
+			ContentType: rec.ContentType,
+			Name:        rec.Name,
+			Headers:     rec.Headers,
+			Query:       rec.Query,
+			Path:        rec.Path,
+			RemoteAddr:  rec.RemoteAddr,
+			Tags:        rec.Tags,
+		}
+		err = enc.Encode(prec)
+	} else if strings.HasPrefix(rec.ContentType, "application/json") {
+		jrec := JSONReceiverRecord{
+			When:        rec.When,
+			Time:        recordTime(rec),
+			ContentType: rec.ContentType,
+			Name:        rec.Name,
+			Headers:     rec.Headers,
+			Query:       rec.Query,
+			Path:        rec.Path,
+			RemoteAddr:  rec.RemoteAddr,
+			Tags:        rec.Tags,
+		}
+		// any JSON value, e.g. a text body json-wrap made a string
+		err = json.Unmarshal(rec.Data, &jrec.Data)
+		if err != nil {
+			return fmt.Errorf("sub unmarshal, %w", err)
+		}
+		err = enc.Encode(jrec)
+	} else {
+		err = enc.Encode(timedRecord{rec, recordTime(rec)})
+	}
+	return err
+}
+
 func prettyPrintJson(fin io.Reader, out io.Writer) error {
 	enc := json.NewEncoder(out)
 	enc.SetIndent("", "  ")
-	dec := cbor.NewDecoder(fin)
+	rr := newRecordReader(fin)
+	err := rr.writeHeader(out)
+	if err != nil {
+		return err
+	}
 	var rec data.ReceiverRecord
 	for {
-		err := dec.Decode(&rec)
+		err = rr.Next(&rec)
 		if err != nil {
 			return err
 		}
-		if strings.HasPrefix(rec.ContentType, "text/") {
-			prec := PrintableReceiverRecord{
-				When:        rec.When,
-				Data:        string(rec.Data),
-				ContentType: rec.ContentType,
-			}
-			err = enc.Encode(prec)
-			if err != nil {
-				return err
-			}
-		} else if strings.HasPrefix(rec.ContentType, "application/json") {
-			jrec := JSONReceiverRecord{
-				When:        rec.When,
-				ContentType: rec.ContentType,
-			}
-			jrec.Data = make(map[string]any)
-			err = json.Unmarshal(rec.Data, &jrec.Data)
-			if err != nil {
-				return fmt.Errorf("sub unmarshal, %w", err)
-			}
-			err = enc.Encode(jrec)
-			if err != nil {
-				return err
-			}
-		} else {
-			err = enc.Encode(&rec)
-			if err != nil {
-				return err
-			}
-		}
-		_, err = out.Write([]byte("\n"))
+		err = printPretty(enc, &rec)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
 }
+
+// printLine writes one record as a line of JSON, the newline from Encode
+func printLine(enc *json.Encoder, rec *data.ReceiverRecord) error {
+	if isPrintableContentType(rec.ContentType) && len(rec.Nonce) == 0 {
+		prec := PrintableReceiverRecord{
+			When:        rec.When,
+			Time:        recordTime(rec),
+			Data:        string(rec.Data),
+			ContentType: rec.ContentType,
+			Name:        rec.Name,
+			Headers:     rec.Headers,
+			Query:       rec.Query,
+			Path:        rec.Path,
+			RemoteAddr:  rec.RemoteAddr,
+			Tags:        rec.Tags,
+		}
+		return enc.Encode(prec)
+	}
+	return enc.Encode(timedRecord{rec, recordTime(rec)})
+}
+
 func jsonPerLine(fin io.Reader, out io.Writer) error {
 	enc := json.NewEncoder(out)
-	dec := cbor.NewDecoder(fin)
+	rr := newRecordReader(fin)
+	err := rr.writeHeader(out)
+	if err != nil {
+		return err
+	}
 	var rec data.ReceiverRecord
 	for {
-		err := dec.Decode(&rec)
+		err = rr.Next(&rec)
 		if err != nil {
 			return err
 		}
-		if isPrintableContentType(rec.ContentType) {
-			prec := PrintableReceiverRecord{
-				When:        rec.When,
-				Data:        string(rec.Data),
-				ContentType: rec.ContentType,
-			}
-			err = enc.Encode(prec)
-			if err != nil {
-				return err
+		err = printLine(enc, &rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// mergeSource is one file being merged, with its next record
+type mergeSource struct {
+	path string
+	in   io.Closer
+	rr   *recordReader
+	rec  data.ReceiverRecord
+}
+
+// mergeFiles prints the records of all paths in time order, e.g. the
+// stripes of a unit with Stripes. Each file must already be in order,
+// as append files are.
+func mergeFiles(paths []string, out io.Writer, pretty bool) error {
+	enc := json.NewEncoder(out)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	var sources []*mergeSource
+	defer func() {
+		for _, src := range sources {
+			src.in.Close()
+		}
+	}()
+	// next advances src, dropping it from sources at the end
+	next := func(i int) error {
+		src := sources[i]
+		err := src.rr.Next(&src.rec)
+		if errors.Is(err, io.EOF) {
+			src.in.Close()
+			sources = append(sources[:i], sources[i+1:]...)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", src.path, err)
+		}
+		return nil
+	}
+	for _, path := range paths {
+		rawin, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		fin, err := maybeDecompress(rawin)
+		if err != nil {
+			rawin.Close()
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		src := &mergeSource{path: path, in: rawin, rr: newRecordReader(fin)}
+		err = src.rr.writeHeader(out)
+		if err != nil {
+			rawin.Close()
+			return err
+		}
+		sources = append(sources, src)
+		err = next(len(sources) - 1)
+		if err != nil {
+			return err
+		}
+	}
+	for len(sources) != 0 {
+		first := 0
+		for i, src := range sources {
+			if src.rec.Time().Before(sources[first].rec.Time()) {
+				first = i
 			}
+		}
+		var err error
+		if pretty {
+			err = printPretty(enc, &sources[first].rec)
 		} else {
-			err = enc.Encode(&rec)
-			if err != nil {
-				return err
+			err = printLine(enc, &sources[first].rec)
+		}
+		if err != nil {
+			return err
+		}
+		err = next(first)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zstdMagic starts a zstd frame, see RFC 8878
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// maybeDecompress returns a reader of the decompressed stream if fin
+// starts with gzip or zstd magic, otherwise a reader of fin as-is.
+//
+// Compressed append files may be several gzip members concatenated
+// (one per flush or rotation); gzip.Reader's multistream mode (the
+// default, set explicitly here) reads through all of them to EOF.
+// The zstd decoder likewise reads through concatenated frames.
+func maybeDecompress(fin io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(fin)
+	magic, _ := br.Peek(len(zstdMagic))
+	if bytes.Equal(magic, zstdMagic) {
+		// one goroutine-free decoder per file, nothing to Close
+		return zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+	}
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		// not gzip, or too short to be, let the decoder sort it out
+		return br, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	gz.Multistream(true)
+	return gz, nil
+}
+
+// expandArgs expands glob arguments, e.g. 'data/*.cbor', each to its
+// matches in sorted order. "**" matches any depth of directories, e.g.
+// 'data/**/*.cbor'. Arguments without glob characters pass through.
+func expandArgs(args []string) ([]string, error) {
+	var out []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			out = append(out, arg)
+			continue
+		}
+		var matches []string
+		var err error
+		if strings.Contains(arg, "**") {
+			matches, err = globRecursive(arg)
+		} else {
+			matches, err = filepath.Glob(arg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no files match", arg)
+		}
+		sort.Strings(matches)
+		out = append(out, matches...)
+	}
+	return out, nil
+}
+
+// globRecursive handles "root/**/rest": files under root whose trailing
+// path components match rest
+func globRecursive(pattern string) ([]string, error) {
+	root, rest, _ := strings.Cut(pattern, "**")
+	root = filepath.Clean(root)
+	if root == "" {
+		root = "."
+	}
+	rest = strings.TrimPrefix(rest, string(filepath.Separator))
+	if rest == "" {
+		rest = "*"
+	}
+	if strings.Contains(rest, "**") {
+		return nil, errors.New("only one ** is supported")
+	}
+	// check the pattern once rather than per file
+	_, err := filepath.Match(rest, "")
+	if err != nil {
+		return nil, err
+	}
+	depth := strings.Count(rest, string(filepath.Separator)) + 1
+	var matches []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		parts := strings.Split(path, string(filepath.Separator))
+		if len(parts) < depth {
+			return nil
+		}
+		tail := filepath.Join(parts[len(parts)-depth:]...)
+		ok, _ := filepath.Match(rest, tail)
+		if ok {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// output is where main sends records: -extract, -stat, or printed
+type output struct {
+	ex     *extractor
+	st     *stats
+	pretty bool
+	out    io.Writer
+}
+
+// records handles the records of one input, until an error or io.EOF
+func (o *output) records(fin io.Reader) error {
+	switch {
+	case o.ex != nil:
+		return o.ex.extract(fin)
+	case o.st != nil:
+		return o.st.add(fin)
+	case o.pretty:
+		return prettyPrintJson(fin, o.out)
+	}
+	return jsonPerLine(fin, o.out)
+}
+
+// files handles each of paths in turn. A file that can't be read is
+// reported to errOut and skipped.
+func (o *output) files(paths []string, errOut io.Writer) {
+	for _, path := range paths {
+		if o.ex != nil {
+			if strings.HasSuffix(path, data.RawMetaSuffix) {
+				continue
 			}
+			// a raw unit's file, named for its sidecar's Content-Type
+			if meta, ok := readRawMeta(path); ok {
+				err := o.ex.extractRaw(path, meta)
+				if err != nil {
+					fmt.Fprintf(errOut, "%s: %s\n", path, err)
+				}
+				continue
+			}
+		}
+		rawin, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(errOut, "%s: %s\n", path, err)
+			continue
+		}
+		fin, err := maybeDecompress(rawin)
+		if err != nil {
+			fmt.Fprintf(errOut, "%s: %s\n", path, err)
+			rawin.Close()
+			continue
+		}
+		err = o.records(fin)
+		rawin.Close()
+		if errors.Is(err, io.EOF) {
+			// okay!
+		} else if err != nil {
+			fmt.Fprintf(errOut, "%s: %s\n", path, err)
 		}
-		// Where is the newline coming from?
-		//_, err = out.Write([]byte("\n"))
-		//if err != nil {
-		//	return err
-		//}
 	}
 }
 
 func main() {
 	var pretty bool
 	flag.BoolVar(&pretty, "pretty", false, "Pretty print JSON")
+	var blobPrefix, blobSuffix string
+	flag.StringVar(&blobPrefix, "blob-prefix", "", "strip this from before each record")
+	flag.StringVar(&blobSuffix, "blob-suffix", "", "strip this from after each record")
+	var maxAge time.Duration
+	flag.DurationVar(&maxAge, "max-age", 0, "skip records older than this, e.g. 24h")
+	var since, until string
+	flag.StringVar(&since, "since", "", "skip records before this time, RFC3339 or unix milliseconds")
+	flag.StringVar(&until, "until", "", "skip records at or after this time, RFC3339 or unix milliseconds")
+	flag.Var(&opts.contentTypes, "content-type", "only records with a Content-Type starting with this, may be repeated")
+	flag.BoolVar(&opts.invertContentTypes, "v", false, "with -content-type, only records that don't match")
+	flag.BoolVar(&opts.skipErrors, "skip-errors", false, "on a CBOR record that doesn't decode, report it and look byte by byte for the next one instead of stopping")
+	var keyb64 string
+	var fieldNames string
+	flag.StringVar(&fieldNames, "field-names", "", "JSON keys as renamed by the unit's field-names, e.g. t=timestamp,d=payload")
+	flag.StringVar(&opts.format, "format", "", "record format, cbor or jsonl, default detected per file")
+	var merge bool
+	var extractDir string
+	var stat bool
+	flag.BoolVar(&stat, "stat", false, "print a summary (record count, bytes, time range, count per Content-Type) instead of the records")
+	flag.StringVar(&extractDir, "extract", "", "write each record's data to a file in this directory, named for its time and Content-Type, instead of printing; raw files with a .meta sidecar are copied named from it")
+	flag.BoolVar(&merge, "merge", false, "print the records of all files together in time order, e.g. a unit's stripes")
+	flag.BoolVar(&opts.showHeader, "header", false, "print file header lines, see the unit's file-header")
+	flag.StringVar(&keyb64, "key", "", "base64 key to decrypt records, as in the unit's encrypt-key")
 	flag.Parse()
+	switch opts.format {
+	case formatJSONL:
+		opts.format = formatJSON
+	case "", formatCBOR, formatJSON:
+	default:
+		fmt.Fprintf(os.Stderr, "-format: want cbor or jsonl\n")
+		os.Exit(1)
+	}
+	if fieldNames != "" {
+		var err error
+		opts.fieldNames, err = parseFieldNames(fieldNames)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-field-names: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if keyb64 != "" {
+		var err error
+		opts.aead, err = data.ParseKey(keyb64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if maxAge > 0 {
+		opts.minTime = time.Now().Add(-maxAge)
+	}
+	if since != "" {
+		t, err := parseTimeArg(since)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-since: %s\n", err)
+			os.Exit(1)
+		}
+		if t.After(opts.minTime) {
+			opts.minTime = t
+		}
+	}
+	if until != "" {
+		var err error
+		opts.maxTime, err = parseTimeArg(until)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-until: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	opts.blobPrefix = []byte(blobPrefix)
+	opts.blobSuffix = []byte(blobSuffix)
+	if (extractDir != "" && (merge || stat)) || (merge && stat) {
+		fmt.Fprintf(os.Stderr, "only one of -extract, -merge, and -stat\n")
+		os.Exit(1)
+	}
+	var st *stats
+	if stat {
+		st = newStats()
+		defer st.write(os.Stdout)
+	}
+	var ex *extractor
+	if extractDir != "" {
+		err := os.MkdirAll(extractDir, 0755)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-extract: %s\n", err)
+			os.Exit(1)
+		}
+		ex = &extractor{dir: extractDir}
+		defer func() {
+			fmt.Fprintf(os.Stderr, "%d files written to %s\n", ex.files, extractDir)
+		}()
+	}
+	o := &output{ex: ex, st: st, pretty: pretty, out: os.Stdout}
 	args := flag.Args()
 	if len(args) == 0 {
-		if pretty {
-			prettyPrintJson(os.Stdin, os.Stdout)
-		} else {
-			jsonPerLine(os.Stdin, os.Stdout)
+		fin, err := maybeDecompress(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "stdin: %s\n", err)
+			os.Exit(1)
+		}
+		err = o.records(fin)
+		if err != nil && !errors.Is(err, io.EOF) {
+			fmt.Fprintf(os.Stderr, "stdin: %s\n", err)
+			os.Exit(1)
 		}
 	} else {
-		for _, path := range args {
-			fin, err := os.Open(path)
+		paths, err := expandArgs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		if merge {
+			err = mergeFiles(paths, os.Stdout, pretty)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, "%s: %s\n", path, err)
-			}
-			if pretty {
-				err = prettyPrintJson(fin, os.Stdout)
-			} else {
-				err = jsonPerLine(fin, os.Stdout)
-			}
-			if errors.Is(err, io.EOF) {
-				// okay!
-			} else if err != nil {
-				fmt.Fprintln(os.Stderr, "%s: %s\n", path, err)
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
 			}
+			return
 		}
+		o.files(paths, os.Stderr)
 	}
 }
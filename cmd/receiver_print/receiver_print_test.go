@@ -0,0 +1,872 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"bolson.org/receiver/data"
+	cbor "github.com/brianolson/cbor_go"
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipBytes(t *testing.T, blob []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(blob)
+	err := gz.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, blob []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(blob)
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestMaybeDecompress(t *testing.T) {
+	// a CBOR map header, as an uncompressed file starts
+	plain := []byte("\xa2\x61t\x01\x61d\x41x")
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"plain", plain, plain},
+		{"empty", nil, nil},
+		{"one byte", []byte{0x1f}, []byte{0x1f}},
+		{"gzip", gzipBytes(t, plain), plain},
+		{"gzip members", concat(gzipBytes(t, plain), gzipBytes(t, []byte("two"))), concat(plain, []byte("two"))},
+		{"zstd", zstdBytes(t, plain), plain},
+		{"zstd frames", concat(zstdBytes(t, plain), zstdBytes(t, []byte("two"))), concat(plain, []byte("two"))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := maybeDecompress(bytes.NewReader(tc.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMaybeDecompressTruncated(t *testing.T) {
+	blob := bytes.Repeat([]byte("hello world "), 1000)
+	for name, in := range map[string][]byte{
+		"gzip": gzipBytes(t, blob),
+		"zstd": zstdBytes(t, blob),
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, err := maybeDecompress(bytes.NewReader(in[:len(in)/2]))
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if err == nil {
+				t.Fatal("no error from truncated stream")
+			}
+		})
+	}
+}
+
+// encodeRecords is recs as a CBOR append file holds them
+func encodeRecords(t *testing.T, recs ...data.ReceiverRecord) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := cbor.NewEncoder(&buf)
+	for i := range recs {
+		err := enc.Encode(&recs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeRecords writes recs as a CBOR append file in dir
+func writeRecords(t *testing.T, dir, name string, recs ...data.ReceiverRecord) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, encodeRecords(t, recs...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func textRecord(when int64, d string) data.ReceiverRecord {
+	return data.ReceiverRecord{When: when, Data: []byte(d), ContentType: "text/plain"}
+}
+
+// printedData runs jsonPerLine over blob, as receiver_print does a
+// file, and returns the "d" of each line
+func printedData(t *testing.T, blob []byte) []string {
+	t.Helper()
+	fin, err := maybeDecompress(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = jsonPerLine(fin, &out)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("jsonPerLine: %v", err)
+	}
+	return decodePrinted(t, &out)
+}
+
+// decodePrinted is the "d" of each record printed to out
+func decodePrinted(t *testing.T, out io.Reader) []string {
+	t.Helper()
+	var got []string
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var prec PrintableReceiverRecord
+		err := dec.Decode(&prec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, prec.Data)
+	}
+	return got
+}
+
+func TestGzipMembers(t *testing.T) {
+	const t0 = 1772600000000
+	// as a compressed append file is after a flush and a reopen
+	blob := concat(
+		gzipBytes(t, encodeRecords(t, textRecord(t0, "1"), textRecord(t0+1, "2"))),
+		gzipBytes(t, encodeRecords(t, textRecord(t0+2, "3"))))
+	got := printedData(t, blob)
+	if strings.Join(got, ",") != "1,2,3" {
+		t.Fatalf("printed %v", got)
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	dir := t.TempDir()
+	const t0 = 1772600000000
+	s0 := writeRecords(t, dir, "a.s0.cbor", textRecord(t0, "1"), textRecord(t0+30, "4"), textRecord(t0+40, "5"))
+	s1 := writeRecords(t, dir, "a.s1.cbor", textRecord(t0+10, "2"), textRecord(t0+20, "3"))
+	s2 := writeRecords(t, dir, "a.s2.cbor")
+	var out bytes.Buffer
+	err := mergeFiles([]string{s0, s1, s2}, &out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodePrinted(t, &out)
+	if strings.Join(got, "") != "12345" {
+		t.Fatalf("merged %v", got)
+	}
+}
+
+// setOpts replaces the flag options for one test
+func setOpts(t *testing.T, o printOptions) {
+	saved := opts
+	opts = o
+	t.Cleanup(func() { opts = saved })
+}
+
+func TestBlobFraming(t *testing.T) {
+	const t0 = 1772600000000
+	var framed []byte
+	for _, d := range []string{"1", "2"} {
+		framed = concat(framed, []byte("REC>"), encodeRecords(t, textRecord(t0, d)), []byte("<END\n"))
+	}
+	setOpts(t, printOptions{blobPrefix: []byte("REC>"), blobSuffix: []byte("<END\n")})
+	if got := printedData(t, framed); strings.Join(got, ",") != "1,2" {
+		t.Fatalf("printed %v", got)
+	}
+	// a wrong prefix is an error, not garbage records
+	setOpts(t, printOptions{blobPrefix: []byte("XXX>"), blobSuffix: []byte("<END\n")})
+	var out bytes.Buffer
+	err := jsonPerLine(bytes.NewReader(framed), &out)
+	if err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("wrong prefix: %v", err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UnixMilli()
+	day := (24 * time.Hour).Milliseconds()
+	recs := []data.ReceiverRecord{
+		textRecord(now-3*day, "old"),
+		textRecord(now-60_000, "new"),
+		textRecord(now-2*day, "old"),
+		textRecord(now, "newer"),
+	}
+	path := writeRecords(t, dir, "a.cbor", recs...)
+	// as -max-age 24h does
+	setOpts(t, printOptions{minTime: time.Now().Add(-24 * time.Hour)})
+
+	if got := printedData(t, encodeRecords(t, recs...)); strings.Join(got, ",") != "new,newer" {
+		t.Errorf("print: %v", got)
+	}
+	var out bytes.Buffer
+	err := mergeFiles([]string{path}, &out, false)
+	if got := decodePrinted(t, &out); err != nil || strings.Join(got, ",") != "new,newer" {
+		t.Errorf("merge: %v, err %v", got, err)
+	}
+	st := newStats()
+	err = st.add(bytes.NewReader(encodeRecords(t, recs...)))
+	if !errors.Is(err, io.EOF) || st.records != 2 {
+		t.Errorf("stat: %d records, err %v", st.records, err)
+	}
+	ex := &extractor{dir: t.TempDir()}
+	err = ex.extract(bytes.NewReader(encodeRecords(t, recs...)))
+	if !errors.Is(err, io.EOF) || ex.files != 2 {
+		t.Errorf("extract: %d files, err %v", ex.files, err)
+	}
+}
+
+func TestSinceUntil(t *testing.T) {
+	since, err := parseTimeArg("2026-03-04T04:53:20Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	until, err := parseTimeArg("1772600010000")
+	if err != nil || !until.Equal(since.Add(10*time.Second)) {
+		t.Fatalf("unix millis: %s, %v", until, err)
+	}
+	if _, err := parseTimeArg("yesterday"); err == nil {
+		t.Error("parsed \"yesterday\"")
+	}
+	const t0 = 1772600000000
+	nano := func(ms int64, d string) data.ReceiverRecord {
+		return textRecord(ms*int64(time.Millisecond), d)
+	}
+	blob := encodeRecords(t,
+		textRecord(t0-1, "before"),
+		textRecord(t0, "at since"),
+		nano(t0-1, "nano before"),
+		nano(t0+5000, "nano in"),
+		textRecord(t0+9999, "last in"),
+		// -until is exclusive
+		textRecord(t0+10000, "at until"),
+		nano(t0+10000, "nano at until"),
+	)
+	setOpts(t, printOptions{minTime: since, maxTime: until})
+	if got := printedData(t, blob); strings.Join(got, ",") != "at since,nano in,last in" {
+		t.Errorf("printed %v", got)
+	}
+}
+
+func TestContentTypeFilter(t *testing.T) {
+	// short names for the types, the order they are in the file
+	names := map[string]string{
+		"image/jpeg":                      "jpeg",
+		"text/plain":                      "text",
+		"image/png":                       "png",
+		"application/json; charset=utf-8": "json",
+	}
+	var blob []byte
+	for _, contentType := range []string{"image/jpeg", "text/plain", "image/png", "application/json; charset=utf-8"} {
+		blob = concat(blob, encodeRecords(t, data.ReceiverRecord{When: 1772600000000, Data: []byte("{}"), ContentType: contentType}))
+	}
+	for _, tc := range []struct {
+		types  []string
+		invert bool
+		want   string
+	}{
+		{nil, false, "jpeg,text,png,json"},
+		{[]string{"image/jpeg"}, false, "jpeg"},
+		// prefixes
+		{[]string{"image/"}, false, "jpeg,png"},
+		{[]string{"application/json"}, false, "json"},
+		{[]string{"image/", "text/"}, false, "jpeg,text,png"},
+		{[]string{"image/"}, true, "text,json"},
+		{[]string{"image/", "text/"}, true, "json"},
+	} {
+		setOpts(t, printOptions{contentTypes: tc.types, invertContentTypes: tc.invert})
+		for _, pretty := range []bool{false, true} {
+			var out bytes.Buffer
+			var err error
+			if pretty {
+				err = prettyPrintJson(bytes.NewReader(blob), &out)
+			} else {
+				err = jsonPerLine(bytes.NewReader(blob), &out)
+			}
+			if !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			var got []string
+			dec := json.NewDecoder(&out)
+			for dec.More() {
+				var rec struct {
+					ContentType string `json:"Content-Type"`
+				}
+				err = dec.Decode(&rec)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, names[rec.ContentType])
+			}
+			if strings.Join(got, ",") != tc.want {
+				t.Errorf("%v -v=%v pretty %v: %v, want %s", tc.types, tc.invert, pretty, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	const t0 = 1772600000000
+	typed := func(when int64, size int, contentType string) data.ReceiverRecord {
+		return data.ReceiverRecord{When: when, Data: make([]byte, size), ContentType: contentType}
+	}
+	st := newStats()
+	// summed across files, which needn't be in order
+	for _, blob := range [][]byte{
+		encodeRecords(t, typed(t0+5000, 100, "image/jpeg"), typed(t0, 10, "text/plain"), typed(t0+1000, 20, "image/jpeg")),
+		gzipBytes(t, encodeRecords(t, typed(t0-2000, 1, "application/json"), typed(t0+3000, 2, "text/plain"), typed(t0+4000, 3, "image/jpeg"))),
+	} {
+		fin, err := maybeDecompress(bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = st.add(fin)
+		if !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	err := st.write(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `records 6
+bytes 136
+first 2026-03-04T04:53:18Z
+last 2026-03-04T04:53:25Z
+3	image/jpeg
+2	text/plain
+1	application/json
+`
+	if out.String() != want {
+		t.Errorf("stat\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	err = newStats().write(&out)
+	if err != nil || out.String() != "records 0\nbytes 0\n" {
+		t.Errorf("empty stat %q, %v", out.String(), err)
+	}
+}
+
+func TestSkipErrors(t *testing.T) {
+	const t0 = 1772600000000
+	truncated := encodeRecords(t, textRecord(t0, "truncated record"))
+	truncated = truncated[:len(truncated)/2]
+	blob := concat(
+		encodeRecords(t, textRecord(t0, "1")),
+		[]byte("junk between records"),
+		encodeRecords(t, textRecord(t0+1, "2")),
+		truncated,
+		encodeRecords(t, textRecord(t0+2, "3"), textRecord(t0+3, "4")),
+	)
+	// without -skip-errors the first bad record ends it, with an error
+	var out bytes.Buffer
+	err := jsonPerLine(bytes.NewReader(blob), &out)
+	if err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("bad record: %v", err)
+	}
+	if got := decodePrinted(t, &out); strings.Join(got, ",") != "1" {
+		t.Errorf("printed %v before the bad record", got)
+	}
+	setOpts(t, printOptions{skipErrors: true})
+	if got := printedData(t, blob); strings.Join(got, ",") != "1,2,3,4" {
+		t.Errorf("-skip-errors printed %v", got)
+	}
+}
+
+func TestMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	const t0 = 1772600000000
+	a := writeRecords(t, dir, "a.cbor", textRecord(t0, "a"))
+	b := writeRecords(t, dir, "b.cbor", textRecord(t0, "b"))
+	missing := filepath.Join(dir, "missing.cbor")
+	var out, errOut bytes.Buffer
+	o := &output{out: &out}
+	o.files([]string{a, missing, b}, &errOut)
+	// reported once, cleanly, and the next file is still printed
+	if got := errOut.String(); !strings.HasPrefix(got, missing+": open "+missing+": ") || strings.Count(got, "\n") != 1 {
+		t.Errorf("stderr %q", got)
+	}
+	if got := decodePrinted(t, &out); strings.Join(got, ",") != "a,b" {
+		t.Errorf("printed %v", got)
+	}
+}
+
+func TestFileHeader(t *testing.T) {
+	const t0 = 1772600000000
+	fh := data.FileHeader{Version: data.FileHeaderVersion, Unit: "a", Created: t0}
+	line, err := fh.MarshalLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := concat(line, encodeRecords(t, textRecord(t0, "1"), textRecord(t0+1, "2")))
+	if got := printedData(t, blob); strings.Join(got, ",") != "1,2" {
+		t.Fatalf("printed %v", got)
+	}
+	// -header
+	setOpts(t, printOptions{showHeader: true})
+	var out bytes.Buffer
+	err = jsonPerLine(bytes.NewReader(blob), &out)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("jsonPerLine: %v", err)
+	}
+	printed, rest, _ := bytes.Cut(out.Bytes(), []byte("\n"))
+	if !bytes.Equal(append(printed, '\n'), line) {
+		t.Fatalf("first line %q, want header %q", printed, line)
+	}
+	if got := decodePrinted(t, bytes.NewReader(rest)); strings.Join(got, ",") != "1,2" {
+		t.Fatalf("printed %v after header", got)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	for contentType, want := range map[string]string{
+		"image/jpeg":                      ".jpg",
+		"application/json; charset=utf-8": ".json",
+		"application/x-unheard-of":        ".bin",
+		"":                                ".bin",
+	} {
+		if got := extensionFor(contentType); got != want {
+			t.Errorf("extensionFor(%q) = %q, want %q", contentType, got, want)
+		}
+	}
+
+	const t0 = 1772600000000
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0, 0, 0x10, 'J', 'F', 'I', 'F', 0, 0xff, 0xd9}
+	recs := []data.ReceiverRecord{
+		{When: t0, Data: jpeg, ContentType: "image/jpeg"},
+		{When: t0 + 1, Data: []byte(`{"k":1}`), ContentType: "application/json"},
+		// same When, kept apart
+		{When: t0 + 1, Data: []byte(`{"k":2}`), ContentType: "application/json"},
+	}
+	dir := t.TempDir()
+	ex := &extractor{dir: dir}
+	err := ex.extract(bytes.NewReader(encodeRecords(t, recs...)))
+	if !errors.Is(err, io.EOF) || ex.files != 3 {
+		t.Fatalf("%d files, err %v", ex.files, err)
+	}
+	for name, want := range map[string][]byte{
+		"1772600000000.jpg":    jpeg,
+		"1772600000001.json":   []byte(`{"k":1}`),
+		"1772600000001-1.json": []byte(`{"k":2}`),
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestExtractRaw(t *testing.T) {
+	dir := t.TempDir()
+	const t0 = 1772600000000
+	path := filepath.Join(dir, "b-20260304")
+	err := os.WriteFile(path, []byte("png bytes"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+data.RawMetaSuffix, []byte(`{"t":1772600000000,"Content-Type":"image/png"}`+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, ok := readRawMeta(path)
+	if !ok || meta.ContentType != "image/png" || meta.When != t0 {
+		t.Fatalf("meta %+v, %v", meta, ok)
+	}
+	if _, ok := readRawMeta(filepath.Join(dir, "none")); ok {
+		t.Fatal("meta for a file without a sidecar")
+	}
+	ex := &extractor{dir: t.TempDir()}
+	err = ex.extractRaw(path, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(ex.dir, "1772600000000.png"))
+	if err != nil || string(got) != "png bytes" || ex.files != 1 {
+		t.Fatalf("extracted %q, %d files, err %v", got, ex.files, err)
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	dir := t.TempDir()
+	const t0 = 1772600000000
+	err := os.MkdirAll(filepath.Join(dir, "sub", "deep"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"a.cbor", "a.1.cbor", "notes.txt", "sub/b.cbor", "sub/deep/c.cbor"} {
+		writeRecords(t, dir, name, textRecord(t0+int64(i), name))
+	}
+	rel := func(paths []string) string {
+		var out []string
+		for _, path := range paths {
+			r, _ := filepath.Rel(dir, path)
+			out = append(out, r)
+		}
+		return strings.Join(out, ",")
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"*.cbor"}, "a.1.cbor,a.cbor"},
+		{[]string{"**/*.cbor"}, "a.1.cbor,a.cbor,sub/b.cbor,sub/deep/c.cbor"},
+		{[]string{"**"}, "a.1.cbor,a.cbor,notes.txt,sub/b.cbor,sub/deep/c.cbor"},
+		{[]string{"**/deep/*.cbor"}, "sub/deep/c.cbor"},
+		// in argument order, each glob sorted, plain names passed through
+		{[]string{"notes.txt", "sub/*.cbor", "a.?.cbor"}, "notes.txt,sub/b.cbor,a.1.cbor"},
+	} {
+		var args []string
+		for _, arg := range tc.args {
+			args = append(args, filepath.Join(dir, arg))
+		}
+		got, err := expandArgs(args)
+		if err != nil || rel(got) != tc.want {
+			t.Errorf("%v: got %s, want %s, err %v", tc.args, rel(got), tc.want, err)
+		}
+	}
+	for _, bad := range []string{"*.json", "[", "**/x/**"} {
+		if _, err := expandArgs([]string{filepath.Join(dir, bad)}); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+	_, err = expandArgs([]string{filepath.Join(dir, "*.json")})
+	if err == nil || !strings.Contains(err.Error(), "no files match") {
+		t.Errorf("no match: %v", err)
+	}
+
+	// the matched files print in order
+	paths, err := expandArgs([]string{filepath.Join(dir, "**/*.cbor")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, path := range paths {
+		blob, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, printedData(t, blob)...)
+	}
+	if strings.Join(got, ",") != "a.1.cbor,a.cbor,sub/b.cbor,sub/deep/c.cbor" {
+		t.Fatalf("printed %v", got)
+	}
+}
+
+func TestPrintGolden(t *testing.T) {
+	blob := encodeRecords(t,
+		textRecord(1772600000000, "hello"),
+		data.ReceiverRecord{When: 1772600000001, Data: []byte(`{"k":1}`), ContentType: "application/json"},
+	)
+	// one line per record, no blank lines
+	const line = `{"t":1772600000000,"time":"2026-03-04T04:53:20Z","d":"hello","Content-Type":"text/plain"}
+{"t":1772600000001,"time":"2026-03-04T04:53:20.001Z","d":"{\"k\":1}","Content-Type":"application/json"}
+`
+	const pretty = `{
+  "t": 1772600000000,
+  "time": "2026-03-04T04:53:20Z",
+  "d": "hello",
+  "Content-Type": "text/plain"
+}
+{
+  "t": 1772600000001,
+  "time": "2026-03-04T04:53:20.001Z",
+  "d": {
+    "k": 1
+  },
+  "Content-Type": "application/json"
+}
+`
+	for _, tc := range []struct {
+		name  string
+		print func(io.Reader, io.Writer) error
+		want  string
+	}{
+		{"line", jsonPerLine, line},
+		{"pretty", prettyPrintJson, pretty},
+	} {
+		var out bytes.Buffer
+		err := tc.print(bytes.NewReader(blob), &out)
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if out.String() != tc.want {
+			t.Errorf("%s printed\n%s\nwant\n%s", tc.name, out.String(), tc.want)
+		}
+	}
+}
+
+func TestPrintPrettyJSONValues(t *testing.T) {
+	// as a json-wrap unit stores text, binary, and JSON bodies
+	bodies := []string{`"plain text"`, `{"base64":"AP8="}`, `12`, `[1,"two"]`, `null`}
+	var recs []data.ReceiverRecord
+	for i, body := range bodies {
+		recs = append(recs, data.ReceiverRecord{When: 1772600000000 + int64(i), Data: []byte(body), ContentType: "application/json"})
+	}
+	var out bytes.Buffer
+	err := prettyPrintJson(bytes.NewReader(encodeRecords(t, recs...)), &out)
+	if !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(&out)
+	for _, body := range bodies {
+		var printed struct {
+			D json.RawMessage `json:"d"`
+		}
+		err = dec.Decode(&printed)
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		var got, want any
+		json.Unmarshal(printed.D, &got)
+		json.Unmarshal([]byte(body), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("printed %s, want %s", printed.D, body)
+		}
+	}
+}
+
+func TestPrintName(t *testing.T) {
+	const t0 = 1772600000000
+	named := textRecord(t0, "1")
+	named.Name = "a"
+	js := data.ReceiverRecord{When: t0 + 1, Data: []byte(`{"k":1}`), ContentType: "application/json", Name: "b"}
+	bin := data.ReceiverRecord{When: t0 + 2, Data: []byte{0xff}, ContentType: "application/octet-stream", Name: "c"}
+	blob := encodeRecords(t, named, js, bin, textRecord(t0+3, "unnamed"))
+	for _, pretty := range []bool{false, true} {
+		var out bytes.Buffer
+		var err error
+		if pretty {
+			err = prettyPrintJson(bytes.NewReader(blob), &out)
+		} else {
+			err = jsonPerLine(bytes.NewReader(blob), &out)
+		}
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("pretty %v: %v", pretty, err)
+		}
+		var names []string
+		dec := json.NewDecoder(&out)
+		for dec.More() {
+			var rec struct {
+				Name *string `json:"name"`
+			}
+			err = dec.Decode(&rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Name == nil {
+				names = append(names, "-")
+			} else {
+				names = append(names, *rec.Name)
+			}
+		}
+		if strings.Join(names, ",") != "a,b,c,-" {
+			t.Errorf("pretty %v names %v", pretty, names)
+		}
+	}
+}
+
+func TestPrintHeaders(t *testing.T) {
+	const t0 = 1772600000000
+	headers := map[string]string{"X-Github-Event": "push"}
+	txt := textRecord(t0, "1")
+	txt.Headers = headers
+	js := data.ReceiverRecord{When: t0 + 1, Data: []byte(`{"k":1}`), ContentType: "application/json", Headers: headers}
+	bin := data.ReceiverRecord{When: t0 + 2, Data: []byte{0xff}, ContentType: "application/octet-stream", Headers: headers}
+	blob := encodeRecords(t, txt, js, bin, textRecord(t0+3, "none"))
+	for _, pretty := range []bool{false, true} {
+		var out bytes.Buffer
+		var err error
+		if pretty {
+			err = prettyPrintJson(bytes.NewReader(blob), &out)
+		} else {
+			err = jsonPerLine(bytes.NewReader(blob), &out)
+		}
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("pretty %v: %v", pretty, err)
+		}
+		var events []string
+		dec := json.NewDecoder(&out)
+		for dec.More() {
+			var rec struct {
+				Headers map[string]string `json:"headers"`
+			}
+			err = dec.Decode(&rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Headers == nil {
+				events = append(events, "-")
+			} else {
+				events = append(events, rec.Headers["X-Github-Event"])
+			}
+		}
+		if strings.Join(events, ",") != "push,push,push,-" {
+			t.Errorf("pretty %v headers %v", pretty, events)
+		}
+	}
+}
+
+func TestPrintQuery(t *testing.T) {
+	rec := textRecord(1772600000000, "1")
+	rec.Query = map[string][]string{"tag": {"a", "b"}}
+	rec.Path = "/-/push"
+	var out bytes.Buffer
+	err := jsonPerLine(bytes.NewReader(encodeRecords(t, rec)), &out)
+	if !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if got := out.String(); !strings.Contains(got, `"query":{"tag":["a","b"]}`) || !strings.Contains(got, `"path":"/-/push"`) {
+		t.Errorf("printed %s", got)
+	}
+}
+
+func TestPrintTags(t *testing.T) {
+	txt := textRecord(1772600000000, "1")
+	txt.Tags = map[string]string{"site": "nyc"}
+	bin := data.ReceiverRecord{When: 1772600000001, Data: []byte{0xff}, ContentType: "application/octet-stream", Tags: txt.Tags}
+	var out bytes.Buffer
+	err := jsonPerLine(bytes.NewReader(encodeRecords(t, txt, bin)), &out)
+	if !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if got := out.String(); strings.Count(got, `"tags":{"site":"nyc"}`) != 2 {
+		t.Errorf("printed %s", got)
+	}
+}
+
+func TestRecordTime(t *testing.T) {
+	milli := data.ReceiverRecord{When: 1772600000123}
+	nano := data.ReceiverRecord{When: 1772600000123456789}
+	if got := recordTime(&milli); got != "2026-03-04T04:53:20.123Z" {
+		t.Errorf("milli %s", got)
+	}
+	if got := recordTime(&nano); got != "2026-03-04T04:53:20.123456789Z" {
+		t.Errorf("nano %s", got)
+	}
+	// mixed precisions still sort by time
+	if !milli.Time().Before(nano.Time()) {
+		t.Errorf("%s not before %s", milli.Time(), nano.Time())
+	}
+}
+
+func TestPrintFieldNames(t *testing.T) {
+	_, err := parseFieldNames("t=d")
+	if err == nil {
+		t.Error("colliding -field-names accepted")
+	}
+	names, err := parseFieldNames("t=timestamp,d=payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blob []byte
+	for i, d := range []string{"1", "2"} {
+		rec := textRecord(1772600000000+int64(i), d)
+		line, err := rec.MarshalJSONFields(names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob = concat(blob, line, []byte("\n"))
+	}
+	setOpts(t, printOptions{fieldNames: names})
+	if got := printedData(t, blob); strings.Join(got, ",") != "1,2" {
+		t.Errorf("printed %v", got)
+	}
+}
+
+// jsonlRecords is recs as a jsonl append file holds them
+func jsonlRecords(t *testing.T, recs ...data.ReceiverRecord) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range recs {
+		err := enc.Encode(&recs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestFormatDetection(t *testing.T) {
+	const t0 = 1772600000000
+	recs := []data.ReceiverRecord{textRecord(t0, "1"), textRecord(t0+1, "2")}
+	cborBlob := encodeRecords(t, recs...)
+	jsonl := jsonlRecords(t, recs...)
+	array, err := json.Marshal(recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh := data.FileHeader{Version: data.FileHeaderVersion, Unit: "a", Created: t0}
+	header, err := fh.MarshalLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		blob []byte
+	}{
+		{"cbor", cborBlob},
+		{"jsonl", jsonl},
+		{"json array", array},
+		{"indented jsonl", concat([]byte("\n  "), jsonl)},
+		{"gzip cbor", gzipBytes(t, cborBlob)},
+		{"gzip jsonl", gzipBytes(t, jsonl)},
+		{"zstd cbor", zstdBytes(t, cborBlob)},
+		{"zstd jsonl", zstdBytes(t, jsonl)},
+		{"header cbor", concat(header, cborBlob)},
+		{"header jsonl", concat(header, jsonl)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := printedData(t, tc.blob); strings.Join(got, ",") != "1,2" {
+				t.Fatalf("printed %v", got)
+			}
+		})
+	}
+
+	// -format overrides detection
+	setOpts(t, printOptions{format: formatJSON})
+	if got := printedData(t, jsonl); strings.Join(got, ",") != "1,2" {
+		t.Errorf("-format jsonl: printed %v", got)
+	}
+	setOpts(t, printOptions{format: formatCBOR})
+	var out bytes.Buffer
+	err = jsonPerLine(bytes.NewReader(jsonl), &out)
+	if err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("-format cbor over jsonl: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"bolson.org/receiver/data"
+)
+
+// resyncReader keeps the bytes read for the current record so that, for
+// -skip-errors, a record that fails to decode can be read again from
+// its second byte. cbor.Decoder reads only what it needs, never ahead,
+// so this is exactly the record's bytes.
+type resyncReader struct {
+	r io.Reader
+
+	// pending is read again before r
+	pending []byte
+
+	// taken is what was read since mark()
+	taken []byte
+}
+
+func (rs *resyncReader) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if len(rs.pending) != 0 {
+		n = copy(p, rs.pending)
+		rs.pending = rs.pending[n:]
+	} else {
+		n, err = rs.r.Read(p)
+	}
+	rs.taken = append(rs.taken, p[:n]...)
+	return n, err
+}
+
+// mark starts a record
+func (rs *resyncReader) mark() {
+	rs.taken = rs.taken[:0]
+}
+
+// peek returns the next n bytes without consuming them
+func (rs *resyncReader) peek(n int) ([]byte, error) {
+	if len(rs.pending) < n {
+		more := make([]byte, n-len(rs.pending))
+		got, err := io.ReadFull(rs.r, more)
+		rs.pending = append(rs.pending, more[:got]...)
+		if err != nil {
+			return rs.pending, err
+		}
+	}
+	return rs.pending[:n], nil
+}
+
+// skip gives back what was read of the failed record, then drops
+// bytes one at a time, at least one, until start() accepts what
+// follows. It returns how many bytes were dropped, with io.EOF if
+// nothing did.
+func (rs *resyncReader) skip(startLen int, start func([]byte) bool) (int, error) {
+	rs.pending = append(append([]byte(nil), rs.taken...), rs.pending...)
+	rs.taken = rs.taken[:0]
+	skipped := 0
+	for {
+		rs.pending = rs.pending[1:]
+		skipped++
+		next, err := rs.peek(startLen)
+		if err != nil {
+			return skipped + len(next), io.EOF
+		}
+		if start(next) {
+			return skipped, nil
+		}
+	}
+}
+
+// recordStartLen is how much of a record looksLikeRecord needs
+func recordStartLen() int {
+	if len(opts.blobPrefix) != 0 {
+		return len(opts.blobPrefix)
+	}
+	return 3
+}
+
+// looksLikeRecord checks the start of a possible record: the blob
+// prefix if there is one, else a CBOR map whose first key is "t", as
+// every ReceiverRecord starts
+func looksLikeRecord(start []byte) bool {
+	if len(opts.blobPrefix) != 0 {
+		return bytes.Equal(start, opts.blobPrefix)
+	}
+	return start[0] >= 0xa3 && start[0] <= 0xb7 && start[1] == 0x61 && start[2] == 't'
+}
+
+var errNotRecord = errors.New("not the start of a record")
+
+// nextResync is nextCBOR for -skip-errors, skipping past bad records.
+// A damaged record can decode with some of the next one in it, taking
+// that one with it.
+func (rr *recordReader) nextResync(rec *data.ReceiverRecord) error {
+	for {
+		rr.resync.mark()
+		start, err := rr.resync.peek(recordStartLen())
+		if err != nil && len(start) == 0 {
+			return io.EOF
+		}
+		if err == nil && looksLikeRecord(start) {
+			err = rr.nextCBORSafe(rec)
+			if err == nil {
+				return nil
+			}
+		} else {
+			err = errNotRecord
+		}
+		fmt.Fprintf(os.Stderr, "bad record: %s, looking for the next one\n", err)
+		skipped, err := rr.resync.skip(recordStartLen(), looksLikeRecord)
+		fmt.Fprintf(os.Stderr, "skipped %d bytes\n", skipped)
+		if err != nil {
+			return err
+		}
+		*rec = data.ReceiverRecord{}
+	}
+}
+
+// nextCBORSafe is nextCBOR, with a panic from garbage, e.g. an absurd
+// length, as an error
+func (rr *recordReader) nextCBORSafe(rec *data.ReceiverRecord) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decode panic: %v", r)
+		}
+	}()
+	return rr.nextCBOR(rec)
+}
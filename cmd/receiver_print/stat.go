@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"bolson.org/receiver/data"
+)
+
+// stats summarizes records for -stat, one at a time as they are read
+type stats struct {
+	records int
+	bytes   int64
+	first   time.Time
+	last    time.Time
+
+	byContentType map[string]int
+}
+
+func newStats() *stats {
+	return &stats{byContentType: make(map[string]int)}
+}
+
+// add reads the records of fin into the summary
+func (st *stats) add(fin io.Reader) error {
+	rr := newRecordReader(fin)
+	var rec data.ReceiverRecord
+	for {
+		err := rr.Next(&rec)
+		if err != nil {
+			return err
+		}
+		st.records++
+		st.bytes += int64(len(rec.Data))
+		t := rec.Time()
+		if st.records == 1 || t.Before(st.first) {
+			st.first = t
+		}
+		if st.records == 1 || t.After(st.last) {
+			st.last = t
+		}
+		st.byContentType[rec.ContentType]++
+	}
+}
+
+// write prints the summary, content types most common first
+func (st *stats) write(out io.Writer) error {
+	_, err := fmt.Fprintf(out, "records %d\nbytes %d\n", st.records, st.bytes)
+	if err != nil || st.records == 0 {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "first %s\nlast %s\n", st.first.UTC().Format(time.RFC3339Nano), st.last.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return err
+	}
+	types := make([]string, 0, len(st.byContentType))
+	for contentType := range st.byContentType {
+		types = append(types, contentType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		ci, cj := st.byContentType[types[i]], st.byContentType[types[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return types[i] < types[j]
+	})
+	for _, contentType := range types {
+		_, err = fmt.Fprintf(out, "%d\t%s\n", st.byContentType[contentType], contentType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bolson.org/receiver/data"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Connect to a receiver unit's /stream and print records as they arrive.
+//
+// receiver_tail -secret hunter2 http://host:8777/unitname/stream
+
+type PrintableReceiverRecord struct {
+	When        int64               `json:"t"`
+	Data        string              `json:"d"`
+	ContentType string              `json:"Content-Type"`
+	Name        string              `json:"name,omitempty"`
+	Headers     map[string]string   `json:"headers,omitempty"`
+	Query       map[string][]string `json:"query,omitempty"`
+	Path        string              `json:"path,omitempty"`
+	RemoteAddr  string              `json:"remote,omitempty"`
+	Tags        map[string]string   `json:"tags,omitempty"`
+}
+
+type JSONReceiverRecord struct {
+	When        int64               `json:"t"`
+	Data        json.RawMessage     `json:"d"`
+	ContentType string              `json:"Content-Type"`
+	Name        string              `json:"name,omitempty"`
+	Headers     map[string]string   `json:"headers,omitempty"`
+	Query       map[string][]string `json:"query,omitempty"`
+	Path        string              `json:"path,omitempty"`
+	RemoteAddr  string              `json:"remote,omitempty"`
+	Tags        map[string]string   `json:"tags,omitempty"`
+}
+
+// printRecord writes one record from the stream, showing text and JSON
+// bodies readably and anything else as base64
+func printRecord(enc *json.Encoder, blob []byte) error {
+	var rec data.ReceiverRecord
+	err := json.Unmarshal(blob, &rec)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(rec.ContentType, "application/json") && json.Valid(rec.Data) {
+		return enc.Encode(JSONReceiverRecord{
+			When:        rec.When,
+			Data:        rec.Data,
+			ContentType: rec.ContentType,
+			Name:        rec.Name,
+			Headers:     rec.Headers,
+			Query:       rec.Query,
+			Path:        rec.Path,
+			RemoteAddr:  rec.RemoteAddr,
+			Tags:        rec.Tags,
+		})
+	}
+	if strings.HasPrefix(rec.ContentType, "text/") {
+		return enc.Encode(PrintableReceiverRecord{
+			When:        rec.When,
+			Data:        string(rec.Data),
+			ContentType: rec.ContentType,
+			Name:        rec.Name,
+			Headers:     rec.Headers,
+			Query:       rec.Query,
+			Path:        rec.Path,
+			RemoteAddr:  rec.RemoteAddr,
+			Tags:        rec.Tags,
+		})
+	}
+	return enc.Encode(&rec)
+}
+
+type tailer struct {
+	url    string
+	secret string
+	client *http.Client
+	enc    *json.Encoder
+
+	// lastID is the last event seen, sent back as Last-Event-ID on reconnect
+	lastID string
+}
+
+var errFatal = errors.New("not retrying")
+
+// follow reads one connection's worth of events
+func (t *tailer) follow() error {
+	req, err := http.NewRequest("GET", t.url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errFatal, err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if t.secret != "" {
+		req.Header.Set("X-Receiver-Token", t.secret)
+	}
+	if t.lastID != "" {
+		req.Header.Set("Last-Event-ID", t.lastID)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", errFatal, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return t.readEvents(resp.Body)
+}
+
+// readEvents parses text/event-stream, see
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+func (t *tailer) readEvents(fin io.Reader) error {
+	scanner := bufio.NewScanner(fin)
+	scanner.Buffer(make([]byte, 64*1024), 100*1024*1024)
+	var id string
+	var dataLines []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// dispatch
+			if len(dataLines) != 0 {
+				err := printRecord(t.enc, []byte(strings.Join(dataLines, "\n")))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "bad record: %s\n", err)
+				}
+			}
+			if id != "" {
+				t.lastID = id
+			}
+			id = ""
+			dataLines = dataLines[:0]
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// comment, keepalive
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			dataLines = append(dataLines, value)
+		}
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+func main() {
+	var t tailer
+	var pretty bool
+	flag.StringVar(&t.secret, "secret", "", "access token for the unit")
+	flag.StringVar(&t.lastID, "last-event-id", "", "resume after this event id")
+	flag.BoolVar(&pretty, "pretty", true, "indent JSON")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: receiver_tail [-secret s] http://host:port/unit/stream\n")
+		os.Exit(1)
+	}
+	t.url = args[0]
+	t.client = &http.Client{}
+	t.enc = json.NewEncoder(os.Stdout)
+	if pretty {
+		t.enc.SetIndent("", "  ")
+	}
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := t.follow()
+		if errors.Is(err, errFatal) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", t.url, err)
+			os.Exit(1)
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s, reconnecting in %s\n", t.url, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
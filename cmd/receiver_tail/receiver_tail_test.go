@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFollowResumes(t *testing.T) {
+	// each connection sends the events after Last-Event-ID, at most two,
+	// then hangs up
+	events := []string{
+		`{"t":1,"d":"b25l","Content-Type":"text/plain"}`,
+		`{"t":2,"d":"eyJhIjoxfQ==","Content-Type":"application/json"}`,
+		`{"t":3,"d":"AAE=","Content-Type":"image/png"}`,
+	}
+	var lastIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("X-Receiver-Token") != "s" {
+			http.Error(out, "nope", http.StatusForbidden)
+			return
+		}
+		lei := request.Header.Get("Last-Event-ID")
+		lastIDs = append(lastIDs, lei)
+		var after int
+		fmt.Sscan(lei, &after)
+		out.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(out, ": keepalive\n\n")
+		for i := after; i < len(events) && i < after+2; i++ {
+			fmt.Fprintf(out, "id: %d\ndata: %s\n\n", i+1, events[i])
+		}
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	tl := tailer{url: server.URL, secret: "s", client: server.Client(), enc: json.NewEncoder(&buf)}
+	for range 2 {
+		err := tl.follow()
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("follow: %v", err)
+		}
+	}
+	if len(lastIDs) != 2 || lastIDs[0] != "" || lastIDs[1] != "2" {
+		t.Fatalf("Last-Event-ID sent %q", lastIDs)
+	}
+	want := `{"t":1,"d":"one","Content-Type":"text/plain"}
+{"t":2,"d":{"a":1},"Content-Type":"application/json"}
+{"t":3,"d":"AAE=","Content-Type":"image/png"}
+`
+	if buf.String() != want {
+		t.Fatalf("printed\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	tl.secret = "wrong"
+	err := tl.follow()
+	if !errors.Is(err, errFatal) {
+		t.Fatalf("wrong secret: %v, want errFatal", err)
+	}
+}
+
+func TestReadEventsMultiline(t *testing.T) {
+	var buf bytes.Buffer
+	tl := tailer{enc: json.NewEncoder(&buf)}
+	// data split over lines is joined with newlines, JSON doesn't mind
+	err := tl.readEvents(bytes.NewReader([]byte("id: 7\ndata: {\"t\":1,\ndata: \"d\":\"eA==\",\"Content-Type\":\"text/plain\"}\n\n")))
+	if !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if tl.lastID != "7" || buf.String() != `{"t":1,"d":"x","Content-Type":"text/plain"}`+"\n" {
+		t.Fatalf("lastID %q, printed %q", tl.lastID, buf.String())
+	}
+}
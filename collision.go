@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// CollisionStrategy values, for when an OutTemplate path already exists
+const (
+	collisionOverwrite = "overwrite"
+	collisionSuffix    = "suffix"
+	collisionReject    = "reject"
+)
+
+// give up on finding a free suffix after this many
+const maxCollisionSuffix = 10000
+
+var errFileExists = errors.New("output file exists")
+
+func exists(fpath string) bool {
+	_, err := os.Lstat(fpath)
+	return err == nil
+}
+
+// suffixedPath puts "-seq" before the extension, "a.cbor" -> "a-1.cbor"
+func suffixedPath(fpath string, seq int) string {
+	ext := filepath.Ext(fpath)
+	return fpath[:len(fpath)-len(ext)] + "-" + strconv.Itoa(seq) + ext
+}
+
+// outPath applies CollisionStrategy to an expanded OutTemplate
+func (ruc *ReceiverUnitConfig) outPath(fpath string) (string, error) {
+	switch ruc.CollisionStrategy {
+	case collisionSuffix:
+		if !exists(fpath) {
+			return fpath, nil
+		}
+		for seq := 1; seq <= maxCollisionSuffix; seq++ {
+			np := suffixedPath(fpath, seq)
+			if !exists(np) {
+				return np, nil
+			}
+		}
+		return "", errFileExists
+	case collisionReject:
+		if exists(fpath) {
+			return "", errFileExists
+		}
+	}
+	return fpath, nil
+}
+
+// commitTempNoClobber is commitTemp that fails with errFileExists
+// instead of replacing a file. link(2), unlike rename(2), won't replace
+// an existing name, so a file created since outPath checked is kept.
+func commitTempNoClobber(f *os.File, fpath string) error {
+	err := f.Chmod(0644)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Link(f.Name(), fpath)
+	if errors.Is(err, fs.ErrExist) {
+		return errFileExists
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
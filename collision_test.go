@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCollisionStrategy(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", OutTemplate: "/tmp/%T", CollisionStrategy: "rename"}, "collision-strategy")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: filepath.Join(dir, "o", "%Y.bin"), Raw: true, CollisionStrategy: collisionOverwrite}},
+		"d": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sd", OutTemplate: filepath.Join(dir, "d", "%Y.bin"), Raw: true}},
+		"s": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "ss", OutTemplate: filepath.Join(dir, "s", "%Y.bin"), Raw: true, CollisionStrategy: collisionSuffix}},
+		"r": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", OutTemplate: filepath.Join(dir, "r", "%Y.bin"), Raw: true, CollisionStrategy: collisionReject}},
+	})
+	// every request in the same year makes the same name
+	when := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	rs.now = func() time.Time { return when }
+	status := make(map[string][]int)
+	for _, body := range []string{"1", "2", "3"} {
+		for _, unit := range []string{"o", "d", "s", "r"} {
+			status[unit] = append(status[unit], post(rs, "/"+unit+"/s"+unit, body).Code)
+		}
+	}
+	for unit, want := range map[string][]int{"o": {200, 200, 200}, "d": {200, 200, 200}, "s": {200, 200, 200}, "r": {200, 409, 409}} {
+		if !reflect.DeepEqual(status[unit], want) {
+			t.Errorf("unit %s status %v, want %v", unit, status[unit], want)
+		}
+	}
+	for _, tc := range []struct {
+		unit  string
+		files map[string]string
+	}{
+		// overwrite is the default
+		{"o", map[string]string{"2026.bin": "3"}},
+		{"d", map[string]string{"2026.bin": "3"}},
+		{"s", map[string]string{"2026.bin": "1", "2026-1.bin": "2", "2026-2.bin": "3"}},
+		{"r", map[string]string{"2026.bin": "1"}},
+	} {
+		got := make(map[string]string)
+		for _, name := range listFiles(t, filepath.Join(dir, tc.unit)) {
+			got[name] = readFile(t, filepath.Join(dir, tc.unit, name))
+		}
+		if !reflect.DeepEqual(got, tc.files) {
+			t.Errorf("unit %s files %v, want %v", tc.unit, got, tc.files)
+		}
+	}
+}
+
+func TestSuffixedPath(t *testing.T) {
+	for _, tc := range []struct {
+		fpath string
+		seq   int
+		want  string
+	}{
+		{"/d/a.cbor", 1, "/d/a-1.cbor"},
+		{"/d/a", 2, "/d/a-2"},
+		{"/d.x/a.tar.gz", 3, "/d.x/a.tar-3.gz"},
+	} {
+		if got := suffixedPath(tc.fpath, tc.seq); got != tc.want {
+			t.Errorf("suffixedPath(%q, %d) = %q, want %q", tc.fpath, tc.seq, got, tc.want)
+		}
+	}
+}
+
+func TestCommitTempNoClobber(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "a.bin")
+	// made after outPath checked, by another request
+	err := os.WriteFile(fpath, []byte("first"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := os.CreateTemp(dir, "a.bin.*"+tempSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.WriteString("second")
+	err = commitTempNoClobber(tmp, fpath)
+	if !errors.Is(err, errFileExists) {
+		t.Fatalf("err %v, want errFileExists", err)
+	}
+	if got := readFile(t, fpath); got != "first" {
+		t.Fatalf("existing file replaced with %q", got)
+	}
+}
+
+func TestRejectCollisionKeepsChecksum(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"r": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", OutTemplate: filepath.Join(dir, "r", "%Y.bin"), Raw: true, CollisionStrategy: collisionReject, WriteChecksum: true}},
+	})
+	rs.now = func() time.Time { return time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC) }
+	const sidecar = "0123abcd  2026.bin\n"
+	// another request makes the file, and its checksum, after outPath checked
+	rs.createTempFn = func(dir, pattern string) (*os.File, error) {
+		fpath := filepath.Join(dir, "2026.bin")
+		err := os.WriteFile(fpath, []byte("first"), 0644)
+		if err == nil {
+			err = os.WriteFile(fpath+".sha256", []byte(sidecar), 0644)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return os.CreateTemp(dir, pattern)
+	}
+	wantStatus(t, post(rs, "/r/sr", "second"), 409)
+	fpath := filepath.Join(dir, "r", "2026.bin")
+	if got := readFile(t, fpath); got != "first" {
+		t.Errorf("existing file replaced with %q", got)
+	}
+	if got := readFile(t, fpath+".sha256"); got != sidecar {
+		t.Errorf("existing checksum replaced with %q", got)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+)
+
+const compressGzip = "gzip"
+
+// gzipFile is an append file written through gzip. Each record is
+// flushed so it is on disk (and readable) once the request returns;
+// Close finishes the gzip member. Reopening an existing file appends a
+// new member, which gzip readers (and receiver_print) read through.
+type gzipFile struct {
+	gz *gzip.Writer
+	f  *os.File
+}
+
+func newGzipFile(f *os.File) *gzipFile {
+	return &gzipFile{gz: gzip.NewWriter(f), f: f}
+}
+
+func (gf *gzipFile) Write(blob []byte) (int, error) {
+	n, err := gf.gz.Write(blob)
+	if err != nil {
+		return n, err
+	}
+	return n, gf.gz.Flush()
+}
+
+// Sync fsyncs what has been flushed, which is every complete record
+func (gf *gzipFile) Sync() error {
+	return gf.f.Sync()
+}
+
+func (gf *gzipFile) Close() error {
+	err := gf.gz.Close()
+	cerr := gf.f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
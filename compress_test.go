@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressGzip(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", OutTemplate: "/tmp/%T", Compress: compressGzip}, "compress")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", Compress: "zip"}, "compress")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor.gz")
+	configs := func() map[string]*ReceiverUnit {
+		return map[string]*ReceiverUnit{
+			"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, Compress: compressGzip}},
+		}
+	}
+	rs := newTestServer(t, configs())
+	wantStatus(t, post(rs, "/a/sa", "one"), 200)
+	wantStatus(t, post(rs, "/a/sa", "two"), 200)
+	// each record is flushed, readable before the file is closed
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial, _ := io.ReadAll(gz)
+	if recs := decodeRecords(t, bytes.NewReader(partial)); len(recs) != 2 {
+		t.Fatalf("%d records readable before close", len(recs))
+	}
+	// shutdown finishes the gzip member
+	rs.closeAppendFiles()
+
+	// a restart appends a second member
+	rs = newTestServer(t, configs())
+	wantStatus(t, post(rs, "/a/sa", "three"), 200)
+	rs.closeAppendFiles()
+
+	recs := readGzipRecords(t, path)
+	if len(recs) != 3 || string(recs[0].Data) != "one" || string(recs[2].Data) != "three" {
+		t.Fatalf("read back %d records", len(recs))
+	}
+	// and each member has a valid trailer
+	fin, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fin.Close()
+	gz, err = gzip.NewReader(fin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(io.Discard, gz)
+	if err != nil {
+		t.Fatalf("gzip stream: %s", err)
+	}
+}
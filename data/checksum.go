@@ -0,0 +1,5 @@
+package data
+
+// ChecksumSuffixes are the extensions of checksum sidecars, one for each
+// receiver HashAlgo, named for the *sum(1) tool that checks them
+var ChecksumSuffixes = []string{".sha256", ".sha512", ".sha1", ".blake2b"}
@@ -0,0 +1,54 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ParseKey makes an AES-256-GCM AEAD from a base64 encoded 32 byte key
+func ParseKey(keyb64 string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(keyb64)
+	if err != nil {
+		return nil, fmt.Errorf("key base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt replaces Data with its ciphertext and sets Nonce
+func (rec *ReceiverRecord) Encrypt(aead cipher.AEAD) error {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	rec.Data = aead.Seal(nil, nonce, rec.Data, nil)
+	rec.Nonce = nonce
+	return nil
+}
+
+var ErrNotEncrypted = errors.New("record is not encrypted")
+
+// Decrypt replaces Data with its plaintext and clears Nonce
+func (rec *ReceiverRecord) Decrypt(aead cipher.AEAD) error {
+	if len(rec.Nonce) == 0 {
+		return ErrNotEncrypted
+	}
+	plain, err := aead.Open(nil, rec.Nonce, rec.Data, nil)
+	if err != nil {
+		return err
+	}
+	rec.Data = plain
+	rec.Nonce = nil
+	return nil
+}
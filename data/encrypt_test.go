@@ -0,0 +1,46 @@
+package data
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+func TestEncryptRoundTrip(t *testing.T) {
+	aead, err := ParseKey(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := ReceiverRecord{When: 1, Data: []byte("secret stuff"), ContentType: "text/plain"}
+	err = rec.Encrypt(aead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Nonce) != aead.NonceSize() || bytes.Contains(rec.Data, []byte("secret")) {
+		t.Fatalf("not encrypted: %+v", rec)
+	}
+	sealed := rec
+	err = rec.Decrypt(aead)
+	if err != nil || string(rec.Data) != "secret stuff" || rec.Nonce != nil {
+		t.Fatalf("decrypted %+v, err %v", rec, err)
+	}
+	if !errors.Is(rec.Decrypt(aead), ErrNotEncrypted) {
+		t.Fatal("decrypted a plaintext record")
+	}
+	sealed.Data = append([]byte(nil), sealed.Data...)
+	sealed.Data[0] ^= 1
+	if sealed.Decrypt(aead) == nil {
+		t.Fatal("tampered record decrypted")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	for _, key := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := ParseKey(key); err == nil {
+			t.Errorf("ParseKey(%q) worked", key)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// JSONFieldNames are the JSON keys of a ReceiverRecord, in the order
+// they are written. A unit's FieldNames renames them.
+var JSONFieldNames = []string{"t", "d", "Content-Type", "n", "name", "headers", "query", "path", "remote", "tags"}
+
+// CheckFieldNames checks a renaming of JSONFieldNames: only known
+// fields, and no two fields ending up with the same key
+func CheckFieldNames(names map[string]string) error {
+	known := make(map[string]bool, len(JSONFieldNames))
+	for _, field := range JSONFieldNames {
+		known[field] = true
+	}
+	used := make(map[string]string, len(JSONFieldNames))
+	for _, field := range JSONFieldNames {
+		key := field
+		if rename, ok := names[field]; ok {
+			if rename == "" {
+				return fmt.Errorf("field %#v renamed to empty", field)
+			}
+			key = rename
+		}
+		if other, dup := used[key]; dup {
+			return fmt.Errorf("fields %#v and %#v would both be %#v", other, field, key)
+		}
+		used[key] = field
+	}
+	for field := range names {
+		if !known[field] {
+			return fmt.Errorf("unknown field %#v", field)
+		}
+	}
+	return nil
+}
+
+// MarshalJSONFields is json.Marshal(rec) with the keys renamed by
+// names, default key to new key. Fields are in the usual order.
+func (rec *ReceiverRecord) MarshalJSONFields(names map[string]string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range rec.fields() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key := f.key
+		if rename, ok := names[key]; ok {
+			key = rename
+		}
+		kb, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		vb, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSONFields decodes a record written by MarshalJSONFields
+// with the same names
+func UnmarshalJSONFields(blob []byte, names map[string]string, rec *ReceiverRecord) error {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(blob, &raw)
+	if err != nil {
+		return err
+	}
+	fieldOf := make(map[string]string, len(JSONFieldNames))
+	for _, field := range JSONFieldNames {
+		if rename, ok := names[field]; ok {
+			fieldOf[rename] = field
+		} else {
+			fieldOf[field] = field
+		}
+	}
+	plain := make(map[string]json.RawMessage, len(raw))
+	for key, value := range raw {
+		if field, ok := fieldOf[key]; ok {
+			plain[field] = value
+		}
+	}
+	blob, err = json.Marshal(plain)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(blob, rec)
+}
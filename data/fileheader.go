@@ -0,0 +1,40 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// FileHeaderVersion is the current FileHeader.Version
+const FileHeaderVersion = 1
+
+// FileHeader is written as one line of JSON at the start of each new
+// append file when a unit has FileHeader set. Records follow it in the
+// unit's format.
+type FileHeader struct {
+	// Version comes first so a reader can recognize a header from the
+	// first bytes of the file, see FileHeaderMagic
+	Version int    `json:"receiver-file"`
+	Unit    string `json:"unit"`
+
+	// Created is unix milliseconds, like ReceiverRecord.When
+	Created int64 `json:"created"`
+}
+
+// FileHeaderMagic starts every encoded FileHeader. A CBOR record never
+// starts with '{'.
+var FileHeaderMagic = []byte(`{"receiver-file":`)
+
+// MarshalLine encodes the header as JSON with a trailing newline
+func (fh *FileHeader) MarshalLine() ([]byte, error) {
+	blob, err := json.Marshal(fh)
+	if err != nil {
+		return nil, err
+	}
+	return append(blob, '\n'), nil
+}
+
+// IsFileHeader reports whether blob, the start of a file, is a FileHeader
+func IsFileHeader(blob []byte) bool {
+	return bytes.HasPrefix(blob, FileHeaderMagic)
+}
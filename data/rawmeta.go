@@ -0,0 +1,12 @@
+package data
+
+// RawMetaSuffix is appended to a raw file's path for its RawMeta sidecar
+const RawMetaSuffix = ".meta"
+
+// RawMeta is the JSON sidecar written next to a raw file, which
+// otherwise has nowhere to keep its content type
+type RawMeta struct {
+	// When is as in ReceiverRecord
+	When        int64  `json:"t"`
+	ContentType string `json:"Content-Type"`
+}
@@ -1,7 +1,121 @@
 package data
 
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	cbor "github.com/brianolson/cbor_go"
+)
+
 type ReceiverRecord struct {
+	// When is unix milliseconds, or nanoseconds from a unit with
+	// TimePrecision "nano", see Time()
 	When        int64  `json:"t"`
 	Data        []byte `json:"d"`
 	ContentType string `json:"Content-Type"`
+
+	// Nonce is set when Data is AES-GCM encrypted
+	Nonce []byte `json:"n,omitempty"`
+
+	// Name is the unit that stored the record, if it has RecordName
+	Name string `json:"name,omitempty"`
+
+	// Headers are the request headers the unit captures, by canonical
+	// name, multiple values joined with ", ". Not encrypted.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Query and Path are from the request URL, if the unit captures them
+	Query map[string][]string `json:"query,omitempty"`
+	Path  string              `json:"path,omitempty"`
+
+	// RemoteAddr is the client IP, if the unit has CaptureRemote
+	RemoteAddr string `json:"remote,omitempty"`
+
+	// Tags are the unit's static Tags. Not encrypted.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// nanoWhen is the least When taken to be nanoseconds. As milliseconds it
+// would be the year 33658, as nanoseconds it is 1970-01-12.
+const nanoWhen = 1e15
+
+// WhenTime converts a When in either precision
+func WhenTime(when int64) time.Time {
+	if when >= nanoWhen {
+		return time.Unix(0, when)
+	}
+	return time.UnixMilli(when)
+}
+
+// Time is When as a time.Time
+func (rec *ReceiverRecord) Time() time.Time {
+	return WhenTime(rec.When)
+}
+
+// cbor_go doesn't honor omitempty, so records are written by hand.
+// The first three fields are always present, in the order cbor_go would
+// write them, so that a record with no optional fields is byte for byte
+// what cbor.Dumps(rec) always produced.
+
+type recordField struct {
+	key   string
+	value interface{}
+}
+
+// fields lists the fields of rec to write, leaving out empty optional ones
+func (rec *ReceiverRecord) fields() []recordField {
+	fields := []recordField{
+		{"t", rec.When},
+		{"d", rec.Data},
+		{"Content-Type", rec.ContentType},
+	}
+	if len(rec.Nonce) != 0 {
+		fields = append(fields, recordField{"n", rec.Nonce})
+	}
+	if rec.Name != "" {
+		fields = append(fields, recordField{"name", rec.Name})
+	}
+	if len(rec.Headers) != 0 {
+		fields = append(fields, recordField{"headers", rec.Headers})
+	}
+	if len(rec.Query) != 0 {
+		fields = append(fields, recordField{"query", rec.Query})
+	}
+	if rec.Path != "" {
+		fields = append(fields, recordField{"path", rec.Path})
+	}
+	if rec.RemoteAddr != "" {
+		fields = append(fields, recordField{"remote", rec.RemoteAddr})
+	}
+	if len(rec.Tags) != 0 {
+		fields = append(fields, recordField{"tags", rec.Tags})
+	}
+	return fields
+}
+
+// MarshalCBOR encodes rec, leaving out empty optional fields
+func (rec *ReceiverRecord) MarshalCBOR() ([]byte, error) {
+	return encodeCBORMap(rec.fields())
+}
+
+func encodeCBORMap(fields []recordField) ([]byte, error) {
+	if len(fields) > 23 {
+		return nil, errors.New("too many fields for short map header")
+	}
+	var buf bytes.Buffer
+	// major type 5 (map), length in the low bits
+	buf.WriteByte(0xa0 | byte(len(fields)))
+	enc := cbor.NewEncoder(&buf)
+	for _, f := range fields {
+		err := enc.Encode(f.key)
+		if err != nil {
+			return nil, err
+		}
+		err = enc.Encode(f.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
 }
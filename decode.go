@@ -0,0 +1,100 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+var errCompressionRatio = errors.New("compression ratio too high")
+
+// countingReader counts bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// ratioGuardReader fails a decompressing read once the output exceeds
+// ratio times the compressed input consumed so far
+type ratioGuardReader struct {
+	r          io.Reader
+	compressed *countingReader
+	ratio      float64
+	n          int64
+}
+
+func (rg *ratioGuardReader) Read(p []byte) (int, error) {
+	n, err := rg.r.Read(p)
+	rg.n += int64(n)
+	compressed := rg.compressed.n
+	if compressed < 1 {
+		compressed = 1
+	}
+	if float64(rg.n) > float64(compressed)*rg.ratio {
+		return n, errCompressionRatio
+	}
+	return n, err
+}
+
+func isGzipEncoding(encoding string) bool {
+	return encoding == "gzip" || encoding == "x-gzip"
+}
+
+// stripsEncoding is true if the body will be decompressed and stored
+// without mention of its Content-Encoding, see StripContentEncoding
+func (ruc *ReceiverUnitConfig) stripsEncoding(header http.Header) bool {
+	return ruc.StripContentEncoding && isGzipEncoding(header.Get("Content-Encoding"))
+}
+
+// decodedContentType drops a "+gzip" suffix from the media type,
+// keeping any parameters
+func decodedContentType(contentType string) string {
+	mediaType, params, found := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if !strings.HasSuffix(mediaType, "+gzip") {
+		return contentType
+	}
+	mediaType = strings.TrimSuffix(mediaType, "+gzip")
+	if found {
+		return mediaType + ";" + params
+	}
+	return mediaType
+}
+
+// bodyReader returns the request body, limited to maxSize.
+// With DecodeContentEncoding a gzip body is decompressed and maxSize
+// applies to the decompressed size.
+func (ruc *ReceiverUnitConfig) bodyReader(out http.ResponseWriter, request *http.Request, maxSize int64) (io.Reader, error) {
+	reader := http.MaxBytesReader(out, request.Body, maxSize)
+	if !ruc.DecodeContentEncoding {
+		return reader, nil
+	}
+	switch request.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return reader, nil
+	case "gzip", "x-gzip":
+		// ok
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	compressed := &countingReader{r: reader}
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, err
+	}
+	var decoded io.Reader = gz
+	if ruc.MaxCompressionRatio > 0 {
+		decoded = &ratioGuardReader{r: gz, compressed: compressed, ratio: ruc.MaxCompressionRatio}
+	}
+	return http.MaxBytesReader(out, io.NopCloser(decoded), maxSize), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// postGzip posts body gzipped with Content-Encoding: gzip
+func postGzip(t *testing.T, rs *receiverServer, target, contentType string, body []byte) int {
+	t.Helper()
+	request := testRequest("POST", target, contentType, gzipBytes(t, body))
+	request.Header.Set("Content-Encoding", "gzip")
+	return serve(rs, request).Code
+}
+
+func TestMaxCompressionRatio(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, DecodeContentEncoding: true, MaxCompressionRatio: 20, MaxSize: 10 << 20}},
+	})
+	// a megabyte of zeros gzips about a thousand to one
+	bomb := make([]byte, 1<<20)
+	if status := postGzip(t, rs, "/a/sa", "application/octet-stream", bomb); status != 413 {
+		t.Fatalf("bomb: status %d, want 413", status)
+	}
+	var normal bytes.Buffer
+	for i := range 2000 {
+		fmt.Fprintf(&normal, "event %d at %d ok\n", i, i*7919%10007)
+	}
+	if status := postGzip(t, rs, "/a/sa", "text/plain", normal.Bytes()); status != 200 {
+		t.Fatalf("normal: status %d, want 200", status)
+	}
+	rs.configs["a"].retire()
+	recs := readRecords(t, path)
+	if len(recs) != 1 || !bytes.Equal(recs[0].Data, normal.Bytes()) {
+		t.Fatalf("stored %d records", len(recs))
+	}
+}
+
+func TestDecodeContentEncoding(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), DecodeContentEncoding: true, MaxSize: 1000}},
+		"k": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sk", AppendPath: filepath.Join(dir, "k.cbor")}},
+	})
+	doc := []byte(`{"event": "login", "user": "alice", "ok": true}`)
+	if status := postGzip(t, rs, "/a/sa", "application/json", doc); status != 200 {
+		t.Fatalf("gzipped JSON: status %d", status)
+	}
+	// MaxSize is on the decoded size, however well it compresses
+	if status := postGzip(t, rs, "/a/sa", "text/plain", bytes.Repeat([]byte("x"), 1001)); status != 413 {
+		t.Errorf("decoded past MaxSize: status %d, want 413", status)
+	}
+	request := testRequest("POST", "/a/sa", "text/plain", []byte("x"))
+	request.Header.Set("Content-Encoding", "br")
+	wantStatus(t, serve(rs, request), 415)
+	request = testRequest("POST", "/a/sa", "text/plain", []byte("not gzip"))
+	request.Header.Set("Content-Encoding", "gzip")
+	wantStatus(t, serve(rs, request), 400)
+	// without DecodeContentEncoding the bytes are stored as sent
+	if status := postGzip(t, rs, "/k/sk", "application/json", doc); status != 200 {
+		t.Fatalf("kept gzip: status %d", status)
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	recs := readRecords(t, filepath.Join(dir, "a.cbor"))
+	if len(recs) != 1 || !bytes.Equal(recs[0].Data, doc) || recs[0].ContentType != "application/json" {
+		t.Fatalf("stored %+v", recs)
+	}
+	recs = readRecords(t, filepath.Join(dir, "k.cbor"))
+	if len(recs) != 1 || !bytes.Equal(recs[0].Data, gzipBytes(t, doc)) {
+		t.Fatalf("kept %d records", len(recs))
+	}
+}
+
+func TestStripContentEncoding(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", StripContentEncoding: true}, "needs decode-content-encoding")
+	for _, tc := range []struct{ in, want string }{
+		{"application/json+gzip", "application/json"},
+		{"text/csv+gzip; charset=utf-8", "text/csv; charset=utf-8"},
+		{"application/gzip", "application/gzip"},
+	} {
+		if got := decodedContentType(tc.in); got != tc.want {
+			t.Errorf("decodedContentType(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	dir := t.TempDir()
+	headers := []string{"Content-Encoding"}
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"s": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "ss", AppendPath: filepath.Join(dir, "s.cbor"), DecodeContentEncoding: true, StripContentEncoding: true, Headers: headers}},
+		"d": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sd", AppendPath: filepath.Join(dir, "d.cbor"), DecodeContentEncoding: true, Headers: headers}},
+		"r": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", OutTemplate: filepath.Join(dir, "r", "%T.json"), Raw: true, DecodeContentEncoding: true, StripContentEncoding: true}},
+	})
+	doc := []byte(`{"event": "login"}`)
+	for _, target := range []string{"/s/ss", "/d/sd", "/r/sr"} {
+		if status := postGzip(t, rs, target, "application/json+gzip", doc); status != 200 {
+			t.Fatalf("%s: status %d", target, status)
+		}
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	recs := readRecords(t, filepath.Join(dir, "s.cbor"))
+	if len(recs) != 1 || !bytes.Equal(recs[0].Data, doc) || recs[0].ContentType != "application/json" || recs[0].Headers != nil {
+		t.Errorf("stripped %+v", recs)
+	}
+	// decoded, but still says how it was sent
+	recs = readRecords(t, filepath.Join(dir, "d.cbor"))
+	if len(recs) != 1 || !bytes.Equal(recs[0].Data, doc) || recs[0].ContentType != "application/json+gzip" || recs[0].Headers["Content-Encoding"] != "gzip" {
+		t.Errorf("decoded %+v", recs)
+	}
+	names := listFiles(t, filepath.Join(dir, "r"))
+	if len(names) != 1 || readFile(t, filepath.Join(dir, "r", names[0])) != string(doc) {
+		t.Errorf("raw files %v", names)
+	}
+}
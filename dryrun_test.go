@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestDryRunQuery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, AllowDryRun: true}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", AppendPath: filepath.Join(dir, "b.cbor")}},
+	})
+	for _, v := range []string{"1", "true", "T"} {
+		out := post(rs, "/a/sa?dryrun="+v, "x")
+		wantStatus(t, out, 200)
+		var result dryRunResult
+		err := json.Unmarshal(out.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatalf("dryrun=%s: %s", v, err)
+		}
+		if result.Unit != "a" || result.Path != path || result.Size != 1 {
+			t.Fatalf("dryrun=%s: %+v", v, result)
+		}
+	}
+	if files := listFiles(t, dir); len(files) != 0 {
+		t.Fatalf("dry run stored %v", files)
+	}
+	for _, v := range []string{"0", "false", ""} {
+		wantStatus(t, post(rs, "/a/sa?dryrun="+v, v), 200)
+	}
+	if n := len(readRecords(t, path)); n != 3 {
+		t.Fatalf("stored %d records, want 3", n)
+	}
+	wantStatus(t, post(rs, "/a/sa?dryrun=maybe", "x"), 400)
+	wantStatus(t, post(rs, "/b/sb?dryrun=1", "x"), 400)
+	wantStatus(t, post(rs, "/b/sb?dryrun=0", "x"), 200)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// syncAppend flushes the open append file to disk if it has unsynced
+// writes. Caller holds ru.l.
+func (ru *ReceiverUnit) syncAppend() error {
+	if !ru.unsynced || ru.fout == nil {
+		return nil
+	}
+	f, ok := ru.fout.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+	ru.unsynced = false
+	return f.Sync()
+}
+
+// closeAppend syncs and closes the open append file. Caller holds ru.l.
+func (ru *ReceiverUnit) closeAppend() {
+	if ru.fout == nil {
+		return
+	}
+	err := ru.syncAppend()
+	if err != nil {
+		slog.Warn("fsync", "path", ru.fpath, "err", err)
+	}
+	err = ru.fout.Close()
+	if err != nil {
+		// for S3 that was the upload, and the records are lost
+		slog.Error("close append", "path", ru.fpath, "err", err)
+	}
+	ru.fout = nil
+	ru.fpath = ""
+}
+
+// syncLoop fsyncs the append file every FsyncInterval
+func (ru *ReceiverUnit) syncLoop() {
+	ticker := time.NewTicker(time.Duration(ru.FsyncInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ru.done:
+			return
+		}
+		ru.syncNow()
+	}
+}
+
+// syncNow is syncAppend with ru.l taken, logging any error
+func (ru *ReceiverUnit) syncNow() {
+	ru.l.Lock()
+	err := ru.syncAppend()
+	ru.l.Unlock()
+	if err != nil {
+		slog.Warn("fsync", "cfg", ru.name, "err", err)
+	}
+}
+
+// syncAllLoop fsyncs every unit's append files each interval, for
+// -fsync-interval, until stop is called. Units come from rs.units()
+// each time, so it follows reloads.
+func (rs *receiverServer) syncAllLoop(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rs.syncAll()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// syncAll fsyncs every unit's append files that have unsynced writes
+func (rs *receiverServer) syncAll() {
+	for _, cfg := range rs.units() {
+		for _, stripe := range cfg.stripes {
+			stripe.syncNow()
+		}
+		cfg.syncNow()
+	}
+}
+
+// closeAppendFiles finishes every unit's open append file, e.g. the gzip
+// trailer, before the process exits
+func (rs *receiverServer) closeAppendFiles() {
+	for _, cfg := range rs.units() {
+		for _, stripe := range cfg.stripes {
+			stripe.l.Lock()
+			stripe.sink.Close()
+			stripe.l.Unlock()
+		}
+		cfg.l.Lock()
+		cfg.sink.Close()
+		if cfg.tlout != nil {
+			cfg.tlout.Close()
+			cfg.tlout = nil
+		}
+		cfg.l.Unlock()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// unsynced is whether cfg has append writes not yet fsynced
+func unsynced(cfg *ReceiverUnit) bool {
+	cfg.l.Lock()
+	defer cfg.l.Unlock()
+	return cfg.unsynced
+}
+
+func TestFsync(t *testing.T) {
+	dir := t.TempDir()
+	var opened []*os.File
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), Fsync: true}},
+		"i": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "si", AppendPath: filepath.Join(dir, "i.cbor"), Fsync: true, FsyncInterval: Duration(20 * time.Millisecond)}},
+		"n": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sn", AppendPath: filepath.Join(dir, "n.cbor")}},
+	})
+	rs.openFileFn = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err == nil {
+			opened = append(opened, f)
+		}
+		return f, err
+	}
+	wantStatus(t, post(rs, "/a/sa", "synced"), 200)
+	if unsynced(rs.configs["a"]) {
+		t.Error("Fsync left the write unsynced")
+	}
+	// the record is on disk with the file still open, as if the process
+	// were killed now and never closed it
+	if recs := readRecords(t, filepath.Join(dir, "a.cbor")); len(recs) != 1 || string(recs[0].Data) != "synced" {
+		t.Fatalf("on disk before close: %d records", len(recs))
+	}
+
+	wantStatus(t, post(rs, "/n/sn", "x"), 200)
+	if !unsynced(rs.configs["n"]) {
+		t.Error("write without Fsync marked synced")
+	}
+
+	// FsyncInterval batches the syncs in the background
+	wantStatus(t, post(rs, "/i/si", "later"), 200)
+	if !unsynced(rs.configs["i"]) {
+		t.Error("FsyncInterval synced per request")
+	}
+	waitFor(t, "interval fsync", func() bool { return !unsynced(rs.configs["i"]) })
+
+	// an append file broken under the unit fails the store, not a 200
+	for _, f := range opened {
+		if f.Name() == filepath.Join(dir, "a.cbor") {
+			f.Close()
+		}
+	}
+	wantStatus(t, post(rs, "/a/sa", "closed under it"), 500)
+}
+
+func TestSyncAll(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+		"s": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "ss", AppendPath: filepath.Join(dir, "s.cbor"), Stripes: 2}},
+	})
+	wantStatus(t, post(rs, "/a/sa", "x"), 200)
+	wantStatus(t, post(rs, "/s/ss", "y"), 200)
+	rs.syncAll()
+	if unsynced(rs.configs["a"]) {
+		t.Error("-fsync-interval left a unit unsynced")
+	}
+	for i, stripe := range rs.configs["s"].stripes {
+		if unsynced(stripe) {
+			t.Errorf("stripe %d unsynced", i)
+		}
+	}
+}
+
+func TestSyncAllLoop(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	wantStatus(t, post(rs, "/a/sa", "x"), 200)
+	stop := rs.syncAllLoop(20 * time.Millisecond)
+	waitFor(t, "-fsync-interval tick", func() bool { return !unsynced(rs.configs["a"]) })
+	// the record is on disk with the file still open
+	if recs := readRecords(t, filepath.Join(dir, "a.cbor")); len(recs) != 1 || string(recs[0].Data) != "x" {
+		t.Fatalf("on disk after a tick: %d records", len(recs))
+	}
+	stop()
+	wantStatus(t, post(rs, "/a/sa", "y"), 200)
+	time.Sleep(60 * time.Millisecond)
+	if !unsynced(rs.configs["a"]) {
+		t.Error("synced after stop")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// gRPC ingest, see receiver.proto
+//
+// The two messages are small enough that they are encoded by hand with
+// protowire rather than generated code.
+
+type grpcRecord struct {
+	Data        []byte
+	ContentType string
+}
+
+type grpcAck struct {
+	Count int64
+}
+
+// grpcCodec speaks protobuf wire format for grpcRecord and grpcAck
+type grpcCodec struct{}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *grpcRecord:
+		var out []byte
+		if len(m.Data) != 0 {
+			out = protowire.AppendTag(out, 1, protowire.BytesType)
+			out = protowire.AppendBytes(out, m.Data)
+		}
+		if m.ContentType != "" {
+			out = protowire.AppendTag(out, 2, protowire.BytesType)
+			out = protowire.AppendString(out, m.ContentType)
+		}
+		return out, nil
+	case *grpcAck:
+		var out []byte
+		if m.Count != 0 {
+			out = protowire.AppendTag(out, 1, protowire.VarintType)
+			out = protowire.AppendVarint(out, uint64(m.Count))
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("grpc codec cannot marshal %T", v)
+}
+
+func (grpcCodec) Unmarshal(blob []byte, v any) error {
+	for len(blob) > 0 {
+		num, typ, n := protowire.ConsumeTag(blob)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		blob = blob[n:]
+		switch m := v.(type) {
+		case *grpcRecord:
+			if typ == protowire.BytesType && (num == 1 || num == 2) {
+				val, n := protowire.ConsumeBytes(blob)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				if num == 1 {
+					m.Data = append([]byte(nil), val...)
+				} else {
+					m.ContentType = string(val)
+				}
+				blob = blob[n:]
+				continue
+			}
+		case *grpcAck:
+			if typ == protowire.VarintType && num == 1 {
+				val, n := protowire.ConsumeVarint(blob)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				m.Count = int64(val)
+				blob = blob[n:]
+				continue
+			}
+		default:
+			return fmt.Errorf("grpc codec cannot unmarshal %T", v)
+		}
+		// unknown field, skip it
+		n = protowire.ConsumeFieldValue(num, typ, blob)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		blob = blob[n:]
+	}
+	return nil
+}
+
+var receiverServiceDesc = grpc.ServiceDesc{
+	ServiceName: "receiver.Receiver",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Send",
+			Handler:       grpcSendHandler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "receiver.proto",
+}
+
+func firstMD(md metadata.MD, key string) string {
+	vals := md.Get(key)
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// grpcPeerIP is the client address of stream, without port
+func grpcPeerIP(stream grpc.ServerStream) string {
+	p, ok := peer.FromContext(stream.Context())
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcSendHandler stores a stream of records to one unit
+func grpcSendHandler(srv any, stream grpc.ServerStream) error {
+	rs := srv.(*receiverServer)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	cfg, some := rs.lookupUnit(firstMD(md, "x-receiver-unit"))
+	if !some && firstMD(md, "x-receiver-unit") == "" {
+		cfg, some = rs.defaultUnit()
+	}
+	if !some {
+		return status.Error(codes.NotFound, "nope")
+	}
+	ip := grpcPeerIP(stream)
+	if !cfg.ipAllowed(ip) {
+		return status.Error(codes.PermissionDenied, "nope")
+	}
+	if cfg.HMACSecret != "" || cfg.NonceAuth {
+		// there is no per-record signature or nonce over gRPC, and over
+		// HTTP the secret alone isn't enough for these units
+		return status.Error(codes.FailedPrecondition, "unit needs a signature, use HTTP")
+	}
+	if !cfg.Public && !secretEqual(firstMD(md, "x-receiver-token"), cfg.Secret) {
+		rs.authFailDelay(stream.Context(), ip, cfg)
+		return status.Error(codes.PermissionDenied, "nope")
+	}
+	if cfg.AuthFailTarpit > 0 {
+		rs.tarpit.succeed(ip)
+	}
+	if cfg.actionFor("POST") != actionStore {
+		// Send stores as a POST would, so the unit's Methods must allow it
+		return status.Error(codes.FailedPrecondition, "unit doesn't store POST")
+	}
+	var count int64
+	for {
+		var in grpcRecord
+		err := stream.RecvMsg(&in)
+		if errors.Is(err, io.EOF) {
+			return stream.SendMsg(&grpcAck{Count: count})
+		}
+		if err != nil {
+			return err
+		}
+		in.ContentType = cfg.contentTypeOrDefault(in.ContentType)
+		if !cfg.contentTypeOK(in.ContentType) {
+			return status.Error(codes.InvalidArgument, "unacceptable content-type")
+		}
+		if int64(len(in.Data)) > cfg.maxSizeFor(in.ContentType) {
+			return status.Error(codes.ResourceExhausted, "too large")
+		}
+		if cfg.ValidateJSON && isJSONContentType(in.ContentType) && !json.Valid(in.Data) {
+			return status.Error(codes.InvalidArgument, "invalid JSON")
+		}
+		now := rs.clock()
+		// each record counts as a request would over HTTP
+		if cfg.limiter != nil && !cfg.limiter.AllowN(now, 1) {
+			return status.Error(codes.ResourceExhausted, "rate limited")
+		}
+		if cfg.budget != nil {
+			if ok, _ := cfg.budget.allow(ip, now); !ok {
+				return status.Error(codes.ResourceExhausted, "request budget exceeded")
+			}
+		}
+		rec := ReceiverRecord{
+			When:        cfg.recordWhen(now),
+			Data:        in.Data,
+			ContentType: in.ContentType,
+		}
+		if cfg.CaptureRemote {
+			rec.RemoteAddr = ip
+		}
+		err = rs.commitRecord(cfg, &rec, cfg.defaultFormat(), "GRPC", now)
+		if errors.Is(err, errWriteQueueFull) || errors.Is(err, errUnitPaused) {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		if errors.Is(err, errFileExists) {
+			return status.Error(codes.AlreadyExists, err.Error())
+		}
+		if err != nil && !errors.Is(err, errUnchanged) {
+			slog.Debug("grpc store", "err", err)
+			return status.Error(codes.Internal, err.Error())
+		}
+		count++
+	}
+}
+
+// newGRPCServer makes a gRPC server for the Receiver service.
+// Messages may be as large as the largest unit allows.
+func (rs *receiverServer) newGRPCServer() *grpc.Server {
+	maxMsg := int64(4 * 1024 * 1024)
+	for _, cfg := range rs.units() {
+		if cfg.MaxSize > maxMsg {
+			maxMsg = cfg.MaxSize
+		}
+		for _, size := range cfg.MaxSizeByContentType {
+			if size > maxMsg {
+				maxMsg = size
+			}
+		}
+	}
+	// leave room for the rest of the Record
+	maxMsg += 1024
+	gs := grpc.NewServer(
+		grpc.ForceServerCodec(grpcCodec{}),
+		grpc.MaxRecvMsgSize(int(maxMsg)),
+	)
+	gs.RegisterService(&receiverServiceDesc, rs)
+	return gs
+}
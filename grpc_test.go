@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcTestClient serves rs on a loopback port and connects to it
+func grpcTestClient(t *testing.T, rs *receiverServer) *grpc.ClientConn {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := rs.newGRPCServer()
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	cc, err := grpc.NewClient(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+// grpcSend sends records to unit with token, returning the acked count
+func grpcSend(cc *grpc.ClientConn, unit, token string, recs ...*grpcRecord) (int64, error) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-receiver-unit", unit, "x-receiver-token", token)
+	stream, err := cc.NewStream(ctx, &receiverServiceDesc.Streams[0], "/receiver.Receiver/Send")
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range recs {
+		err = stream.SendMsg(rec)
+		if err != nil {
+			break
+		}
+	}
+	stream.CloseSend()
+	var ack grpcAck
+	err = stream.RecvMsg(&ack)
+	return ack.Count, err
+}
+
+func wantCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("got %v, want %s", err, code)
+	}
+}
+
+func TestGRPCSend(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	cc := grpcTestClient(t, rs)
+	count, err := grpcSend(cc, "a", "sa", &grpcRecord{Data: []byte("one"), ContentType: "text/plain"}, &grpcRecord{Data: []byte("two")})
+	if err != nil || count != 2 {
+		t.Fatalf("count %d, err %v", count, err)
+	}
+	_, err = grpcSend(cc, "a", "wrong", &grpcRecord{Data: []byte("x")})
+	wantCode(t, err, codes.PermissionDenied)
+	recs := readRecords(t, filepath.Join(dir, "a.cbor"))
+	if len(recs) != 2 || string(recs[0].Data) != "one" || string(recs[1].Data) != "two" {
+		t.Fatalf("records %+v", recs)
+	}
+}
+
+func TestGRPCIPFilter(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), DenyCIDRs: []string{"127.0.0.0/8"}}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", AppendPath: filepath.Join(dir, "b.cbor"), AllowCIDRs: []string{"10.0.0.0/8"}}},
+		"c": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sc", AppendPath: filepath.Join(dir, "c.cbor"), AllowCIDRs: []string{"127.0.0.1"}}},
+	})
+	cc := grpcTestClient(t, rs)
+	_, err := grpcSend(cc, "a", "sa", &grpcRecord{Data: []byte("x")})
+	wantCode(t, err, codes.PermissionDenied)
+	_, err = grpcSend(cc, "b", "sb", &grpcRecord{Data: []byte("x")})
+	wantCode(t, err, codes.PermissionDenied)
+	_, err = grpcSend(cc, "c", "sc", &grpcRecord{Data: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := listFiles(t, dir); len(files) != 1 || files[0] != "c.cbor" {
+		t.Fatalf("files %v", files)
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), RateLimit: 0.001, RateBurst: 2}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", AppendPath: filepath.Join(dir, "b.cbor"), RequestBudget: 2}},
+	})
+	cc := grpcTestClient(t, rs)
+	for _, unit := range []string{"a", "b"} {
+		recs := []*grpcRecord{{Data: []byte("1")}, {Data: []byte("2")}, {Data: []byte("3")}}
+		_, err := grpcSend(cc, unit, "s"+unit, recs...)
+		wantCode(t, err, codes.ResourceExhausted)
+		if n := len(readRecords(t, filepath.Join(dir, unit+".cbor"))); n != 2 {
+			t.Fatalf("unit %s stored %d records, want 2", unit, n)
+		}
+	}
+}
+
+func TestGRPCTarpit(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), AuthFailTarpit: Duration(tarpitBaseDelay * 4)}},
+	})
+	cc := grpcTestClient(t, rs)
+	for range 2 {
+		_, err := grpcSend(cc, "a", "wrong", &grpcRecord{Data: []byte("x")})
+		wantCode(t, err, codes.PermissionDenied)
+	}
+	rs.tarpit.l.Lock()
+	te := rs.tarpit.failures["127.0.0.1"]
+	rs.tarpit.l.Unlock()
+	if te == nil || te.count != 2 {
+		t.Fatalf("tarpit entry %+v", te)
+	}
+	_, err := grpcSend(cc, "a", "sa", &grpcRecord{Data: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.tarpit.l.Lock()
+	_, some := rs.tarpit.failures["127.0.0.1"]
+	rs.tarpit.l.Unlock()
+	if some {
+		t.Fatal("success didn't clear the tarpit")
+	}
+}
+
+func TestGRPCRefusesHMAC(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", HMACSecret: "ha", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	cc := grpcTestClient(t, rs)
+	_, err := grpcSend(cc, "a", "sa", &grpcRecord{Data: []byte("x")})
+	wantCode(t, err, codes.FailedPrecondition)
+	if files := listFiles(t, dir); len(files) != 0 {
+		t.Fatalf("stored %v", files)
+	}
+}
+
+func TestGRPCRefusesNonceAuth(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", NonceAuth: true, AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	cc := grpcTestClient(t, rs)
+	_, err := grpcSend(cc, "a", "sa", &grpcRecord{Data: []byte("x")})
+	wantCode(t, err, codes.FailedPrecondition)
+	if files := listFiles(t, dir); len(files) != 0 {
+		t.Fatalf("stored %v", files)
+	}
+}
+
+func TestGRPCValidateJSON(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", ValidateJSON: true, AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	cc := grpcTestClient(t, rs)
+	count, err := grpcSend(cc, "a", "sa", &grpcRecord{Data: []byte(`{"ok":1}`), ContentType: "application/json"}, &grpcRecord{Data: []byte("not json"), ContentType: "text/plain"})
+	if err != nil || count != 2 {
+		t.Fatalf("count %d, err %v", count, err)
+	}
+	_, err = grpcSend(cc, "a", "sa", &grpcRecord{Data: []byte(`{"ok":`), ContentType: "application/json"})
+	wantCode(t, err, codes.InvalidArgument)
+	rs.configs["a"].retire()
+	if recs := readRecords(t, filepath.Join(dir, "a.cbor")); len(recs) != 2 {
+		t.Fatalf("%d records", len(recs))
+	}
+}
+
+func TestGRPCMethods(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"p": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sp", Methods: []string{"PUT"}, AppendPath: filepath.Join(dir, "p.cbor")}},
+		"r": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", MethodActions: map[string]string{"POST": actionRemoveLatest}, OutTemplate: filepath.Join(dir, "r", "%T")}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", Methods: []string{"PUT", "POST"}, AppendPath: filepath.Join(dir, "b.cbor")}},
+	})
+	cc := grpcTestClient(t, rs)
+	for _, unit := range []string{"p", "r"} {
+		_, err := grpcSend(cc, unit, "s"+unit, &grpcRecord{Data: []byte("x")})
+		wantCode(t, err, codes.FailedPrecondition)
+	}
+	count, err := grpcSend(cc, "b", "sb", &grpcRecord{Data: []byte("x")})
+	if err != nil || count != 1 {
+		t.Fatalf("count %d, err %v", count, err)
+	}
+	if files := listFiles(t, dir); len(files) != 1 || files[0] != "b.cbor" {
+		t.Fatalf("stored %v", files)
+	}
+}
+
+func TestGRPCCodec(t *testing.T) {
+	var codec grpcCodec
+	blob, err := codec.Marshal(&grpcRecord{Data: []byte{0, 1, 2}, ContentType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a field from a newer client is skipped
+	blob = protowire.AppendTag(blob, 9, protowire.VarintType)
+	blob = protowire.AppendVarint(blob, 42)
+	var rec grpcRecord
+	err = codec.Unmarshal(blob, &rec)
+	if err != nil || string(rec.Data) != "\x00\x01\x02" || rec.ContentType != "image/png" {
+		t.Fatalf("record %+v, err %v", rec, err)
+	}
+	blob, _ = codec.Marshal(&grpcAck{Count: 300})
+	var ack grpcAck
+	err = codec.Unmarshal(blob, &ack)
+	if err != nil || ack.Count != 300 {
+		t.Fatalf("ack %+v, err %v", ack, err)
+	}
+	err = codec.Unmarshal([]byte{0x0a, 0x05, 1}, &rec)
+	if err == nil {
+		t.Fatal("truncated message decoded")
+	}
+}
+
+func TestGRPCStream(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a":             {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), ContentTypes: []string{"text/plain", "application/json"}, MaxSize: 100}},
+		"p":             {ReceiverUnitConfig: ReceiverUnitConfig{Public: true, ContentType: "text/plain", AppendPath: filepath.Join(dir, "p.cbor")}},
+		defaultUnitName: {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sd", AppendPath: filepath.Join(dir, "d.cbor")}},
+	})
+	cc := grpcTestClient(t, rs)
+	const n = 1000
+	recs := make([]*grpcRecord, n)
+	for i := range recs {
+		recs[i] = &grpcRecord{Data: []byte(fmt.Sprintf("record %d", i)), ContentType: "text/plain"}
+	}
+	count, err := grpcSend(cc, "a", "sa", recs...)
+	if err != nil || count != n {
+		t.Fatalf("count %d, err %v", count, err)
+	}
+	_, err = grpcSend(cc, "a", "sa", &grpcRecord{Data: []byte("<x/>"), ContentType: "text/xml"})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = grpcSend(cc, "a", "sa", &grpcRecord{Data: make([]byte, 101), ContentType: "text/plain"})
+	wantCode(t, err, codes.ResourceExhausted)
+	_, err = grpcSend(cc, "nosuch", "sa", &grpcRecord{Data: []byte("x")})
+	wantCode(t, err, codes.NotFound)
+	// the default unit is only had by not naming one
+	_, err = grpcSend(cc, "", "sd", &grpcRecord{Data: []byte("default"), ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = grpcSend(cc, "p", "", &grpcRecord{Data: []byte("public"), ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	stored := readRecords(t, filepath.Join(dir, "a.cbor"))
+	if len(stored) != n {
+		t.Fatalf("stored %d records, want %d", len(stored), n)
+	}
+	for i, rec := range stored {
+		if string(rec.Data) != fmt.Sprintf("record %d", i) || rec.ContentType != "text/plain" {
+			t.Fatalf("record %d: %+v", i, rec)
+		}
+	}
+	for name, want := range map[string]string{"d.cbor": "default", "p.cbor": "public"} {
+		recs := readRecords(t, filepath.Join(dir, name))
+		if len(recs) != 1 || string(recs[0].Data) != want || recs[0].ContentType != "text/plain" {
+			t.Errorf("%s: %+v", name, recs)
+		}
+	}
+}
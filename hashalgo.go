@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashAlgo values. The checksum sidecar is named for the algorithm, and
+// in the format its *sum(1) tool checks.
+const (
+	hashSHA256  = "sha256"
+	hashSHA512  = "sha512"
+	hashSHA1    = "sha1"
+	hashBLAKE2b = "blake2b"
+)
+
+func checkHashAlgo(algo string) error {
+	switch algo {
+	case "", hashSHA256, hashSHA512, hashSHA1, hashBLAKE2b:
+		return nil
+	}
+	return fmt.Errorf("hash-algo %#v: want sha256, sha512, blake2b, or sha1", algo)
+}
+
+// hashAlgo is HashAlgo or the default
+func (ruc *ReceiverUnitConfig) hashAlgo() string {
+	if ruc.HashAlgo == "" {
+		return hashSHA256
+	}
+	return ruc.HashAlgo
+}
+
+// newHash makes a hash.Hash of the unit's HashAlgo
+func (ruc *ReceiverUnitConfig) newHash() hash.Hash {
+	switch ruc.hashAlgo() {
+	case hashSHA512:
+		return sha512.New()
+	case hashSHA1:
+		return sha1.New()
+	case hashBLAKE2b:
+		// 512 bits, as b2sum(1); only a bad key is an error
+		h, _ := blake2b.New512(nil)
+		return h
+	}
+	return sha256.New()
+}
+
+// checksumSuffix names the checksum sidecar, ".sha256" etc
+func (ruc *ReceiverUnitConfig) checksumSuffix() string {
+	return "." + ruc.hashAlgo()
+}
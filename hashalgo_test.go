@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bolson.org/receiver/data"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestChecksumSuffixesListed(t *testing.T) {
+	for _, algo := range []string{"", hashSHA256, hashSHA512, hashSHA1, hashBLAKE2b} {
+		ruc := ReceiverUnitConfig{HashAlgo: algo}
+		if !containsString(data.ChecksumSuffixes, ruc.checksumSuffix()) {
+			t.Errorf("%s not in data.ChecksumSuffixes", ruc.checksumSuffix())
+		}
+	}
+}
+
+func TestHashAlgo(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", OutTemplate: "/tmp/%T", WriteChecksum: true, HashAlgo: "md5"}, "hash-algo")
+
+	dir := t.TempDir()
+	configs := map[string]*ReceiverUnit{}
+	for _, algo := range []string{hashSHA512, hashSHA1, hashBLAKE2b} {
+		configs[algo] = &ReceiverUnit{ReceiverUnitConfig: ReceiverUnitConfig{Secret: "s" + algo, OutTemplate: filepath.Join(dir, algo, "%T.bin"), Raw: true, WriteChecksum: true, HashAlgo: algo}}
+	}
+	rs := newTestServer(t, configs)
+	rs.now = func() time.Time { return time.Unix(1772600000, 0) }
+	body := []byte("checked")
+	s512 := sha512.Sum512(body)
+	s1 := sha1.Sum(body)
+	b2 := blake2b.Sum512(body)
+	sums := make(map[string]bool)
+	for algo, want := range map[string][]byte{hashSHA512: s512[:], hashSHA1: s1[:], hashBLAKE2b: b2[:]} {
+		wantStatus(t, post(rs, "/"+algo+"/s"+algo, string(body)), 200)
+		names := listFiles(t, filepath.Join(dir, algo))
+		// the sidecar is named for its algorithm
+		if len(names) != 2 || names[1] != names[0]+"."+algo {
+			t.Fatalf("%s files %v", algo, names)
+		}
+		line := readFile(t, filepath.Join(dir, algo, names[1]))
+		if line != hex.EncodeToString(want)+"  "+names[0]+"\n" {
+			t.Errorf("%s checksum %q", algo, line)
+		}
+		sums[line] = true
+	}
+	if len(sums) != 3 {
+		t.Errorf("digests not distinct: %v", sums)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// readyRetry is how often waitReady checks storage until it is reachable
+const readyRetry = 5 * time.Second
+
+// readyTimeout bounds one storage check
+const readyTimeout = 10 * time.Second
+
+// healthz answers 200 while the process serves, for liveness probes
+func healthz(out http.ResponseWriter, request *http.Request) {
+	out.Header().Set("Content-Type", "text/plain")
+	out.Write([]byte("ok\n"))
+}
+
+// readyz answers 200 once waitReady has found storage reachable, 503
+// until then, for readiness probes
+func (rs *receiverServer) readyz(out http.ResponseWriter, request *http.Request) {
+	if !rs.ready.Load() {
+		http.Error(out, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	out.Header().Set("Content-Type", "text/plain")
+	out.Write([]byte("ready\n"))
+}
+
+// checkStorage checks that each S3 unit's bucket is reachable.
+// Local directories are made as needed, so there is nothing to wait for.
+func (rs *receiverServer) checkStorage() error {
+	for name, cfg := range rs.units() {
+		if cfg.s3client == nil {
+			continue
+		}
+		tmpl := cfg.OutTemplate
+		if cfg.AppendPath != "" {
+			tmpl = cfg.AppendPath
+		}
+		bucket, _ := splitS3Path(tmpl)
+		ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+		_, err := cfg.s3client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("config[%#v] bucket %s: %w", name, bucket, err)
+		}
+	}
+	return nil
+}
+
+// waitReady sets rs.ready once checkStorage passes, retrying until then.
+// Configs have all passed sane() before it is started.
+func (rs *receiverServer) waitReady() {
+	for {
+		err := rs.checkStorage()
+		if err == nil {
+			rs.ready.Store(true)
+			slog.Debug("ready")
+			return
+		}
+		slog.Warn("not ready", "err", err)
+		time.Sleep(readyRetry)
+	}
+}
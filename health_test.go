@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthReady(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	handler := rs.newHTTPServer("", "admin secret", false).Handler
+	get := func(target string) int {
+		return serveHandler(handler, testRequest("GET", target, "", nil)).Code
+	}
+	// no secret needed for either
+	if status := get("/healthz"); status != 200 {
+		t.Errorf("/healthz: status %d", status)
+	}
+	if status := get("/readyz"); status != 503 {
+		t.Errorf("/readyz before ready: status %d", status)
+	}
+	// local storage needs nothing, so waitReady returns at once
+	rs.waitReady()
+	if status := get("/readyz"); status != 200 {
+		t.Errorf("/readyz when ready: status %d", status)
+	}
+	if status := get("/healthz"); status != 200 {
+		t.Errorf("/healthz when ready: status %d", status)
+	}
+}
+
+func TestCheckStorage(t *testing.T) {
+	m := newMockS3(t)
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: "s3://b/a.cbor", MaxFileAge: Duration(time.Hour), S3PathStyle: true}},
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: "s3://c/%T.bin", Raw: true, S3PathStyle: true}},
+		"l": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sl", AppendPath: filepath.Join(t.TempDir(), "l.cbor")}},
+	})
+	m.buckets["/b"] = true
+	err := rs.checkStorage()
+	if err == nil || !strings.Contains(err.Error(), "bucket c") {
+		t.Fatalf("missing bucket: %v", err)
+	}
+	m.buckets["/c"] = true
+	err = rs.checkStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.waitReady()
+	if status := serveHandler(rs.newHTTPServer("", "", false).Handler, testRequest("GET", "/readyz", "", nil)).Code; status != 200 {
+		t.Errorf("/readyz: status %d", status)
+	}
+}
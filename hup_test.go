@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "cfg.json")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	stop := rs.reloadOnHUP(cfgPath, nil, 0)
+	defer stop()
+	wantStatus(t, post(rs, "/b/sb", "x"), 404)
+
+	writeConfig(t, cfgPath, `{
+  "a": {"secret": "sa", "append": "`+filepath.Join(dir, "a.cbor")+`"},
+  "b": {"secret": "sb", "append": "`+filepath.Join(dir, "b.cbor")+`"}
+}`)
+	err := syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "reload", func() bool { return rs.units()["b"] != nil })
+	wantStatus(t, post(rs, "/b/sb", "x"), 200)
+}
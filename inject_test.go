@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInjectedFailures(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+		"r": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", OutTemplate: filepath.Join(dir, "r", "%T.bin"), Raw: true}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	for _, tc := range []struct {
+		name, target string
+		setup        func()
+		want         string
+	}{
+		{"disk full opening", "/a/sa", func() {
+			rs.openFileFn = func(string, int, os.FileMode) (*os.File, error) { return nil, syscall.ENOSPC }
+		}, "no space"},
+		{"permission denied", "/r/sr", func() {
+			rs.createTempFn = func(string, string) (*os.File, error) { return nil, os.ErrPermission }
+		}, "permission denied"},
+		{"disk full writing", "/a/sa", func() {
+			rs.writeFn = func(io.Writer, []byte) (int, error) { return 0, syscall.ENOSPC }
+		}, "no space"},
+		{"short write", "/r/sr", func() {
+			rs.writeFn = func(w io.Writer, blob []byte) (int, error) { return w.Write(blob[:len(blob)/2]) }
+		}, "short write"},
+	} {
+		tc.setup()
+		out := post(rs, tc.target, "failed "+tc.name)
+		if out.Code != 500 || !strings.Contains(out.Body.String(), tc.want) {
+			t.Errorf("%s: %d %q", tc.name, out.Code, out.Body.String())
+		}
+		rs.openFileFn, rs.createTempFn, rs.writeFn = nil, nil, nil
+		// and storage recovers once the fault clears
+		when = when.Add(time.Second)
+		wantStatus(t, post(rs, tc.target, "after "+tc.name), 200)
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	recs := readRecords(t, filepath.Join(dir, "a.cbor"))
+	if len(recs) != 2 {
+		t.Errorf("a stored %d records, want 2", len(recs))
+	}
+	for _, rec := range recs {
+		if !strings.HasPrefix(string(rec.Data), "after ") {
+			t.Errorf("a stored %q", rec.Data)
+		}
+	}
+	// a failed raw write leaves neither a partial file nor a temp file
+	names := listFiles(t, filepath.Join(dir, "r"))
+	if len(names) != 2 {
+		t.Errorf("r files %v", names)
+	}
+	for _, name := range names {
+		if got := readFile(t, filepath.Join(dir, "r", name)); !strings.HasPrefix(got, "after ") {
+			t.Errorf("r/%s holds %q", name, got)
+		}
+	}
+}
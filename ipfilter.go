@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP is the address the request came from, without port.
+// With -trust-forwarded-for it is the last X-Forwarded-For entry, the
+// one the (single, trusted) proxy in front of receiver added.
+func (rs *receiverServer) clientIP(request *http.Request) string {
+	if rs.trustForwardedFor {
+		xff := request.Header.Values("X-Forwarded-For")
+		if len(xff) != 0 {
+			hops := strings.Split(xff[len(xff)-1], ",")
+			last := strings.TrimSpace(hops[len(hops)-1])
+			if last != "" {
+				return last
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// parseCIDRs takes "10.0.0.0/8", "2001:db8::/32", or a bare address
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %#v", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed checks AllowCIDRs and DenyCIDRs. An address that can't be
+// parsed is refused if either is set.
+func (ruc *ReceiverUnitConfig) ipAllowed(addr string) bool {
+	if len(ruc.allowNets) == 0 && len(ruc.denyNets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	if len(ruc.allowNets) != 0 && !netsContain(ruc.allowNets, ip) {
+		return false
+	}
+	return !netsContain(ruc.denyNets, ip)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", AllowCIDRs: []string{"10.0.0.0/33"}}, "allow")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", DenyCIDRs: []string{"not an ip"}}, "deny")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), AllowCIDRs: []string{"192.0.2.0/24", "2001:db8::/32"}, DenyCIDRs: []string{"192.0.2.66", "2001:db8:bad::/48"}}},
+	})
+	for _, tc := range []struct {
+		remote string
+		status int
+	}{
+		{"192.0.2.1:1234", 200},
+		{"192.0.2.66:1234", 403},
+		{"198.51.100.1:1234", 403},
+		{"[2001:db8::1]:1234", 200},
+		{"[2001:db8:bad::1]:1234", 403},
+		{"[2001:db9::1]:1234", 403},
+		// IPv4-mapped IPv6 is the IPv4 address
+		{"[::ffff:192.0.2.1]:1234", 200},
+		{"garbage", 403},
+	} {
+		request := testRequest("POST", "/a/sa", "text/plain", []byte(tc.remote))
+		request.RemoteAddr = tc.remote
+		if out := serve(rs, request); out.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.remote, out.Code, tc.status)
+		}
+	}
+
+	// X-Forwarded-For is ignored unless the proxy is trusted
+	spoofed := func(remote, xff string) int {
+		request := testRequest("POST", "/a/sa", "text/plain", []byte(xff))
+		request.RemoteAddr = remote
+		request.Header.Set("X-Forwarded-For", xff)
+		return serve(rs, request).Code
+	}
+	if status := spoofed("198.51.100.1:1234", "192.0.2.1"); status != 403 {
+		t.Errorf("spoofed X-Forwarded-For: status %d", status)
+	}
+	if status := spoofed("192.0.2.66:1234", "192.0.2.1"); status != 403 {
+		t.Errorf("spoofed X-Forwarded-For from a denied address: status %d", status)
+	}
+	rs.trustForwardedFor = true
+	// the last hop is the one the trusted proxy added
+	if status := spoofed("10.0.0.1:1234", "198.51.100.1, 192.0.2.1"); status != 200 {
+		t.Errorf("trusted proxy: status %d", status)
+	}
+	if status := spoofed("10.0.0.1:1234", "192.0.2.1, 198.51.100.1"); status != 403 {
+		t.Errorf("trusted proxy, client-added first hop: status %d", status)
+	}
+}
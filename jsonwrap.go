@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// jsonWrapContentType is the Content-Type of a body after JSONWrap
+const jsonWrapContentType = "application/json"
+
+// wrappedBinary is how JSONWrap writes a body that isn't text
+type wrappedBinary struct {
+	Base64 []byte `json:"base64"`
+}
+
+// wrapJSON makes body valid JSON: JSON is kept as it is, UTF-8 text
+// becomes a JSON string, anything else {"base64": "..."}
+func wrapJSON(body []byte) ([]byte, error) {
+	if json.Valid(body) {
+		return body, nil
+	}
+	if utf8.Valid(body) && bytes.IndexByte(body, 0) < 0 {
+		return json.Marshal(string(body))
+	}
+	return json.Marshal(wrappedBinary{Base64: body})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWrapJSON(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{`{"k": [1, 2]}`, `{"k": [1, 2]}`},
+		{`"already a string"`, `"already a string"`},
+		{"12", "12"},
+		{"plain text", `"plain text"`},
+		{"say \"hi\"\n\ttab <b>", `"say \"hi\"\n\ttab \u003cb\u003e"`},
+		{"", `""`},
+		{"\x00\xff", `{"base64":"AP8="}`},
+		// valid UTF-8 with a NUL is still binary
+		{"a\x00b", `{"base64":"YQBi"}`},
+	} {
+		got, err := wrapJSON([]byte(tc.body))
+		if err != nil || string(got) != tc.want {
+			t.Errorf("%q: got %s, %v, want %s", tc.body, got, err, tc.want)
+		}
+	}
+}
+
+func TestJSONWrap(t *testing.T) {
+	dir := t.TempDir()
+	appendPath := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: filepath.Join(dir, "o", "%T.json"), Raw: true, JSONWrap: true}},
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: appendPath, JSONWrap: true}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	bodies := []string{"plain text", "\x00\xff binary", `{"k": [1, 2]}`}
+	for _, body := range bodies {
+		when = when.Add(time.Second)
+		wantStatus(t, post(rs, "/o/so", body), 200)
+		wantStatus(t, post(rs, "/a/sa", body), 200)
+	}
+	rs.configs["a"].retire()
+
+	names := listFiles(t, filepath.Join(dir, "o"))
+	if len(names) != len(bodies) {
+		t.Fatalf("files %v", names)
+	}
+	recs := readRecords(t, appendPath)
+	if len(recs) != len(bodies) {
+		t.Fatalf("%d records", len(recs))
+	}
+	for i, want := range []any{"plain text", map[string]any{"base64": "AP8gYmluYXJ5"}, map[string]any{"k": []any{1.0, 2.0}}} {
+		var got any
+		err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, "o", names[i]))), &got)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %v, %v", names[i], got, err)
+		}
+		err = json.Unmarshal(recs[i].Data, &got)
+		if err != nil || !reflect.DeepEqual(got, want) || recs[i].ContentType != jsonWrapContentType {
+			t.Errorf("record %d: %q %s, %v", i, recs[i].ContentType, recs[i].Data, err)
+		}
+	}
+}
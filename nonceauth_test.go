@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// noncePost posts body to the unit signed for nonce with secret
+func noncePost(rs *receiverServer, target, secret, nonce, body string) int {
+	request := testRequest("POST", target, "text/plain", []byte(body))
+	request.Header.Set("X-Receiver-Nonce", nonce)
+	request.Header.Set("X-Receiver-Auth", hex.EncodeToString(nonceAuthMAC(secret, nonce, []byte(body))))
+	return serve(rs, request).Code
+}
+
+func TestNonceAuth(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", NonceAuth: true, NonceWindow: Duration(time.Minute), AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+
+	if code := noncePost(rs, "/a", "sa", "n1", "one"); code != 200 {
+		t.Fatalf("valid nonce: %d", code)
+	}
+	if code := noncePost(rs, "/a", "sa", "n1", "one"); code != 403 {
+		t.Errorf("replayed nonce: %d", code)
+	}
+	if code := noncePost(rs, "/a", "wrong", "n2", "two"); code != 403 {
+		t.Errorf("bad HMAC: %d", code)
+	}
+	// the bare secret isn't enough
+	wantStatus(t, post(rs, "/a/sa", "three"), 403)
+	// a signature over a different body
+	request := testRequest("POST", "/a", "text/plain", []byte("tampered"))
+	request.Header.Set("X-Receiver-Nonce", "n3")
+	request.Header.Set("X-Receiver-Auth", hex.EncodeToString(nonceAuthMAC("sa", "n3", []byte("original"))))
+	wantStatus(t, serve(rs, request), 403)
+	// past the window the nonce may be used again
+	when = when.Add(time.Minute)
+	if code := noncePost(rs, "/a", "sa", "n1", "four"); code != 200 {
+		t.Errorf("nonce after window: %d", code)
+	}
+
+	rs.configs["a"].retire()
+	recs := readRecords(t, filepath.Join(dir, "a.cbor"))
+	if len(recs) != 2 || string(recs[0].Data) != "one" || string(recs[1].Data) != "four" {
+		t.Fatalf("stored %d records", len(recs))
+	}
+}
+
+func TestNonceCachePrune(t *testing.T) {
+	nc := newNonceCache(time.Minute)
+	when := time.Unix(1772600000, 0)
+	for _, nonce := range []string{"a", "b", "c"} {
+		if !nc.use(nonce, when) {
+			t.Fatalf("fresh nonce %q refused", nonce)
+		}
+	}
+	if nc.use("b", when.Add(59*time.Second)) {
+		t.Fatal("replay within window accepted")
+	}
+	when = when.Add(2 * time.Minute)
+	if !nc.use("d", when) {
+		t.Fatal("fresh nonce refused")
+	}
+	if len(nc.seen) != 1 {
+		t.Fatalf("%d nonces kept after the window", len(nc.seen))
+	}
+}
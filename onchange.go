@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// errUnchanged is from storeRecord with StoreOnChange when the body is
+// the same as the last one stored. Callers treat it as success.
+var errUnchanged = errors.New("unchanged")
+
+// bodyUnchanged is true if sum is of what the unit last stored.
+// Caller holds ru.lastSumL.
+func (ru *ReceiverUnit) bodyUnchanged(sum []byte) bool {
+	return ru.lastSum != nil && bytes.Equal(ru.lastSum, sum)
+}
+
+func bodySum(body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return sum[:]
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStoreOnChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "c.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"c": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sc", AppendPath: path, StoreOnChange: true}},
+	})
+	for _, tc := range []struct {
+		body      string
+		unchanged bool
+	}{
+		{"one", false},
+		{"one", true},
+		{"one", true},
+		{"two", false},
+		{"two", true},
+		// only the last body is compared
+		{"one", false},
+		{"", false},
+		{"", true},
+	} {
+		out := post(rs, "/c/sc", tc.body)
+		wantStatus(t, out, 200)
+		if unchanged := strings.Contains(out.Body.String(), "unchanged"); unchanged != tc.unchanged {
+			t.Errorf("%q: answered %q", tc.body, out.Body)
+		}
+	}
+	rs.configs["c"].retire()
+	var got []string
+	for _, rec := range readRecords(t, path) {
+		got = append(got, string(rec.Data))
+	}
+	want := []string{"one", "two", "one", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+
+	// a failed store isn't remembered, so the same body is tried again
+	failing := newTestServer(t, map[string]*ReceiverUnit{
+		"f": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sf", AppendPath: filepath.Join(dir, "f.cbor"), StoreOnChange: true}},
+	})
+	failing.writeFn = func(io.Writer, []byte) (int, error) { return 0, syscall.ENOSPC }
+	wantStatus(t, post(failing, "/f/sf", "one"), 500)
+	failing.writeFn = nil
+	if out := post(failing, "/f/sf", "one"); out.Code != 200 || strings.Contains(out.Body.String(), "unchanged") {
+		t.Errorf("after a failure: status %d %q", out.Code, out.Body)
+	}
+}
+
+func TestStoreOnChangeConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "c.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"c": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sc", AppendPath: path, StoreOnChange: true}},
+	})
+	var encodes atomic.Int32
+	rs.encodeFn = func(rec *ReceiverRecord, format string, fieldNames map[string]string) ([]byte, error) {
+		encodes.Add(1)
+		return encodeRecord(rec, format, fieldNames)
+	}
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var first sync.Once
+	rs.writeFn = func(w io.Writer, blob []byte) (int, error) {
+		first.Do(func() {
+			close(entered)
+			<-release
+		})
+		return w.Write(blob)
+	}
+	var wg sync.WaitGroup
+	for _, body := range []string{"A", "B"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wantStatus(t, post(rs, "/c/sc", body), 200)
+		}()
+		if body == "A" {
+			<-entered
+		}
+	}
+	// B waits for A's store before it is compared, encoded and stored
+	time.Sleep(50 * time.Millisecond)
+	if n := encodes.Load(); n != 1 {
+		t.Errorf("%d encodes while the first store was in progress", n)
+	}
+	close(release)
+	wg.Wait()
+	// B was stored last, so A is a change
+	if out := post(rs, "/c/sc", "A"); strings.Contains(out.Body.String(), "unchanged") {
+		t.Error("A skipped after B was stored")
+	}
+	rs.configs["c"].retire()
+	var got []string
+	for _, rec := range readRecords(t, path) {
+		got = append(got, string(rec.Data))
+	}
+	if want := []string{"A", "B", "A"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+}
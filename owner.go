@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// lookupUID takes a user name or numeric id
+func lookupUID(owner string) (int, error) {
+	if uid, err := strconv.Atoi(owner); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID takes a group name or numeric id
+func lookupGID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// resolveOwner sets fileUID and fileGID from FileOwner and FileGroup,
+// -1 for unset which os.Chown leaves alone
+func (ruc *ReceiverUnitConfig) resolveOwner() error {
+	ruc.fileUID = -1
+	ruc.fileGID = -1
+	var err error
+	if ruc.FileOwner != "" {
+		ruc.fileUID, err = lookupUID(ruc.FileOwner)
+		if err != nil {
+			return fmt.Errorf("file-owner: %w", err)
+		}
+	}
+	if ruc.FileGroup != "" {
+		ruc.fileGID, err = lookupGID(ruc.FileGroup)
+		if err != nil {
+			return fmt.Errorf("file-group: %w", err)
+		}
+	}
+	return nil
+}
+
+func (ru *ReceiverUnit) wantChown() bool {
+	return ru.FileOwner != "" || ru.FileGroup != ""
+}
+
+// chownFile applies FileOwner/FileGroup to an open file.
+// Failure (usually not running as root) is logged once and otherwise
+// ignored, the data is still stored.
+func (ru *ReceiverUnit) chownFile(f *os.File) {
+	if !ru.wantChown() {
+		return
+	}
+	ru.chownResult(f.Name(), f.Chown(ru.fileUID, ru.fileGID))
+}
+
+// chownPath is chownFile for a sidecar written by path
+func (ru *ReceiverUnit) chownPath(fpath string) {
+	if !ru.wantChown() {
+		return
+	}
+	ru.chownResult(fpath, os.Chown(fpath, ru.fileUID, ru.fileGID))
+}
+
+func (ru *ReceiverUnit) chownResult(fpath string, err error) {
+	if err != nil && !ru.chownWarned.Swap(true) {
+		slog.Warn("chown failed, leaving file owners alone", "cfg", ru.name, "path", fpath, "err", err)
+	}
+}
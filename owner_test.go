@@ -0,0 +1,69 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestResolveOwner(t *testing.T) {
+	ruc := ReceiverUnitConfig{Secret: "s", AppendPath: "/tmp/x.cbor", FileOwner: "1234", FileGroup: "root"}
+	err := ruc.resolveOwner()
+	if err != nil || ruc.fileUID != 1234 || ruc.fileGID != 0 {
+		t.Fatalf("uid %d gid %d, err %v", ruc.fileUID, ruc.fileGID, err)
+	}
+	ruc = ReceiverUnitConfig{Secret: "s", AppendPath: "/tmp/x.cbor", FileGroup: "7"}
+	err = ruc.resolveOwner()
+	if err != nil || ruc.fileUID != -1 || ruc.fileGID != 7 {
+		t.Fatalf("uid %d gid %d, err %v", ruc.fileUID, ruc.fileGID, err)
+	}
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "/tmp/x.cbor", FileOwner: "no-such-user-here"}, "file-owner")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "/tmp/x.cbor", FileGroup: "no-such-group-here"}, "file-group")
+}
+
+func fileOwner(t *testing.T, path string) (int, int) {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	return int(st.Uid), int(st.Gid)
+}
+
+func TestChown(t *testing.T) {
+	dir := t.TempDir()
+	// as root the files are given away; otherwise chown fails and the
+	// records are stored anyway
+	const uid, gid = 65534, 65533
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), FileOwner: "65534", FileGroup: "65533"}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", OutTemplate: filepath.Join(dir, "b-%T"), WriteChecksum: true, FileOwner: "65534", FileGroup: "65533"}},
+	})
+	wantStatus(t, post(rs, "/a/sa", "one"), 200)
+	wantStatus(t, post(rs, "/b/sb", "two"), 200)
+	rs.configs["a"].retire()
+	if n := len(readRecords(t, filepath.Join(dir, "a.cbor"))); n != 1 {
+		t.Fatalf("a stored %d records", n)
+	}
+	names := listFiles(t, dir)
+	if len(names) != 3 {
+		t.Fatalf("files %v", names)
+	}
+	for _, name := range names {
+		fuid, fgid := fileOwner(t, filepath.Join(dir, name))
+		if os.Geteuid() == 0 {
+			if fuid != uid || fgid != gid {
+				t.Errorf("%s owned %d:%d, want %d:%d", name, fuid, fgid, uid, gid)
+			}
+		} else if fuid != os.Geteuid() {
+			t.Errorf("%s owned by %d", name, fuid)
+		}
+	}
+	if os.Geteuid() != 0 && !rs.configs["a"].chownWarned.Load() {
+		t.Error("chown failure not noted")
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes for f, so that a full disk fails
+// here instead of partway through writing. Filesystems that can't are
+// skipped.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const size = 1 << 20
+	err = preallocate(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	// a filesystem without fallocate is skipped, and the file stays empty
+	if info.Size() == 0 {
+		t.Skip("fallocate not supported here")
+	}
+	if info.Size() != size || st.Blocks*512 < size {
+		t.Errorf("size %d, %d blocks", info.Size(), st.Blocks)
+	}
+}
+
+// sizeWatcher reads r, noting the largest size f reaches meanwhile
+type sizeWatcher struct {
+	r   io.Reader
+	f   **os.File
+	max int64
+}
+
+func (sw *sizeWatcher) Read(p []byte) (int, error) {
+	if *sw.f != nil {
+		if info, err := (*sw.f).Stat(); err == nil && info.Size() > sw.max {
+			sw.max = info.Size()
+		}
+	}
+	return sw.r.Read(p)
+}
+
+func TestPreallocateOverMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"s": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "ss", OutTemplate: filepath.Join(dir, "%T.bin"), Raw: true, Preallocate: true, SpillThreshold: 1024, MaxSize: 1 << 20}},
+	})
+	var spill *os.File
+	rs.createTempFn = func(dir, pattern string) (*os.File, error) {
+		f, err := os.CreateTemp(dir, pattern)
+		spill = f
+		return f, err
+	}
+	body := &sizeWatcher{r: bytes.NewReader(bytes.Repeat([]byte("x"), 2<<20)), f: &spill}
+	request := testRequest("POST", "/s/ss", "application/octet-stream", nil)
+	request.Body = io.NopCloser(body)
+	// the client claims far more than the unit will take
+	request.ContentLength = 64 << 20
+	wantStatus(t, serve(rs, request), 413)
+	if spill == nil {
+		t.Fatal("body not spilled")
+	}
+	if body.max > 2<<20 {
+		t.Errorf("reserved %d bytes for a body over MaxSize", body.max)
+	}
+	if names := listFiles(t, dir); len(names) != 0 {
+		t.Errorf("files left %v", names)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// preallocate is only implemented on Linux, elsewhere files grow as
+// they are written
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPreallocateStore(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"p": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sp", OutTemplate: filepath.Join(dir, "p", "%T.bin"), Raw: true, Preallocate: true, MaxSize: 4 << 20}},
+		"s": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "ss", OutTemplate: filepath.Join(dir, "s", "%T.bin"), Raw: true, Preallocate: true, SpillThreshold: 1024, MaxSize: 4 << 20}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	big := bytes.Repeat([]byte("preallocated "), 20000)
+	for _, target := range []string{"/p/sp", "/s/ss"} {
+		wantStatus(t, serve(rs, testRequest("POST", target, "application/octet-stream", big)), 200)
+	}
+	// a body shorter than its Content-Length doesn't keep the reserved tail
+	when = when.Add(time.Second)
+	request := testRequest("POST", "/s/ss", "application/octet-stream", big)
+	request.ContentLength = 2 << 20
+	wantStatus(t, serve(rs, request), 200)
+
+	for _, unit := range []string{"p", "s"} {
+		for _, name := range listFiles(t, filepath.Join(dir, unit)) {
+			if got := readFile(t, filepath.Join(dir, unit, name)); got != string(big) {
+				t.Errorf("%s/%s: %d bytes, want %d", unit, name, len(got), len(big))
+			}
+		}
+	}
+	if names := listFiles(t, filepath.Join(dir, "s")); len(names) != 2 {
+		t.Errorf("s files %v", names)
+	}
+}
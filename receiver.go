@@ -1,20 +1,39 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/cipher"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	cbor "github.com/brianolson/cbor_go"
+	"bolson.org/receiver/data"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 )
 
 //go:embed static
@@ -22,155 +41,1283 @@ var sfs embed.FS
 
 const timestampFormat = "20060102_150405.999999999"
 
-func formatTemplateString(x string, when time.Time) string {
+// pathVars are the per-request values for path template directives
+type pathVars struct {
+	method string
+
+	// rec body is parsed on demand for %{json:field}
+	rec        *ReceiverRecord
+	jsonParsed bool
+	json       interface{}
+}
+
+func newPathVars(method string, rec *ReceiverRecord) *pathVars {
+	return &pathVars{method: method, rec: rec}
+}
+
+// formatTemplateString expands an OutTemplate.
+// %T becomes a timestamp in layout, %Y %m %d %H %i %S parts of it,
+// %M the request method, %{json:field} a field of a JSON body.
+func formatTemplateString(x string, when time.Time, layout string, vars *pathVars) string {
+	return expandTemplate(x, when, when.Format(layout), vars)
+}
+
+// expandTemplate does the directives common to OutTemplate and AppendPath
+func expandTemplate(x string, when time.Time, timestamp string, vars *pathVars) string {
 	// "%%" becomes "%"
 	// e.g. "%%T" -> "%T"
 	parts := strings.Split(x, "%%")
-	timestamp := when.Format(timestampFormat)
+	directives := strings.NewReplacer(
+		"%T", timestamp,
+		"%Y", when.Format("2006"),
+		"%m", when.Format("01"),
+		"%d", when.Format("02"),
+		"%H", when.Format("15"),
+		// %M was already the method, minutes are %i as in MySQL
+		"%i", when.Format("04"),
+		"%S", when.Format("05"),
+		"%M", sanitizeMethod(vars.method),
+	)
 	for i, p := range parts {
-		parts[i] = strings.ReplaceAll(p, "%T", timestamp)
+		parts[i] = vars.expandJSON(directives.Replace(p))
 	}
 	return strings.Join(parts, "%")
 }
 
-func formatAppendTemplateString(x string, unixSeconds int64) string {
-	// "%%" becomes "%"
-	// e.g. "%%T" -> "%T"
-	parts := strings.Split(x, "%%")
+// formatAppendTemplateString expands an AppendPath.
+// %T becomes unix seconds, or that time in layout if set, and otherwise
+// as formatTemplateString.
+func formatAppendTemplateString(x string, unixSeconds int64, layout string, vars *pathVars) string {
+	when := time.Unix(unixSeconds, 0)
 	timestamp := strconv.FormatInt(unixSeconds, 10)
-	for i, p := range parts {
-		parts[i] = strings.ReplaceAll(p, "%T", timestamp)
+	if layout != "" {
+		timestamp = when.Format(layout)
 	}
-	return strings.Join(parts, "%")
+	return expandTemplate(x, when, timestamp, vars)
 }
 
-type ReceiverRecord struct {
-	When        int64  `json:"t"`
-	Data        []byte `json:"d"`
-	ContentType string `json:"Content-Type"`
+const jsonDirectivePrefix = "%{json:"
+
+// jsonFieldMissing replaces %{json:field} when the body isn't JSON or
+// doesn't have the field
+const jsonFieldMissing = "_missing"
+
+// expandJSON replaces each %{json:field} in x.
+// field may be dotted to reach into nested objects, e.g. "%{json:device.id}"
+func (pv *pathVars) expandJSON(x string) string {
+	for {
+		start := strings.Index(x, jsonDirectivePrefix)
+		if start < 0 {
+			return x
+		}
+		end := strings.IndexByte(x[start:], '}')
+		if end < 0 {
+			return x
+		}
+		end += start
+		field := x[start+len(jsonDirectivePrefix) : end]
+		x = x[:start] + pv.jsonField(field) + x[end+1:]
+	}
+}
+
+// jsonField returns a body field sanitized for use in a path
+func (pv *pathVars) jsonField(field string) string {
+	if !pv.jsonParsed {
+		pv.jsonParsed = true
+		if pv.rec != nil && isJSONContentType(pv.rec.ContentType) {
+			dec := json.NewDecoder(bytes.NewReader(pv.rec.Data))
+			dec.UseNumber()
+			if dec.Decode(&pv.json) != nil {
+				pv.json = nil
+			}
+		}
+	}
+	v := pv.json
+	for _, key := range strings.Split(field, ".") {
+		ob, ok := v.(map[string]interface{})
+		if !ok {
+			return jsonFieldMissing
+		}
+		v, ok = ob[key]
+		if !ok {
+			return jsonFieldMissing
+		}
+	}
+	var xs string
+	switch tv := v.(type) {
+	case string:
+		xs = tv
+	case json.Number:
+		xs = tv.String()
+	case bool:
+		xs = strconv.FormatBool(tv)
+	default:
+		// null, objects, arrays
+		return jsonFieldMissing
+	}
+	xs = sanitizePathValue(xs)
+	if xs == "" {
+		return jsonFieldMissing
+	}
+	return xs
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// sanitizePathValue makes a client supplied value safe as part of a
+// single path element: no separators, no leading dots, bounded length
+func sanitizePathValue(xs string) string {
+	const maxLen = 100
+	xs = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, xs)
+	xs = strings.TrimLeft(xs, ".")
+	if len(xs) > maxLen {
+		xs = xs[:maxLen]
+	}
+	return xs
+}
+
+// sanitizeMethod makes an HTTP method safe to put in a file path
+func sanitizeMethod(method string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return -1
+	}, method)
+}
+
+// Duration is a time.Duration that is written in JSON config as a
+// string, e.g. "90s" or "10m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(blob []byte) error {
+	var xs string
+	err := json.Unmarshal(blob, &xs)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(xs)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type ReceiverRecord = data.ReceiverRecord
+
+// Storage formats, as named by the X-Receiver-Format header
+const (
+	formatRaw  = "raw"
+	formatCBOR = "cbor"
+	formatJSON = "json"
+
+	// formatJSONL is another name for formatJSON, which is one record
+	// per line
+	formatJSONL = "jsonl"
+)
+
+// encodeRecord renders a record as CBOR or as one line of JSON.
+// fieldNames renames JSON keys, see FieldNames.
+func encodeRecord(rec *ReceiverRecord, format string, fieldNames map[string]string) ([]byte, error) {
+	if format == formatJSON {
+		var blob []byte
+		var err error
+		if len(fieldNames) != 0 {
+			blob, err = rec.MarshalJSONFields(fieldNames)
+		} else {
+			blob, err = json.Marshal(rec)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append(blob, '\n'), nil
+	}
+	return rec.MarshalCBOR()
 }
 
 type ReceiverUnit struct {
 	ReceiverUnitConfig
 
+	// name is the key in receiverServer.configs
+	name string
+
+	// l guards the open file state, fpath through lastPath and TextLog,
+	// held across a whole storeRecord. It is also the rotation barrier:
+	// fout is only replaced or closed with l held, and every writer
+	// (requests, the write queue, gRPC, the fsync loop) takes l, so a
+	// write to the old file always finishes before it is closed.
+	l sync.Mutex
+
 	fpath string
-	fout  io.WriteCloser
+	fout  outFile
+
+	// fbase is GenerateAppendPath() for the open file,
+	// fpath may have a rotation suffix from fseq.
+	fbase   string
+	fseq    int
+	fopened time.Time
+
+	// unsynced is set by writes to fout since the last fsync
+	unsynced bool
+
+	// fbytes is the size of fout, for MaxFileBytes
+	fbytes int64
+
+	// stripes are set up if Stripes is, records go to them in turn
+	stripes    []*ReceiverUnit
+	nextStripe atomic.Uint64
+
+	// open TextLog file
+	tlpath string
+	tlout  *os.File
+
+	// lastPath is the most recent OutTemplate file, for remove-latest
+	lastPath string
+
+	// lastSum is the sha256 of the last body stored, for StoreOnChange.
+	// lastSumL is held from the compare through the store.
+	lastSumL sync.Mutex
+	lastSum  []byte
+
+	// stream is set if Stream is on
+	stream *recordStream
+
+	// writeQueue is set if MaxWritesPerSecond is
+	writeQueue *writeQueue
+
+	// budget is set if RequestBudget is
+	budget *requestBudget
+
+	// limiter is set if RateLimit is
+	limiter *rate.Limiter
+
+	// nonces is set if NonceAuth is
+	nonces *nonceCache
+
+	// paused is set from /admin/units/{name}/pause
+	paused atomic.Bool
+
+	// rotateReady is set by watchRotateSignal
+	rotateReady atomic.Bool
+
+	// chownWarned is set after the first chown failure is logged
+	chownWarned atomic.Bool
+
+	// aborted counts uploads the client gave up on mid-body
+	aborted atomic.Uint64
+
+	// lastWrite is unix nanoseconds of the last stored record, or of
+	// setup, and silent is set while over MaxSilence
+	lastWrite atomic.Int64
+	silent    atomic.Bool
+
+	// sink is where records go, see newSink()
+	sink Sink
+
+	// retired is set, with l held, once a config reload has replaced
+	// this unit. done is closed then to stop its goroutines.
+	retired bool
+	done    chan struct{}
+}
+
+// setup creates runtime state, after sane()
+func (ru *ReceiverUnit) setup(rs *receiverServer, name string) {
+	ru.name = name
+	ru.done = make(chan struct{})
+	ru.sink = ru.newSink(rs)
+	if ru.Stream {
+		ru.stream = newRecordStream()
+	}
+	if ru.NonceAuth {
+		ru.nonces = newNonceCache(time.Duration(ru.NonceWindow))
+	}
+	if ru.RateLimit > 0 {
+		ru.limiter = rate.NewLimiter(rate.Limit(ru.RateLimit), ru.RateBurst)
+	}
+	if ru.RequestBudget > 0 {
+		ru.budget = newRequestBudget(ru.RequestBudget, time.Duration(ru.BudgetWindow))
+	}
+	if ru.RotateOnSignal != "" {
+		go ru.watchRotateSignal()
+	}
+	if ru.FsyncInterval > 0 && ru.AppendPath != "" {
+		go ru.syncLoop()
+	}
+	if ru.MaxSilence > 0 {
+		ru.noteWrite(rs.clock())
+		go ru.silenceLoop(rs)
+	}
+	if ru.Stripes > 0 {
+		ru.setupStripes(rs)
+	}
+	if ru.MaxWritesPerSecond > 0 {
+		ru.writeQueue = newWriteQueue(ru.MaxWritesPerSecond, ru.WriteQueueSize, ru.done)
+		go ru.writeQueue.run(rs, ru)
+	}
 }
 
 type receiverServer struct {
+	// cl guards configs, which SIGHUP reload replaces, see units()
+	cl      sync.RWMutex
 	configs map[string]*ReceiverUnit
+
+	// now is time.Now unless a test replaces it
+	now func() time.Time
+
+	// openFileFn, createTempFn, and writeFn are os.OpenFile,
+	// os.CreateTemp, and io.Writer.Write unless a test replaces them to
+	// inject storage failures (disk full, permissions, short writes)
+	openFileFn   func(name string, flag int, perm os.FileMode) (*os.File, error)
+	createTempFn func(dir, pattern string) (*os.File, error)
+	writeFn      func(w io.Writer, blob []byte) (int, error)
+
+	// encodeFn is encodeRecord unless a test replaces it to make
+	// encoding fail, for FallbackRaw
+	encodeFn func(rec *ReceiverRecord, format string, fieldNames map[string]string) ([]byte, error)
+
+	tarpit *tarpit
+
+	// trustForwardedFor takes the client address from X-Forwarded-For,
+	// for running behind a reverse proxy
+	trustForwardedFor bool
+
+	// maxPathLen rejects longer URL paths with 414, if set
+	maxPathLen int
+
+	// ready is set by waitReady, for /readyz
+	ready atomic.Bool
+}
+
+func (rs *receiverServer) clock() time.Time {
+	if rs.now != nil {
+		return rs.now()
+	}
+	return time.Now()
+}
+
+func (rs *receiverServer) openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	if rs.openFileFn != nil {
+		return rs.openFileFn(name, flag, perm)
+	}
+	return os.OpenFile(name, flag, perm)
+}
+
+// openFileDir is openFile that makes name's directory if it is missing
+func (rs *receiverServer) openFileDir(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return createInDir(filepath.Dir(name), func() (*os.File, error) {
+		return rs.openFile(name, flag, perm)
+	})
+}
+
+func (rs *receiverServer) createTemp(dir, pattern string) (*os.File, error) {
+	if rs.createTempFn != nil {
+		return rs.createTempFn(dir, pattern)
+	}
+	return os.CreateTemp(dir, pattern)
+}
+
+// createTempDir is createTemp that makes dir if it is missing
+func (rs *receiverServer) createTempDir(dir, pattern string) (*os.File, error) {
+	return createInDir(dir, func() (*os.File, error) {
+		return rs.createTemp(dir, pattern)
+	})
+}
+
+// createInDir runs create, and if dir didn't exist makes it and tries
+// again, for templates with e.g. "%Y/%m/%d/" directories. Checking only
+// on failure costs nothing once the directory is there.
+func createInDir(dir string, create func() (*os.File, error)) (*os.File, error) {
+	f, err := create()
+	if !errors.Is(err, os.ErrNotExist) {
+		return f, err
+	}
+	if os.MkdirAll(dir, 0755) != nil {
+		return f, err
+	}
+	return create()
+}
+
+func (rs *receiverServer) encode(rec *ReceiverRecord, format string, fieldNames map[string]string) ([]byte, error) {
+	if rs.encodeFn != nil {
+		return rs.encodeFn(rec, format, fieldNames)
+	}
+	return encodeRecord(rec, format, fieldNames)
+}
+
+// write is w.Write(blob), with short writes as io.ErrShortWrite
+func (rs *receiverServer) write(w io.Writer, blob []byte) error {
+	var n int
+	var err error
+	if rs.writeFn != nil {
+		n, err = rs.writeFn(w, blob)
+	} else {
+		n, err = w.Write(blob)
+	}
+	if err == nil && n < len(blob) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// splitPath splits a URL path on "/", dropping empty segments so that
+// leading, trailing, and doubled slashes don't matter.
+func splitPath(path string) []string {
+	parts := strings.Split(path, "/")
+	out := parts[:0]
+	for _, part := range parts {
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// defaultUnitName is the key in receiverServer.configs of the unit set
+// up by command line flags (or "" in a config file). It is only used
+// when nothing in the request names another unit, never by name.
+const defaultUnitName = "(default)"
+
+// lookupUnit finds a unit by exact name, or failing that a unit with
+// CaseInsensitiveNames set whose name matches ignoring case.
+// The default unit is not found by name, see defaultUnit.
+func (rs *receiverServer) lookupUnit(name string) (*ReceiverUnit, bool) {
+	if name == "" || name == defaultUnitName {
+		return nil, false
+	}
+	units := rs.units()
+	cfg, some := units[name]
+	if some {
+		return cfg, true
+	}
+	for cname, cfg := range units {
+		if cfg.CaseInsensitiveNames && strings.EqualFold(cname, name) {
+			return cfg, true
+		}
+	}
+	return nil, false
 }
 
 // Many ways to do it
 // ?d=configuration_name
 // /whatever/{configuration_name}/{secret}
-// Authorization: whatever {secret}
+// Authorization: Bearer {secret} (or any scheme, or just {secret})
 // X-Receiver-Token: {secret}
+//
+// Unit selection: first ?d=, then each non-empty path segment in order,
+// the first that names a unit wins, else the default unit (from flags)
+// if there is one. Empty segments from leading, trailing, or doubled
+// slashes are ignored, so "/a", "/a/", and "//a" are the same, and "/"
+// or "//" get the default unit. Names are case sensitive unless the
+// unit sets CaseInsensitiveNames, and an exact match always beats a
+// case-insensitive one.
+//
+// GET /{configuration_name}/stream is a Server-Sent Events feed of
+// stored records for units with Stream set.
+//
+// POST /{configuration_name}/batch stores several records at once for
+// units with AllowBatch set, see serveBatch.
 func (rs *receiverServer) ServeHTTP(out http.ResponseWriter, request *http.Request) {
-	request.ParseForm()
-	pathParts := strings.Split(request.URL.Path, "/")
-	configName := request.FormValue("d")
-	cfg, some := rs.configs[configName]
+	if rs.maxPathLen > 0 && len(request.URL.Path) > rs.maxPathLen {
+		// before splitting it, and before any unit is known
+		http.Error(out, "path too long", http.StatusRequestURITooLong)
+		return
+	}
+	if reservedMethod(request.Method) && request.Method != "OPTIONS" {
+		// whatever the unit's Methods say, for scanners that probe these
+		http.Error(out, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Only the URL query, not request.ParseForm(), which would consume
+	// an application/x-www-form-urlencoded body that should be stored.
+	query := request.URL.Query()
+	pathParts := splitPath(request.URL.Path)
+	configName := query.Get("d")
+	cfg, some := rs.lookupUnit(configName)
 	if !some {
 		for _, part := range pathParts {
-			cfg, some = rs.configs[part]
+			cfg, some = rs.lookupUnit(part)
 			if some {
 				break
 			}
 		}
+		if !some {
+			cfg, some = rs.defaultUnit()
+		}
 		if !some {
 			http.Error(out, "nope", http.StatusNotFound)
 			return
 		}
 	}
+	if !cfg.ipAllowed(rs.clientIP(request)) {
+		http.Error(out, "nope", http.StatusForbidden)
+		return
+	}
+	if request.Method == "OPTIONS" {
+		// CORS preflight comes without credentials, and stores nothing
+		allow := strings.Join(append(cfg.allowedMethods(), "OPTIONS"), ", ")
+		out.Header().Set("Allow", allow)
+		out.Header().Set("Access-Control-Allow-Methods", allow)
+		out.WriteHeader(http.StatusNoContent)
+		return
+	}
 	var err error
 	foundSecret := false
 	for _, part := range pathParts {
-		if cfg.Secret != "" && cfg.Secret == part {
+		if secretEqual(part, cfg.Secret) {
 			foundSecret = true
 		}
 	}
-	if cfg.Secret == "" {
+	if cfg.Public {
 		// ok
+	} else if cfg.NonceAuth {
+		// verified against the body once it has been read
+		if !hasNonceAuthHeaders(request) {
+			rs.denyAuth(out, request, cfg)
+			return
+		}
+	} else if cfg.Secret == "" && cfg.HMACSecret != "" {
+		// signature only, verified once the body has been read
 	} else if foundSecret {
 		// ok
-	} else if strings.Contains(request.Header.Get("Authorization"), cfg.Secret) {
-		// ok
-	} else if request.Header.Get("X-Receiver-Token") == cfg.Secret {
+	} else if tokenOK(request, cfg.Secret) {
 		// ok
 	} else {
-		http.Error(out, "nope", http.StatusForbidden)
+		rs.denyAuth(out, request, cfg)
+		return
+	}
+	if cfg.AuthFailTarpit > 0 && !cfg.NonceAuth && cfg.HMACSecret == "" {
+		rs.tarpit.succeed(rs.clientIP(request))
+	}
+	// after auth, so that unauthenticated junk can't use up the rate
+	// for real clients
+	if cfg.limiter != nil {
+		now := rs.clock()
+		reservation := cfg.limiter.ReserveN(now, 1)
+		if wait := reservation.DelayFrom(now); wait > 0 {
+			reservation.CancelAt(now)
+			cfg.setRetryAfter(out, wait)
+			http.Error(out, "rate limited", http.StatusTooManyRequests)
+			return
+		}
+	}
+	if cfg.budget != nil {
+		ok, wait := cfg.budget.allow(rs.clientIP(request), rs.clock())
+		if !ok {
+			cfg.setRetryAfter(out, wait)
+			http.Error(out, "request budget exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+	if cfg.stream != nil && request.Method == "GET" && len(pathParts) > 0 && pathParts[len(pathParts)-1] == "stream" {
+		if !cfg.bodyAuthOK(request, nil, rs.clock()) {
+			rs.denyAuth(out, request, cfg)
+			return
+		}
+		cfg.stream.ServeHTTP(out, request)
+		return
+	}
+	if cfg.AllowBatch && request.Method == "POST" && len(pathParts) > 0 && pathParts[len(pathParts)-1] == "batch" {
+		rs.serveBatch(out, request, cfg)
 		return
 	}
 	out.Header()["Content-Type"] = []string{"text/plain"}
-	if request.Method != "POST" {
-		http.Error(out, "not POST", 400)
+	switch cfg.actionFor(request.Method) {
+	case actionStore:
+		if cfg.paused.Load() {
+			cfg.setRetryAfter(out, 0)
+			http.Error(out, errUnitPaused.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	case actionRemoveLatest:
+		if !cfg.bodyAuthOK(request, nil, rs.clock()) {
+			rs.denyAuth(out, request, cfg)
+			return
+		}
+		rs.removeLatest(cfg, out)
 		return
+	default:
+		out.Header().Set("Allow", strings.Join(cfg.allowedMethods(), ", "))
+		http.Error(out, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType := cfg.contentTypeOrDefault(request.Header.Get("Content-Type"))
+	if cfg.stripsEncoding(request.Header) {
+		contentType = decodedContentType(contentType)
 	}
-	if (cfg.ContentType != "") && (cfg.ContentType != request.Header.Get("Content-Type")) {
+	if !cfg.contentTypeOK(contentType) {
 		http.Error(out, "unacceptable content-type", 400)
 		return
 	}
-	reader := http.MaxBytesReader(out, request.Body, cfg.MaxSize)
-	data, err := io.ReadAll(reader)
+	format := cfg.defaultFormat()
+	if hformat := request.Header.Get("X-Receiver-Format"); hformat != "" {
+		if !cfg.AllowFormatOverride {
+			http.Error(out, "format override not allowed", 400)
+			return
+		}
+		switch hformat {
+		case formatRaw:
+			if cfg.OutTemplate == "" {
+				http.Error(out, "raw format requires output template", 400)
+				return
+			}
+		case formatCBOR, formatJSON:
+			// ok
+		case formatJSONL:
+			hformat = formatJSON
+		default:
+			http.Error(out, "unknown format", 400)
+			return
+		}
+		format = hformat
+	}
+	maxSize := cfg.maxSizeFor(contentType)
+	// to tell the connection failing from the body failing to decode
+	raw := &rawBody{ReadCloser: request.Body}
+	request.Body = raw
+	reader, err := cfg.bodyReader(out, request, maxSize)
+	if errors.Is(err, errUnsupportedEncoding) {
+		http.Error(out, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		slog.Debug("body reader", "err", err)
+		http.Error(out, err.Error(), 400)
+		return
+	}
+	var data []byte
+	var spill *spillFile
+	if cfg.SpillThreshold > 0 && format == formatRaw {
+		expect := request.ContentLength
+		if cfg.DecodeContentEncoding && request.Header.Get("Content-Encoding") != "" {
+			// decoded size isn't known
+			expect = -1
+		}
+		if expect > maxSize {
+			// it will be refused, don't reserve disk for it
+			expect = -1
+		}
+		data, spill, err = rs.readBodySpill(cfg, reader, expect, request.Method, rs.clock())
+		if spill != nil {
+			// no-op once committed
+			defer discardTemp(spill.f)
+		}
+	} else {
+		data, err = readBody(reader, cfg.ReadBufferSize, maxSize)
+	}
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) || errors.Is(err, errCompressionRatio) {
+		slog.Debug("read body", "err", err)
+		http.Error(out, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil && clientGone(request, raw.err) {
+		// nobody to answer, and nothing was stored
+		cfg.aborted.Add(1)
+		slog.Debug("read body, client gone", "err", err)
+		return
+	}
+	if badEncoding(err) {
+		// e.g. truncated gzip from a client that is still there
+		slog.Debug("read body", "err", err)
+		http.Error(out, err.Error(), 400)
+		return
+	}
 	if err != nil {
 		slog.Debug("read body", "err", err)
 		http.Error(out, err.Error(), 500)
 		return
 	}
 
+	if !cfg.bodyAuthOK(request, data, rs.clock()) {
+		rs.denyAuth(out, request, cfg)
+		return
+	}
+	if cfg.ValidateJSON && isJSONContentType(contentType) && !json.Valid(data) {
+		http.Error(out, "invalid JSON", 400)
+		return
+	}
+
+	now := rs.clock()
+	var rec ReceiverRecord
+	rec.When = cfg.recordWhen(now)
+	rec.Data = data
+	rec.ContentType = contentType
+	rec.Headers = cfg.captureHeaders(request.Header)
+	rec.Query = cfg.captureQuery(query)
+	rec.Path = cfg.capturePath(pathParts)
+	if cfg.CaptureRemote {
+		rec.RemoteAddr = rs.clientIP(request)
+	}
+	size := int64(len(data))
+	if spill != nil {
+		size = spill.size
+	}
+	dryRun, err := queryBool(query, "dryrun")
+	if err != nil {
+		http.Error(out, "bad dryrun: "+err.Error(), 400)
+		return
+	}
+	if dryRun {
+		if !cfg.AllowDryRun {
+			http.Error(out, "dry run not allowed", 400)
+			return
+		}
+		rs.dryRun(out, cfg, &rec, size, format, request.Method, now)
+		return
+	}
+	if spill != nil {
+		err = rs.commitSpill(cfg, spill, &rec, request.Method, now)
+	} else {
+		err = rs.commitRecord(cfg, &rec, format, request.Method, now)
+	}
+	if errors.Is(err, errWriteQueueFull) {
+		cfg.setRetryAfter(out, cfg.writeQueue.interval)
+		http.Error(out, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errUnitPaused) {
+		cfg.setRetryAfter(out, 0)
+		http.Error(out, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errFileExists) {
+		http.Error(out, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errUnchanged) {
+		// fine, there was just nothing new to store
+		out.Write([]byte("unchanged\n"))
+		return
+	}
+	if err != nil {
+		http.Error(out, err.Error(), 500)
+		return
+	}
+}
+
+// queryBool parses a boolean query parameter as strconv.ParseBool does,
+// absent or empty is false
+func queryBool(query url.Values, name string) (bool, error) {
+	v := query.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// dryRunResult is the response to ?dryrun=1
+type dryRunResult struct {
+	Unit        string `json:"unit"`
+	Format      string `json:"format"`
+	Path        string `json:"path"`
+	ContentType string `json:"Content-Type"`
+	Size        int64  `json:"size"`
+	When        int64  `json:"t"`
+}
+
+// dryRun reports where a record would be stored, without storing it
+func (rs *receiverServer) dryRun(out http.ResponseWriter, cfg *ReceiverUnit, rec *ReceiverRecord, size int64, format, method string, now time.Time) {
+	vars := newPathVars(method, rec)
+	var path string
+	if cfg.AppendPath == "-" {
+		path = cfg.AppendPath
+	} else if cfg.AppendPath != "" {
+		path = cfg.GenerateAppendPath(now, vars)
+		if path == cfg.fbase {
+			path = cfg.fpath
+		}
+	} else {
+		path = formatTemplateString(cfg.OutTemplate, now, cfg.outTimeLayout(), vars)
+	}
+	result := dryRunResult{
+		Unit:        cfg.name,
+		Format:      format,
+		Path:        path,
+		ContentType: rec.ContentType,
+		Size:        size,
+		When:        rec.When,
+	}
+	out.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(out).Encode(result)
+}
+
+// removeLatest deletes the unit's most recently stored OutTemplate file
+func (rs *receiverServer) removeLatest(cfg *ReceiverUnit, out http.ResponseWriter) {
+	cfg.l.Lock()
+	defer cfg.l.Unlock()
+	if cfg.lastPath == "" {
+		http.Error(out, "nothing to remove", http.StatusNotFound)
+		return
+	}
+	err := os.Remove(cfg.lastPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Debug("remove latest", "path", cfg.lastPath, "err", err)
+		http.Error(out, err.Error(), 500)
+		return
+	}
+	if cfg.WriteChecksum {
+		os.Remove(cfg.lastPath + cfg.checksumSuffix())
+	}
+	if cfg.RawMeta || cfg.RawContentType != "" {
+		os.Remove(cfg.lastPath + data.RawMetaSuffix)
+	}
+	slog.Debug("removed latest", "path", cfg.lastPath)
+	cfg.lastPath = ""
+}
+
+// storeRecord encodes and writes one record to the unit's storage.
+// In raw format only rec.Data is written.
+func (rs *receiverServer) storeRecord(cfg *ReceiverUnit, rec *ReceiverRecord, format, method string, now time.Time) error {
+	if cfg.StoreOnChange {
+		// compare, store, and set as one, or two requests at once could
+		// leave lastSum at a body that wasn't the last stored
+		cfg.lastSumL.Lock()
+		defer cfg.lastSumL.Unlock()
+		sum := bodySum(rec.Data)
+		if cfg.bodyUnchanged(sum) {
+			return errUnchanged
+		}
+		err := rs.storeChanged(cfg, rec, format, method, now)
+		if err == nil {
+			cfg.lastSum = sum
+		}
+		return err
+	}
+	return rs.storeChanged(cfg, rec, format, method, now)
+}
+
+// storeChanged is storeRecord after the StoreOnChange check
+func (rs *receiverServer) storeChanged(cfg *ReceiverUnit, rec *ReceiverRecord, format, method string, now time.Time) error {
+	if len(cfg.stripes) != 0 {
+		return rs.storeStriped(cfg, rec, format, method, now)
+	}
+	var err error
+	vars := newPathVars(method, rec)
+	// encrypt a copy, rec stays plaintext for stream and tee
+	stored := rec
+	if cfg.aead != nil {
+		erec := *rec
+		err = erec.Encrypt(cfg.aead)
+		if err != nil {
+			return err
+		}
+		stored = &erec
+	}
 	var blob []byte
-	if cfg.Raw {
-		blob = data
+	if format == formatRaw {
+		blob = rawBlob(stored)
 	} else {
-		var rec ReceiverRecord
-		rec.When = time.Now().UnixMilli()
-		rec.Data = data
-		rec.ContentType = request.Header.Get("Content-Type")
-		blob, err = cbor.Dumps(rec)
+		blob, err = rs.encode(stored, format, cfg.FieldNames)
+		if err != nil && cfg.FallbackRaw {
+			fbpath := cfg.fallbackPath(now, vars)
+			ferr := rs.writeFileAtomic(fbpath, rawBlob(stored))
+			if ferr == nil {
+				cfg.chownPath(fbpath)
+				slog.Warn("encode record failed, stored raw body", "path", fbpath, "err", err)
+				return nil
+			}
+			slog.Error("raw fallback", "path", fbpath, "err", ferr)
+		}
 		if err != nil {
-			slog.Debug("cbor d", "err", err)
-			http.Error(out, err.Error(), 500)
-			return
+			slog.Debug("encode record", "format", format, "err", err)
+			return err
+		}
+	}
+	// file state below is shared by concurrent requests to the unit
+	cfg.l.Lock()
+	defer cfg.l.Unlock()
+	if cfg.retired {
+		// replaced by a config reload while this request was in flight
+		return errUnitPaused
+	}
+	err = cfg.sink.Store(blob, rec, format, now, vars)
+	if err != nil {
+		return err
+	}
+	cfg.afterStore(rec, now, vars)
+	return nil
+}
+
+// rawBlob is what raw format stores for rec, the body, after the nonce
+// if it is encrypted
+func rawBlob(rec *ReceiverRecord) []byte {
+	if len(rec.Nonce) != 0 {
+		// no record to hold the nonce, so it goes first
+		return append(append([]byte(nil), rec.Nonce...), rec.Data...)
+	}
+	return rec.Data
+}
+
+// afterStore does the secondary outputs for a stored record.
+// Caller holds ru.l, for the text log.
+func (ru *ReceiverUnit) afterStore(rec *ReceiverRecord, now time.Time, vars *pathVars) {
+	ru.noteWrite(now)
+	if ru.TextLog != "" {
+		ru.writeTextLog(rec, now, vars)
+	}
+	if ru.stream != nil {
+		ru.stream.publish(rec)
+	}
+	if ru.TeeStdout {
+		teeStdout(rec)
+	}
+}
+
+var stdoutLock sync.Mutex
+
+// teeStdout writes a record to stdout as one line of JSON
+func teeStdout(rec *ReceiverRecord) {
+	blob, err := encodeRecord(rec, formatJSON, nil)
+	if err != nil {
+		slog.Debug("tee json", "err", err)
+		return
+	}
+	stdoutLock.Lock()
+	defer stdoutLock.Unlock()
+	os.Stdout.Write(blob)
+}
+
+// tempSuffix marks in-progress OutTemplate files.
+// Anything left with this suffix is debris from a crash.
+const tempSuffix = ".receiver-tmp"
+
+// commitTemp closes a temp file and renames it to its final path
+func commitTemp(f *os.File, fpath string) error {
+	// CreateTemp makes 0600 files, match what os.Create would have done
+	err := f.Chmod(0644)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fpath)
+}
+
+// writeFileAtomic writes blob to fpath by way of a temp file
+func (rs *receiverServer) writeFileAtomic(fpath string, blob []byte) error {
+	f, err := rs.createTempDir(filepath.Dir(fpath), filepath.Base(fpath)+".*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+	defer discardTemp(f)
+	err = rs.write(f, blob)
+	if err != nil {
+		return err
+	}
+	return commitTemp(f, fpath)
+}
+
+// discardTemp cleans up after a temp file that was not committed.
+// After a successful commitTemp it is a harmless no-op.
+func discardTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// sweepStaleTemps removes temp files older than maxAge from dir,
+// returning how many were removed.
+func sweepStaleTemps(dir string, maxAge time.Duration) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+tempSuffix))
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	count := 0
+	for _, path := range matches {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if fi.Mode().IsRegular() && fi.ModTime().Before(cutoff) {
+			err = os.Remove(path)
+			if err != nil {
+				slog.Warn("stale temp", "path", path, "err", err)
+				continue
+			}
+			count++
 		}
 	}
-	var fout io.WriteCloser
-	var fpath string
-	if cfg.AppendPath != "" {
-		if cfg.AppendPath == "-" {
-			fout = os.Stdout
-			fpath = cfg.AppendPath
+	return count, nil
+}
+
+// sweepUnitTemps runs sweepStaleTemps over every OutTemplate directory.
+// A templated directory, "/data/%Y/%m/%d/%T.cbor", is swept all the way
+// down from the part that doesn't change, "/data".
+func (rs *receiverServer) sweepUnitTemps(maxAge time.Duration) {
+	seen := make(map[string]bool)
+	for _, cfg := range rs.units() {
+		if cfg.OutTemplate == "" {
+			continue
+		}
+		if isS3Path(cfg.OutTemplate) {
+			continue
+		}
+		dir := filepath.Dir(cfg.OutTemplate)
+		templated := strings.Contains(dir, "%")
+		if templated {
+			dir = templateRoot(cfg.OutTemplate)
+		}
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		var count int
+		var err error
+		if templated {
+			count, err = sweepStaleTempTree(dir, maxAge)
 		} else {
-			nfpath := cfg.GenerateAppendPath(time.Now())
-			if nfpath == cfg.fpath {
-				fout = cfg.fout
-			} else {
-				if cfg.fout != nil {
-					cfg.fout.Close()
-					cfg.fout = nil
-				}
-				fout, err = os.OpenFile(nfpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-				cfg.fout = fout
-				cfg.fpath = nfpath
+			count, err = sweepStaleTemps(dir, maxAge)
+		}
+		if err != nil {
+			slog.Warn("stale temp sweep", "dir", dir, "err", err)
+			continue
+		}
+		slog.Info("stale temp sweep", "dir", dir, "removed", count)
+	}
+}
+
+// sweepStaleTempTree is sweepStaleTemps for root and every directory
+// under it
+func sweepStaleTempTree(root string, maxAge time.Duration) (int, error) {
+	total := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
 			}
-			fpath = cfg.fpath
+			slog.Warn("stale temp sweep", "dir", path, "err", err)
+			return nil
 		}
-	} else {
-		fpath = formatTemplateString(cfg.OutTemplate, time.Now())
-		fout, err = os.Create(fpath)
-		defer fout.Close()
+		if !d.IsDir() {
+			return nil
+		}
+		count, err := sweepStaleTemps(path, maxAge)
+		total += count
+		if err != nil {
+			slog.Warn("stale temp sweep", "dir", path, "err", err)
+		}
+		return nil
+	})
+	return total, err
+}
+
+// readBody reads all of r.
+// If sizeHint is set the buffer is allocated once up front instead of
+// growing as io.ReadAll does, which matters for high rate fixed size bodies.
+func readBody(r io.Reader, sizeHint, maxSize int64) ([]byte, error) {
+	if sizeHint <= 0 {
+		return io.ReadAll(r)
+	}
+	if sizeHint > maxSize {
+		sizeHint = maxSize
+	}
+	var buf bytes.Buffer
+	// ReadFrom wants MinRead free space before each read,
+	// without the extra it would grow right away
+	buf.Grow(int(sizeHint) + bytes.MinRead)
+	_, err := buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
+
+// rawBody keeps the first error reading the request body off the
+// connection, before any Content-Encoding is decoded
+type rawBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (rb *rawBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && rb.err == nil {
+		rb.err = err
 	}
+	return n, err
+}
+
+// clientGone is true if a body read failed because the client hung up
+// or gave up: the request was canceled, or rawErr from the connection
+// is a reset or it closing before Content-Length bytes (or the final
+// chunk) arrived.
+func clientGone(request *http.Request, rawErr error) bool {
+	return request.Context().Err() != nil ||
+		errors.Is(rawErr, io.ErrUnexpectedEOF) ||
+		errors.Is(rawErr, syscall.ECONNRESET) ||
+		errors.Is(rawErr, net.ErrClosed)
+}
+
+// badEncoding is true for a body that arrived but doesn't decode, such
+// as corrupt or truncated gzip. Check clientGone first, a body cut off
+// by the connection closing looks truncated too.
+func badEncoding(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, gzip.ErrChecksum) ||
+		errors.As(err, &corrupt) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// updateLatestSymlink points "latest" in fpath's directory at fpath.
+// The link is made under a temp name and renamed over the old one so
+// readers never see it missing.
+func updateLatestSymlink(fpath string) error {
+	link := filepath.Join(filepath.Dir(fpath), "latest")
+	tmp := link + "." + strconv.Itoa(os.Getpid()) + tempSuffix
+	os.Remove(tmp)
+	err := os.Symlink(filepath.Base(fpath), tmp)
 	if err != nil {
-		slog.Debug("open", "path", fpath, "err", err)
-		http.Error(out, err.Error(), 500)
-		return
+		return err
 	}
-	_, err = fout.Write(blob)
+	err = os.Rename(tmp, link)
 	if err != nil {
-		slog.Debug("write", "path", fpath, "err", err)
-		http.Error(out, err.Error(), 500)
-		return
+		os.Remove(tmp)
 	}
+	return err
+}
+
+// writeFileHeader starts a new append file with a data.FileHeader line.
+// A file that already has data, e.g. reopened after a restart, is left alone.
+// f is nil for an S3 object, which is always new.
+func (ru *ReceiverUnit) writeFileHeader(w io.Writer, f *os.File, now time.Time) error {
+	if f != nil {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() != 0 {
+			return nil
+		}
+	}
+	fh := data.FileHeader{
+		Version: data.FileHeaderVersion,
+		Unit:    ru.name,
+		Created: now.UnixMilli(),
+	}
+	blob, err := fh.MarshalLine()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(blob)
+	return err
+}
+
+// writeChecksumFile writes e.g. fpath+".sha256" in the format of
+// sha256sum(1) so that `sha256sum -c` can verify it, see HashAlgo.
+func (ruc *ReceiverUnitConfig) writeChecksumFile(fpath string, blob []byte) error {
+	h := ruc.newHash()
+	h.Write(blob)
+	return ruc.writeChecksumLine(fpath, h.Sum(nil))
+}
+
+// writeChecksumLine is writeChecksumFile for an already computed sum
+func (ruc *ReceiverUnitConfig) writeChecksumLine(fpath string, sum []byte) error {
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum), filepath.Base(fpath))
+	return os.WriteFile(fpath+ruc.checksumSuffix(), []byte(line), 0644)
+}
+
+// preallocateMin is the smallest file Preallocate bothers with
+const preallocateMin = 64 * 1024
+
+// TimePrecision values
+const (
+	timePrecisionMilli = "milli"
+	timePrecisionNano  = "nano"
+)
+
+// recordWhen is now as ReceiverRecord.When in the unit's TimePrecision
+func (ruc *ReceiverUnitConfig) recordWhen(now time.Time) int64 {
+	if ruc.TimePrecision == timePrecisionNano {
+		return now.UnixNano()
+	}
+	return now.UnixMilli()
+}
+
+// captureHeaders picks out the request headers listed in Headers
+func (ruc *ReceiverUnitConfig) captureHeaders(header http.Header) map[string]string {
+	if len(ruc.Headers) == 0 {
+		return nil
+	}
+	var captured map[string]string
+	for _, name := range ruc.Headers {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		if name == "Content-Encoding" && ruc.stripsEncoding(header) {
+			continue
+		}
+		if captured == nil {
+			captured = make(map[string]string, len(ruc.Headers))
+		}
+		captured[name] = strings.Join(values, ", ")
+	}
+	return captured
+}
+
+// captureQuery is the request query for the record, if CaptureQuery
+func (ruc *ReceiverUnitConfig) captureQuery(query url.Values) map[string][]string {
+	if !ruc.CaptureQuery {
+		return nil
+	}
+	var captured map[string][]string
+	for k, v := range query {
+		if k == "d" || k == "dryrun" {
+			continue
+		}
+		if captured == nil {
+			captured = make(map[string][]string, len(query))
+		}
+		captured[k] = v
+	}
+	return captured
+}
+
+// capturePath is the request path for the record, if CapturePath
+func (ruc *ReceiverUnitConfig) capturePath(pathParts []string) string {
+	if !ruc.CapturePath {
+		return ""
+	}
+	parts := make([]string, len(pathParts))
+	for i, part := range pathParts {
+		if secretEqual(part, ruc.Secret) {
+			part = "-"
+		}
+		parts[i] = part
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// writeRawMeta writes the data.RawMeta sidecar for a raw file
+func (ru *ReceiverUnit) writeRawMeta(fpath string, rec *ReceiverRecord) error {
+	meta := data.RawMeta{When: rec.When, ContentType: rec.ContentType}
+	if ru.RawContentType != "" {
+		meta.ContentType = ru.RawContentType
+	}
+	blob, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fpath+data.RawMetaSuffix, append(blob, '\n'), 0644)
 }
 
 func faviconHandler(out http.ResponseWriter, request *http.Request) {
@@ -191,42 +1338,601 @@ type ReceiverUnitConfig struct {
 	// Default writes a CBOR ReceiverRecord
 	Raw bool `json:"raw"`
 
-	// POST request must include this secret
-	Secret string `json:"secret"`
+	// Format is "cbor" (default) or "jsonl", a ReceiverRecord per line
+	// of JSON with base64 data, for grep. "json" means jsonl too.
+	Format string `json:"format"`
+
+	// POST request must include this secret
+	Secret string `json:"secret"`
+
+	// SecretGroup lets units share a Secret or HMACSecret, which is
+	// otherwise refused at load: a secret in the path could pick the
+	// wrong unit. Units with the same SecretGroup may share secrets.
+	SecretGroup string `json:"secret-group"`
+
+	// NonceAuth replaces sending the Secret with challenge-response:
+	// X-Receiver-Nonce is a unique string and X-Receiver-Auth is
+	// hex(HMAC-SHA256(Secret, nonce + body)). A nonce is rejected if
+	// seen again within NonceWindow (default 5m).
+	NonceAuth   bool     `json:"nonce-auth"`
+	NonceWindow Duration `json:"nonce-window"`
+
+	// AuthFailTarpit, if set, delays the 403 for a client IP that keeps
+	// failing auth, doubling from 100ms per failure up to this.
+	AuthFailTarpit Duration `json:"auth-fail-tarpit"`
+
+	// HMACSecret requires X-Receiver-Signature, the hex HMAC-SHA256 of
+	// the body with this key ("sha256=" prefix optional), so the key
+	// itself is never sent. With Secret also set both are required.
+	// Stream and remove-latest have no body to sign, so they need Secret.
+	HMACSecret string `json:"hmac-secret"`
+
+	// Public must be set for a unit with no Secret.
+	// Anyone who can reach the server can post to it.
+	Public bool `json:"public"`
 
 	// OutTemplate forms output file path
+	// %T gets a timestamp, %M gets the request method
+	// %Y %m %d %H %i %S get the year, month, day, hour, minute (%i, as
+	// %M was taken) and second of the timestamp.
+	// Missing directories are made, e.g. "/data/%Y/%m/%d/%T.cbor"
+	// %{json:field} gets a field from an application/json body,
+	// sanitized, or "_missing". Dotted fields reach into objects.
 	// "%%" becomes "%"
 	// e.g. "%%T" -> "%T"
+	// "s3://bucket/prefix/%T.cbor" uploads each record as an S3 object.
 	OutTemplate string `json:"out"`
 
 	// AppendPath receives CBOR ReceiverRecord
 	// AppendPath %T gets unix seconds base 10
+	// AppendPath %M gets the request method
+	// AppendPath %Y %m %d %H %i %S as for OutTemplate
+	// AppendPath %{json:field} as for OutTemplate
 	// AppendPath %T unix seconds are clamped to modulo and offset from AppendMod and AppendOffset
 	// ```
 	// nowu := now.Unix()
 	// nowu = nowu - ((nowu + ruc.AppendOffset) % ruc.AppendMod)
 	// ```
+	// with the remainder taken in [0, AppendMod) even for negative
+	// AppendOffset, so %T is always the start of nowu's bucket.
+	// An "s3://bucket/key" AppendPath collects records in memory and
+	// uploads them as one object when the file would rotate (%T bucket,
+	// max-file-age, max-file-bytes) or on shutdown. One of those is
+	// required, and what hasn't been uploaded is lost in a crash.
 	AppendPath string `json:"append"`
 
+	// S3PathStyle addresses S3 as endpoint/bucket/key rather than
+	// bucket.endpoint/key, as MinIO and other S3-compatible services
+	// set by AWS_ENDPOINT_URL_S3 often need. Credentials and region come
+	// from the usual AWS environment and config files.
+	S3PathStyle bool `json:"s3-path-style"`
+
+	// FileHeader writes a data.FileHeader JSON line at the start of each
+	// new append file (unit name, format version, creation time).
+	// receiver_print skips it.
+	FileHeader bool `json:"file-header"`
+
+	// BlobPrefix and BlobSuffix are written before and after each blob
+	// in append mode, e.g. a magic banner for other tools to sniff.
+	// `receiver_print -blob-prefix ... -blob-suffix ...` strips them.
+	BlobPrefix string `json:"blob-prefix"`
+	BlobSuffix string `json:"blob-suffix"`
+
+	// Headers lists request headers to keep in each record, e.g.
+	// ["User-Agent", "X-GitHub-Event"], for debugging webhooks.
+	// Don't list Authorization or anything else carrying a secret.
+	Headers []string `json:"headers"`
+
+	// CaptureQuery keeps the URL query parameters in each record, other
+	// than the receiver's own d and dryrun. CapturePath keeps the URL
+	// path, with any secret segment replaced by "-".
+	CaptureQuery bool `json:"capture-query"`
+	CapturePath  bool `json:"capture-path"`
+
+	// TimePrecision of the record time "t", "milli" (default) or "nano"
+	// for high rate sources that need sub-millisecond ordering.
+	// Either way records sort by "t", and data.WhenTime() reads both.
+	TimePrecision string `json:"time-precision"`
+
+	// CaptureRemote keeps the client IP in each record ("remote"),
+	// see -trust-forwarded-for
+	CaptureRemote bool `json:"capture-remote"`
+
+	// RecordName stores the unit's name in each record ("name"), to tell
+	// records apart when several units share files or tools.
+	RecordName bool `json:"record-name"`
+
+	// Tags are static key/values put in each record ("tags"), e.g.
+	// {"site": "nyc"}, for grouping downstream
+	Tags map[string]string `json:"tags"`
+
+	// CollisionStrategy is what to do when an OutTemplate path already
+	// exists, e.g. from a coarse TimeFormat: "overwrite" (default)
+	// replaces it, "suffix" adds "-1", "-2", ... before the extension,
+	// "reject" answers 409.
+	CollisionStrategy string `json:"collision-strategy"`
+
+	// DefaultContentType is recorded for requests with no Content-Type,
+	// e.g. "text/plain" so receiver_print shows text from clients that
+	// don't send the header. It is checked against ContentTypes like a
+	// sent header.
+	DefaultContentType string `json:"default-content-type"`
+
+	// TimeFormat is a Go time layout for %T, e.g. "2006-01-02T15-04-05".
+	// The default is "20060102_150405.999999999" in OutTemplate and unix
+	// seconds in AppendPath. In AppendPath it formats the start of the
+	// AppendMod bucket.
+	TimeFormat string `json:"time-format"`
+
 	// AppendMod if non-zero changes %T in AppendPath
 	AppendMod int64 `json:"append-mod"`
 
 	AppendOffset int64 `json:"append-offset"`
 
+	// Methods are the HTTP methods accepted for storing, default ["POST"]
+	//
+	//	Methods, MethodActions   store or action, else 405 with Allow
+	//	GET .../stream           record stream, if Stream
+	//	POST .../batch           batch store, if AllowBatch
+	//	OPTIONS                  204 with Allow, no auth, never stored
+	//	TRACE, CONNECT           always 405, before any unit is looked up
+	//
+	// OPTIONS, TRACE and CONNECT can't be in Methods or MethodActions.
+	Methods []string `json:"methods"`
+
+	// MaintainLatestSymlink keeps a symlink "latest" next to the
+	// append file pointing at the current one, updated on rotation.
+	MaintainLatestSymlink bool `json:"latest-symlink"`
+
+	// MaxFileAge starts a new append file once the current one has
+	// been open this long, even within the same %T bucket.
+	// The new file gets a ".1", ".2", ... before its extension,
+	// "a.cbor" then "a.1.cbor".
+	MaxFileAge Duration `json:"max-file-age"`
+
+	// MaxFileBytes starts a new append file, with the same suffixes,
+	// before a record would take the current one past this size.
+	// A record bigger than that gets a file to itself. With Compress
+	// it counts bytes before compression, so files come out smaller.
+	MaxFileBytes int64 `json:"max-file-bytes"`
+
+	// Stripes spreads append writes over this many files, each with
+	// its own lock, taking records in turn, for sources too fast for
+	// one file. Stripe i of "a.cbor" is "a.s{i}.cbor". Each stripe is
+	// in time order; `receiver_print -merge` puts them back together.
+	Stripes int `json:"stripes"`
+
+	// AllowBatch enables POST /{name}/batch, a JSON array of
+	// {"contentType": "...", "dataBase64": "..."} each stored as its own
+	// record. The response is a JSON array of {"status": 200} or
+	// {"status": 4xx, "error": "..."} per item. The whole body is limited
+	// to MaxBatchBytes (default MaxSize), each item as a single post is.
+	AllowBatch    bool  `json:"allow-batch"`
+	MaxBatchBytes int64 `json:"max-batch-bytes"`
+
+	// Compress "gzip" writes append files through gzip, each record
+	// flushed as it is written. Name the AppendPath "*.gz" to match;
+	// receiver_print reads them either way.
+	Compress string `json:"compress"`
+
+	// Fsync makes each write durable before the request gets 200: the
+	// append file is fsynced after every record, and OutTemplate files
+	// before they are renamed into place. Without it a crash or power
+	// loss can drop recent records the client was told were stored.
+	// Each fsync costs a disk flush (milliseconds on spinning disks), so
+	// for busy units FsyncInterval instead syncs the append file in the
+	// background every interval, bounding loss to that window.
+	Fsync         bool     `json:"fsync"`
+	FsyncInterval Duration `json:"fsync-interval"`
+
+	// RotateOnSignal makes the append file rotate only when downstream
+	// says it is ready, instead of on %T or MaxFileAge. It is a sentinel
+	// file path, which is removed when seen, or an http(s) URL that
+	// answers 200 when ready. Checked every RotateSignalInterval
+	// (default 10s), the rotation happens on the next write.
+	RotateOnSignal       string   `json:"rotate-on-signal"`
+	RotateSignalInterval Duration `json:"rotate-signal-interval"`
+
+	// MethodActions maps HTTP methods to what they do, adding to
+	// Methods. Actions are "store" and "remove-latest", which deletes
+	// the most recent OutTemplate file, e.g.
+	// {"PUT": "store", "DELETE": "remove-latest"}
+	MethodActions map[string]string `json:"method-actions"`
+
 	// ContentType must match HTTP POST header Content-Type
 	ContentType string `json:"Content-Type"`
 
+	// ContentTypes, if set, lists the only media types accepted,
+	// e.g. ["application/json", "text/plain"].
+	// Parameters like "; charset=utf-8" are ignored.
+	// Public units must set this or ContentType.
+	ContentTypes []string `json:"content-types"`
+
 	MaxSize int64 `json:"max_ob_bytes"`
+
+	// MaxSizeByContentType overrides MaxSize by Content-Type prefix,
+	// e.g. {"image/": 50000000, "application/json": 10000}
+	// The longest matching prefix wins.
+	MaxSizeByContentType map[string]int64 `json:"max-size-by-content-type"`
+
+	// DecodeContentEncoding decompresses bodies sent with
+	// `Content-Encoding: gzip` before storing them.
+	// MaxSize applies to the decompressed size.
+	DecodeContentEncoding bool `json:"decode-content-encoding"`
+
+	// StripContentEncoding, with DecodeContentEncoding, stores decoded
+	// bodies as if they had been sent uncompressed: a "+gzip" suffix is
+	// dropped from the Content-Type (application/json+gzip becomes
+	// application/json) and Content-Encoding is left out of Headers.
+	StripContentEncoding bool `json:"strip-content-encoding"`
+
+	// MaxCompressionRatio, if set, rejects a compressed body with 413 as
+	// soon as it decompresses to more than this many times the
+	// compressed bytes read, a defense against decompression bombs.
+	MaxCompressionRatio float64 `json:"max-compression-ratio"`
+
+	// ValidateJSON rejects application/json bodies that don't parse
+	ValidateJSON bool `json:"validate-json"`
+
+	// Preallocate reserves the space for OutTemplate files of
+	// preallocateMin or more bytes (spilled bodies by Content-Length)
+	// before writing them, to reduce fragmentation and fail early when
+	// the disk is full. Linux only, elsewhere it does nothing.
+	Preallocate bool `json:"preallocate"`
+
+	// SpillThreshold, for raw OutTemplate units, streams bodies bigger
+	// than this many bytes to a temp file next to the output instead of
+	// holding them in memory. Not compatible with settings that need
+	// the whole body, see spillConflicts().
+	SpillThreshold int64 `json:"spill-threshold"`
+
+	// ReadBufferSize is the typical body size in bytes.
+	// If set, request bodies are read into a buffer preallocated to
+	// this size (capped at MaxSize).
+	ReadBufferSize int64 `json:"read-buffer-size"`
+
+	// AllowFormatOverride lets a request pick the storage format with
+	// the header `X-Receiver-Format: raw|cbor|json|jsonl`.
+	// "raw" is only possible with OutTemplate.
+	AllowFormatOverride bool `json:"allow-format-override"`
+
+	// FieldNames renames the keys of records stored as JSON, for a
+	// downstream schema, e.g. {"t": "timestamp", "d": "payload"}.
+	// Keys are as in data.JSONFieldNames. Read them back with
+	// `receiver_print -field-names t=timestamp,d=payload`.
+	FieldNames map[string]string `json:"field-names"`
+
+	// FallbackRaw stores the raw body to a ".raw" file if the record
+	// can't be encoded, rather than dropping it. With EncryptKey the
+	// body is sealed as raw files are, nonce first.
+	// See fallbackPath() for where that goes.
+	FallbackRaw bool `json:"fallback-raw"`
+
+	// CaseInsensitiveNames lets this unit be selected by its name in
+	// any case, e.g. unit "sensors" from "/Sensors/".
+	CaseInsensitiveNames bool `json:"case-insensitive-names"`
+
+	// Stream enables GET /{name}/stream, a Server-Sent Events feed of
+	// each newly stored record rendered as JSON.
+	// Clients may resume with Last-Event-ID.
+	Stream bool `json:"stream"`
+
+	// MaxWritesPerSecond caps how fast records are committed to storage,
+	// for downstream consumers with limited ingest. Bursts wait in a
+	// queue of up to WriteQueueSize (default 100) requests; beyond that
+	// requests get 503.
+	MaxWritesPerSecond float64 `json:"max-writes-per-second"`
+	WriteQueueSize     int     `json:"write-queue-size"`
+
+	// TeeStdout also writes each stored record to stdout as a line of
+	// JSON, for debugging.
+	TeeStdout bool `json:"tee-stdout"`
+
+	// AllowDryRun lets a request with ?dryrun=1 go through all the
+	// checks and get back a JSON summary of what would be stored,
+	// without storing anything.
+	AllowDryRun bool `json:"allow-dry-run"`
+
+	// EncryptKey, base64 of 32 random bytes, encrypts stored data with
+	// AES-256-GCM. Records keep the nonce in "n" and
+	// `receiver_print -key` decrypts them. Raw files are nonce then
+	// ciphertext. Generate with: head -c 32 /dev/urandom | base64
+	EncryptKey string `json:"encrypt-key"`
+
+	aead cipher.AEAD
+
+	// s3client is set if OutTemplate or AppendPath is s3://
+	s3client *s3.Client
+
+	// appendCache is set by sane() if appendPathTimeOnly()
+	appendCache *atomic.Pointer[appendPathBucket]
+
+	// AllowCIDRs, if set, limits the unit to clients in these networks
+	// ("10.0.0.0/8", "2001:db8::/32", or single addresses). DenyCIDRs
+	// refuses clients in these. Both get 403. Behind a proxy see
+	// -trust-forwarded-for.
+	AllowCIDRs []string `json:"allow-cidrs"`
+	DenyCIDRs  []string `json:"deny-cidrs"`
+
+	// from AllowCIDRs and DenyCIDRs by sane()
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+
+	// RateLimit caps the unit at this many requests per second, with
+	// bursts up to RateBurst (default 1), across all clients. Over the
+	// limit gets 429 with Retry-After. Keeps a misbehaving client from
+	// filling the disk. Each record of a gRPC stream counts.
+	RateLimit float64 `json:"rate-limit"`
+	RateBurst int     `json:"rate-burst"`
+
+	// RetryAfterSeconds is the least Retry-After sent with 429 and 503
+	// responses. Where the wait is known (RateLimit, RequestBudget,
+	// MaxWritesPerSecond) that is sent if longer. A paused unit only
+	// sends Retry-After if this is set.
+	RetryAfterSeconds int `json:"retry-after-seconds"`
+
+	// RequestBudget allows each client IP this many requests per
+	// BudgetWindow (default 1h), after which it gets 429 until the
+	// window ends. Coarse bot deterrence for public-ish units.
+	// Each record of a gRPC stream counts.
+	RequestBudget int      `json:"request-budget"`
+	BudgetWindow  Duration `json:"budget-window"`
+
+	// WriteChecksum writes a "{path}.sha256" sidecar next to each
+	// OutTemplate file. Not used in append mode.
+	WriteChecksum bool `json:"write-checksum"`
+
+	// HashAlgo is the WriteChecksum digest: "sha256" (default),
+	// "sha512", "blake2b" (512 bit, as b2sum), or "sha1". The sidecar
+	// is named for it, "{path}.sha512" etc.
+	HashAlgo string `json:"hash-algo"`
+
+	// RawMeta writes a "{path}.meta" data.RawMeta JSON sidecar with the
+	// time and Content-Type next to each raw OutTemplate file, so tools
+	// can tell what the bytes are.
+	RawMeta bool `json:"raw-meta"`
+
+	// RawContentType, if set, is the Content-Type recorded in raw .meta
+	// sidecars instead of the request's. Implies RawMeta.
+	RawContentType string `json:"raw-content-type"`
+
+	// FileOwner and FileGroup, user/group names or numeric ids, are
+	// applied to files the unit creates. Needs the privilege to chown
+	// (usually root); if that fails it is logged once and skipped.
+	FileOwner string `json:"file-owner"`
+	FileGroup string `json:"file-group"`
+
+	// TextLog, an append path template like AppendPath, gets a line per
+	// stored record: time, content type, size, and the first
+	// TextLogBytes (default 80) of text or JSON bodies. It rotates with
+	// the append file. Meant for grep, not for reading records back.
+	TextLog      string `json:"text-log"`
+	TextLogBytes int    `json:"text-log-bytes"`
+
+	// StoreOnChange skips a body the same as the last one the unit
+	// stored, for clients that poll and send their whole state each
+	// time. The request still succeeds, HTTP says "unchanged". Only the
+	// body is compared, and only since startup.
+	StoreOnChange bool `json:"store-on-change"`
+
+	// JSONWrap makes every stored body valid JSON, so raw OutTemplate
+	// files always parse: a JSON body is kept, other UTF-8 text becomes
+	// a JSON string, and binary {"base64": "..."}. The Content-Type
+	// becomes application/json.
+	JSONWrap bool `json:"json-wrap"`
+
+	// MaxSilence logs a warning when the unit has stored nothing for
+	// this long, counting from startup, for noticing sources that have
+	// stopped. SilenceWebhook, if set, is POSTed a JSON
+	// {"unit", "last-write", "silence"} then too. Once per silence;
+	// /status shows "silent" until records come again.
+	MaxSilence     Duration `json:"max-silence"`
+	SilenceWebhook string   `json:"silence-webhook"`
+
+	// from FileOwner and FileGroup by sane(), -1 if unset
+	fileUID int
+	fileGID int
 }
 
-func (ruc *ReceiverUnitConfig) GenerateAppendPath(now time.Time) string {
+func (ruc *ReceiverUnitConfig) GenerateAppendPath(now time.Time, vars *pathVars) string {
 	nowu := now.Unix()
+	if ruc.appendCache != nil {
+		if b := ruc.appendCache.Load(); b != nil && nowu >= b.start && nowu < b.end {
+			return b.path
+		}
+	}
+	start := ruc.appendBucket(nowu)
+	end := nowu + 1
+	if ruc.AppendMod != 0 {
+		end = start + ruc.AppendMod
+	}
+	path := formatAppendTemplateString(ruc.AppendPath, start, ruc.TimeFormat, vars)
+	if ruc.appendCache != nil {
+		ruc.appendCache.Store(&appendPathBucket{start: start, end: end, path: path})
+	}
+	return path
+}
+
+// appendBucket is the %T value for an append path at nowu unix seconds
+func (ruc *ReceiverUnitConfig) appendBucket(nowu int64) int64 {
 	if ruc.AppendMod == 0 {
-		return formatAppendTemplateString(ruc.AppendPath, nowu)
+		return nowu
 	}
 	remainder := (nowu + ruc.AppendOffset) % ruc.AppendMod
-	nowu = nowu - remainder
-	return formatAppendTemplateString(ruc.AppendPath, nowu)
+	if remainder < 0 {
+		// Go's % takes the sign of the dividend, floor instead
+		remainder += ruc.AppendMod
+	}
+	return nowu - remainder
+}
+
+// appendPathBucket is a GenerateAppendPath result and the unix seconds
+// [start,end) it holds for
+type appendPathBucket struct {
+	start int64
+	end   int64
+	path  string
+}
+
+// appendPathTimeOnly is true if AppendPath depends on nothing but the
+// time, so GenerateAppendPath can be cached per AppendMod bucket
+func (ruc *ReceiverUnitConfig) appendPathTimeOnly() bool {
+	return !strings.Contains(ruc.AppendPath, "%M") && !strings.Contains(ruc.AppendPath, jsonDirectivePrefix)
+}
+
+// rotatedPath adds a rotation sequence number for seq > 0, before the
+// extension so it still says what the file is: "a.cbor" -> "a.1.cbor",
+// "a.cbor.gz" -> "a.cbor.1.gz"
+func rotatedPath(base string, seq int) string {
+	if seq == 0 {
+		return base
+	}
+	ext := filepath.Ext(base)
+	return base[:len(base)-len(ext)] + "." + strconv.Itoa(seq) + ext
+}
+
+// outTimeLayout is the time.Format layout for %T in OutTemplate
+func (ruc *ReceiverUnitConfig) outTimeLayout() string {
+	if ruc.TimeFormat != "" {
+		return ruc.TimeFormat
+	}
+	return timestampFormat
+}
+
+// checkTimeFormat rejects a layout that has no time fields, which would
+// give every file the same name, or that would make a "/"
+func checkTimeFormat(layout string) error {
+	ref := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	formatted := ref.Format(layout)
+	if formatted == layout {
+		return errors.New("time-format has no time fields, use a Go reference time layout like \"2006-01-02T15-04-05\"")
+	}
+	if strings.ContainsRune(formatted, '/') {
+		return errors.New("time-format must not make a \"/\"")
+	}
+	return nil
+}
+
+// fallbackPath is where FallbackRaw puts a body that failed to encode.
+// That's next to the OutTemplate file, or for append mode a
+// timestamped file next to the current append file.
+func (ruc *ReceiverUnitConfig) fallbackPath(now time.Time, vars *pathVars) string {
+	if ruc.AppendPath != "" && ruc.AppendPath != "-" {
+		return ruc.GenerateAppendPath(now, vars) + "." + now.Format(timestampFormat) + ".raw"
+	}
+	if ruc.OutTemplate != "" {
+		return formatTemplateString(ruc.OutTemplate, now, ruc.outTimeLayout(), vars) + ".raw"
+	}
+	// append to stdout, fallback to cwd
+	return now.Format(timestampFormat) + ".raw"
+}
+
+// contentTypeOrDefault fills in DefaultContentType for a request without one
+func (ruc *ReceiverUnitConfig) contentTypeOrDefault(contentType string) string {
+	if contentType == "" {
+		return ruc.DefaultContentType
+	}
+	return contentType
+}
+
+// maxSizeFor returns the body size limit for a Content-Type
+func (ruc *ReceiverUnitConfig) maxSizeFor(contentType string) int64 {
+	maxSize := ruc.MaxSize
+	bestLen := -1
+	for prefix, size := range ruc.MaxSizeByContentType {
+		if len(prefix) > bestLen && strings.HasPrefix(contentType, prefix) {
+			maxSize = size
+			bestLen = len(prefix)
+		}
+	}
+	return maxSize
+}
+
+// contentTypeOK checks ContentType (exact) and ContentTypes (media type,
+// ignoring parameters like charset)
+func (ruc *ReceiverUnitConfig) contentTypeOK(contentType string) bool {
+	if (ruc.ContentType != "") && (ruc.ContentType != contentType) {
+		return false
+	}
+	if len(ruc.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return containsString(ruc.ContentTypes, mediaType)
+}
+
+// Method actions, see MethodActions
+const (
+	actionStore        = "store"
+	actionRemoveLatest = "remove-latest"
+)
+
+// allowedMethods is Methods, or just POST by default,
+// plus anything in MethodActions
+func (ruc *ReceiverUnitConfig) allowedMethods() []string {
+	methods := ruc.Methods
+	if len(methods) == 0 {
+		methods = []string{"POST"}
+	}
+	if len(ruc.MethodActions) == 0 {
+		return methods
+	}
+	all := append([]string(nil), methods...)
+	for m := range ruc.MethodActions {
+		if !containsString(all, m) {
+			all = append(all, m)
+		}
+	}
+	sort.Strings(all)
+	return all
+}
+
+// actionFor returns what to do for an HTTP method, "" if not allowed
+func (ruc *ReceiverUnitConfig) actionFor(method string) string {
+	if action, some := ruc.MethodActions[method]; some {
+		return action
+	}
+	methods := ruc.Methods
+	if len(methods) == 0 {
+		methods = []string{"POST"}
+	}
+	if containsString(methods, method) {
+		return actionStore
+	}
+	return ""
+}
+
+// reservedMethod is true for methods the server answers itself,
+// never stored or given an action
+func reservedMethod(method string) bool {
+	switch method {
+	case "OPTIONS", "TRACE", "CONNECT":
+		return true
+	}
+	return false
+}
+
+func containsString(they []string, x string) bool {
+	for _, v := range they {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultFormat is the storage format when a request doesn't pick one
+func (ruc *ReceiverUnitConfig) defaultFormat() string {
+	if ruc.Raw {
+		return formatRaw
+	}
+	if ruc.Format == formatJSON {
+		return formatJSON
+	}
+	return formatCBOR
 }
 
 func (ruc *ReceiverUnitConfig) sane() error {
@@ -235,18 +1941,334 @@ func (ruc *ReceiverUnitConfig) sane() error {
 			return errors.New("raw mode requires output template")
 		}
 	}
-	if ruc.Secret == "" {
-		return errors.New("secret must be set")
+	switch ruc.Format {
+	case "", formatCBOR, formatJSON:
+	case formatJSONL:
+		ruc.Format = formatJSON
+	default:
+		return fmt.Errorf("format %#v: want cbor or jsonl", ruc.Format)
+	}
+	if ruc.Raw && ruc.Format == formatJSON {
+		return errors.New("raw and format jsonl are exclusive")
+	}
+	if ruc.Public {
+		if ruc.Secret != "" {
+			return errors.New("public unit must not have a secret")
+		}
+	} else if ruc.Secret == "" && ruc.HMACSecret == "" {
+		return errors.New("secret or hmac-secret must be set, or \"public\": true for a unit anyone can post to")
+	}
+	if ruc.Public && ruc.HMACSecret != "" {
+		return errors.New("public unit must not have an hmac-secret")
+	}
+	if ruc.NonceAuth && ruc.Public {
+		return errors.New("nonce-auth needs a secret, not public")
+	}
+	if ruc.AuthFailTarpit < 0 {
+		return errors.New("auth-fail-tarpit must not be negative")
+	}
+	if ruc.NonceWindow < 0 {
+		return errors.New("nonce-window must not be negative")
+	}
+	if ruc.NonceAuth && ruc.NonceWindow == 0 {
+		ruc.NonceWindow = Duration(5 * time.Minute)
+	}
+	if ruc.Public && len(ruc.ContentTypes) == 0 && ruc.ContentType == "" {
+		return errors.New("public unit must restrict content-types")
+	}
+	for i, ct := range ruc.ContentTypes {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return fmt.Errorf("content-types[%d]: %s", i, err)
+		}
+		ruc.ContentTypes[i] = mediaType
 	}
 	if ruc.OutTemplate == "" && ruc.AppendPath == "" {
 		return errors.New("at least one of output template and append path must be set")
 	}
+	if ruc.RotateOnSignal != "" && (ruc.AppendPath == "" || ruc.AppendPath == "-") {
+		return errors.New("rotate-on-signal needs an append file")
+	}
+	if ruc.Stripes < 0 {
+		return errors.New("stripes must not be negative")
+	}
+	if ruc.Stripes > 0 {
+		if ruc.AppendPath == "" || ruc.AppendPath == "-" {
+			return errors.New("stripes needs an append file")
+		}
+		if ruc.RotateOnSignal != "" || ruc.MaintainLatestSymlink {
+			return errors.New("stripes can't be used with rotate-on-signal or latest-symlink")
+		}
+	}
+	if ruc.MaxFileBytes < 0 {
+		return errors.New("max-file-bytes must not be negative")
+	}
+	if ruc.MaxFileBytes > 0 && (ruc.AppendPath == "" || ruc.AppendPath == "-") {
+		return errors.New("max-file-bytes needs an append file")
+	}
+	if ruc.MaxFileBytes > 0 && ruc.RotateOnSignal != "" {
+		return errors.New("max-file-bytes can't be used with rotate-on-signal, which decides when to rotate")
+	}
+	switch ruc.Compress {
+	case "":
+	case compressGzip:
+		if ruc.AppendPath == "" || ruc.AppendPath == "-" {
+			return errors.New("compress needs an append file")
+		}
+	default:
+		return fmt.Errorf("compress: unknown %#v, want \"gzip\"", ruc.Compress)
+	}
+	switch ruc.CollisionStrategy {
+	case "", collisionOverwrite, collisionSuffix, collisionReject:
+	default:
+		return fmt.Errorf("collision-strategy: unknown %#v, want overwrite, suffix, or reject", ruc.CollisionStrategy)
+	}
+	if ruc.SpillThreshold < 0 {
+		return errors.New("spill-threshold must not be negative")
+	}
+	if ruc.SpillThreshold > 0 {
+		if !ruc.Raw || ruc.AppendPath != "" {
+			return errors.New("spill-threshold needs raw with an output template and no append file")
+		}
+		if conflict := ruc.spillConflicts(); conflict != "" {
+			return fmt.Errorf("spill-threshold can't be used with %s, which needs the whole body in memory", conflict)
+		}
+	}
+	if ruc.MaxBatchBytes < 0 {
+		return errors.New("max-batch-bytes must not be negative")
+	}
+	if ruc.FsyncInterval < 0 {
+		return errors.New("fsync-interval must not be negative")
+	}
+	if ruc.RotateSignalInterval < 0 {
+		return errors.New("rotate-signal-interval must not be negative")
+	}
+	if ruc.AppendMod < 0 {
+		return errors.New("append-mod must not be negative")
+	}
+	if ruc.MaxSilence < 0 {
+		return errors.New("max-silence must not be negative")
+	}
+	if ruc.SilenceWebhook != "" && ruc.MaxSilence == 0 {
+		return errors.New("silence-webhook needs max-silence")
+	}
+	if ruc.TimeFormat != "" {
+		err := checkTimeFormat(ruc.TimeFormat)
+		if err != nil {
+			return err
+		}
+	}
+	if ruc.AppendPath != "" && ruc.appendPathTimeOnly() {
+		ruc.appendCache = new(atomic.Pointer[appendPathBucket])
+	}
+	if ruc.TextLogBytes < 0 {
+		return errors.New("text-log-bytes must not be negative")
+	}
+	err := ruc.resolveOwner()
+	if err != nil {
+		return err
+	}
+	if ruc.EncryptKey != "" {
+		aead, err := data.ParseKey(ruc.EncryptKey)
+		if err != nil {
+			return fmt.Errorf("encrypt-key: %w", err)
+		}
+		ruc.aead = aead
+	}
+	if ruc.MaxCompressionRatio < 0 {
+		return errors.New("max-compression-ratio must not be negative")
+	}
+	if ruc.StripContentEncoding && !ruc.DecodeContentEncoding {
+		return errors.New("strip-content-encoding needs decode-content-encoding")
+	}
+	ruc.allowNets, err = parseCIDRs(ruc.AllowCIDRs)
+	if err != nil {
+		return fmt.Errorf("allow-cidrs: %w", err)
+	}
+	ruc.denyNets, err = parseCIDRs(ruc.DenyCIDRs)
+	if err != nil {
+		return fmt.Errorf("deny-cidrs: %w", err)
+	}
+	for i, name := range ruc.Headers {
+		ruc.Headers[i] = http.CanonicalHeaderKey(name)
+	}
+	switch ruc.TimePrecision {
+	case "", timePrecisionMilli, timePrecisionNano:
+	default:
+		return fmt.Errorf("time-precision: unknown %#v, want \"milli\" or \"nano\"", ruc.TimePrecision)
+	}
+	if ruc.RetryAfterSeconds < 0 {
+		return errors.New("retry-after-seconds must not be negative")
+	}
+	if ruc.RateLimit < 0 || ruc.RateBurst < 0 {
+		return errors.New("rate-limit and rate-burst must not be negative")
+	}
+	if ruc.RateLimit > 0 && ruc.RateBurst == 0 {
+		ruc.RateBurst = 1
+	}
+	if ruc.RequestBudget < 0 || ruc.BudgetWindow < 0 {
+		return errors.New("request-budget and budget-window must not be negative")
+	}
+	if ruc.RequestBudget > 0 && ruc.BudgetWindow == 0 {
+		ruc.BudgetWindow = Duration(time.Hour)
+	}
+	if ruc.MaxWritesPerSecond < 0 || ruc.WriteQueueSize < 0 {
+		return errors.New("max-writes-per-second and write-queue-size must not be negative")
+	}
+	if ruc.MaxWritesPerSecond > 0 && ruc.WriteQueueSize == 0 {
+		ruc.WriteQueueSize = 100
+	}
+	if ruc.MaxFileAge < 0 {
+		return errors.New("max-file-age must not be negative")
+	}
+	for prefix, size := range ruc.MaxSizeByContentType {
+		if size <= 0 {
+			return fmt.Errorf("max-size-by-content-type[%#v] must be positive", prefix)
+		}
+	}
+	for i, m := range ruc.Methods {
+		ruc.Methods[i] = strings.ToUpper(m)
+		if reservedMethod(ruc.Methods[i]) {
+			return fmt.Errorf("methods: %s can't store", ruc.Methods[i])
+		}
+	}
+	if len(ruc.MethodActions) != 0 {
+		actions := make(map[string]string, len(ruc.MethodActions))
+		for m, action := range ruc.MethodActions {
+			switch action {
+			case actionStore:
+			case actionRemoveLatest:
+				if ruc.OutTemplate == "" || ruc.AppendPath != "" {
+					return errors.New("method action remove-latest requires output template and no append path")
+				}
+			default:
+				return fmt.Errorf("method-actions[%#v]: unknown action %#v", m, action)
+			}
+			m = strings.ToUpper(m)
+			if reservedMethod(m) {
+				return fmt.Errorf("method-actions: %s can't have an action", m)
+			}
+			actions[m] = action
+		}
+		ruc.MethodActions = actions
+	}
+	if ruc.Secret == "" && ruc.HMACSecret != "" {
+		// with no body to sign the signature never changes, and one
+		// captured request would replay forever
+		if ruc.Stream {
+			return errors.New("stream needs a secret, hmac-secret alone can't authenticate a GET")
+		}
+		for m, action := range ruc.MethodActions {
+			if action == actionRemoveLatest {
+				return fmt.Errorf("method-actions[%#v]: remove-latest needs a secret, hmac-secret alone can't authenticate a request without a body", m)
+			}
+		}
+	}
+	err = checkHashAlgo(ruc.HashAlgo)
+	if err != nil {
+		return err
+	}
+	if len(ruc.FieldNames) != 0 {
+		err := data.CheckFieldNames(ruc.FieldNames)
+		if err != nil {
+			return fmt.Errorf("field-names: %w", err)
+		}
+	}
+	if ruc.usesS3() {
+		for _, p := range []string{ruc.OutTemplate, ruc.AppendPath} {
+			if bucket, key := splitS3Path(p); isS3Path(p) && (bucket == "" || key == "") {
+				return fmt.Errorf("%#v: s3 path needs a bucket and key", p)
+			}
+		}
+		if conflict := ruc.s3Conflicts(); conflict != "" {
+			return fmt.Errorf("s3 output can't be used with %s", conflict)
+		}
+		if isS3Path(ruc.AppendPath) && ruc.MaxFileAge == 0 && ruc.MaxFileBytes == 0 && (ruc.AppendMod == 0 || !strings.Contains(ruc.AppendPath, "%T")) {
+			// records are held in memory until the object is uploaded
+			return errors.New("s3 append needs max-file-age, max-file-bytes, or append-mod with %T, to upload before memory runs out")
+		}
+		client, err := newS3Client(ruc.S3PathStyle)
+		if err != nil {
+			return fmt.Errorf("s3: %w", err)
+		}
+		ruc.s3client = client
+	}
 	if ruc.MaxSize == 0 {
 		ruc.MaxSize = 10_000_00
 	}
 	return nil
 }
 
+// checkSharedAppendPaths rejects units that would append to the same
+// file. Each unit has its own file handle and they would interleave
+// partial writes.
+func checkSharedAppendPaths(configs map[string]*ReceiverUnit) error {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	byPath := make(map[string]string, len(configs))
+	for _, name := range names {
+		cfg := configs[name]
+		if cfg.AppendPath == "" || cfg.AppendPath == "-" {
+			continue
+		}
+		path := filepath.Clean(cfg.AppendPath)
+		if other, some := byPath[path]; some {
+			return fmt.Errorf("config[%#v] and config[%#v] both append to %#v", other, name, cfg.AppendPath)
+		}
+		byPath[path] = name
+	}
+	return nil
+}
+
+// shutdown stops taking new requests and lets the ones in progress
+// finish storing, up to timeout, before the files they write to are
+// closed. gs may be nil.
+func (rs *receiverServer) shutdown(server *http.Server, gs *grpc.Server, timeout time.Duration) {
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if gs != nil {
+		go func() {
+			<-sctx.Done()
+			gs.Stop()
+		}()
+		gs.GracefulStop()
+	}
+	err := server.Shutdown(sctx)
+	if err != nil {
+		slog.Warn("shutdown", "err", err)
+		server.Close()
+	}
+	rs.closeAppendFiles()
+}
+
+// newHTTPServer routes the health, admin, and unit handlers. Without
+// keep-alive every response closes its connection.
+func (rs *receiverServer) newHTTPServer(addr, adminSecret string, noKeepAlive bool) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/favicon.ico", faviconHandler)
+	// unauthenticated, for liveness and readiness probes
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", rs.readyz)
+	if adminSecret != "" {
+		admin := &adminHandler{rs: rs, secret: adminSecret}
+		mux.Handle("/admin/", admin)
+		mux.Handle("/status", admin)
+	}
+	mux.Handle("/", rs)
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	if noKeepAlive {
+		server.SetKeepAlivesEnabled(false)
+	}
+	return server
+}
+
 func maybefail(err error, msg string, p ...interface{}) {
 	if err == nil {
 		return
@@ -255,21 +2277,55 @@ func maybefail(err error, msg string, p ...interface{}) {
 	os.Exit(1)
 }
 
+// unitFlags configure the default unit, which needs -out or -append
+var unitFlags = []string{"secret", "public", "max", "raw", "content-type", "checksum"}
+
+// unitFlagsSet lists the unitFlags given to fs, as "-name"
+func unitFlagsSet(fs *flag.FlagSet) []string {
+	var set []string
+	fs.Visit(func(f *flag.Flag) {
+		if containsString(unitFlags, f.Name) {
+			set = append(set, "-"+f.Name)
+		}
+	})
+	return set
+}
+
 func main() {
 	var rs receiverServer
+	rs.tarpit = newTarpit()
 	var defaultReceiver ReceiverUnit
 	var verbose bool
 	serveAddr := flag.String("addr", ":8777", "Server Addr")
+	// HTTP keep-alive saves connection setup for clients that post
+	// repeatedly, at the cost of an open socket per idle client.
+	// Connection-per-request suits many clients that each post rarely.
+	noKeepAlive := flag.Bool("no-keepalive", false, "disable HTTP keep-alive, close the connection after each request")
+	// TCP keep-alive probes notice dead peers holding open connections
+	tcpKeepAlive := flag.Duration("tcp-keepalive", 0, "TCP keep-alive probe period, 0 for Go's default (15s), negative to disable")
+	tlsCert := flag.String("tls-cert", "", "serve HTTPS with this certificate (PEM), needs -tls-key")
+	tlsKey := flag.String("tls-key", "", "private key (PEM) for -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "require client certificates signed by a CA in this PEM file")
+	adminSecret := flag.String("admin-secret", "", "enables /admin/ and /status with this access token")
+	flag.BoolVar(&rs.trustForwardedFor, "trust-forwarded-for", false, "client address is the last X-Forwarded-For entry, only behind a reverse proxy that sets it")
+	flag.IntVar(&rs.maxPathLen, "max-path-len", 1024, "reject requests with a longer URL path (414), 0 for no limit")
+	grpcAddr := flag.String("grpc-addr", "", "also serve gRPC ingest (see receiver.proto) on this addr")
 	flag.StringVar(&defaultReceiver.Secret, "secret", "", "access token")
-	flag.StringVar(&defaultReceiver.OutTemplate, "out", "", "path template to write files to. %T gets timestamp")
+	flag.BoolVar(&defaultReceiver.Public, "public", false, "accept posts without a secret")
+	flag.StringVar(&defaultReceiver.OutTemplate, "out", "", "path template to write files to. %T gets timestamp, %Y %m %d %H %i %S its parts, %M the method")
 	flag.StringVar(&defaultReceiver.AppendPath, "append", "", "append to one file instead of writing files")
 	flag.Int64Var(&defaultReceiver.MaxSize, "max", 10_000_000, "maximum object to receive")
 	flag.BoolVar(&defaultReceiver.Raw, "raw", false, "write raw data instead of cbor ReceiverRecord")
 	flag.StringVar(&defaultReceiver.ContentType, "content-type", "", "only accept this Content-Type:")
+	flag.BoolVar(&defaultReceiver.WriteChecksum, "checksum", false, "write a .sha256 sidecar next to each -out file")
 	flag.BoolVar(&verbose, "verbose", false, "verbose logging")
 
 	var configPath string
 	flag.StringVar(&configPath, "cfg", "", "json config file")
+	maxUnits := flag.Int("max-units", 1000, "refuse a config with more units than this, 0 for no limit")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "on SIGINT/SIGTERM wait this long for requests in progress before closing files")
+	staleTempAge := flag.Duration("stale-tmp-age", time.Hour, "at startup remove leftover temp files older than this from output directories, 0 to disable")
+	fsyncInterval := flag.Duration("fsync-interval", 0, "fsync every unit's append files this often, bounding what a crash can lose without fsync per record")
 	flag.Parse()
 
 	if verbose {
@@ -279,33 +2335,104 @@ func main() {
 	}
 
 	if configPath != "" {
-		fin, err := os.Open(configPath)
-		maybefail(err, "%s: %s", configPath, err)
-		dec := json.NewDecoder(fin)
-		err = dec.Decode(&rs.configs)
-		maybefail(err, "%s: bad json, %s", configPath, err)
+		var err error
+		rs.configs, err = readConfigFile(configPath)
+		maybefail(err, "%s\n", err)
 		slog.Debug("loaded config", "cfg", rs.configs)
 	} else {
 		rs.configs = make(map[string]*ReceiverUnit, 1)
 	}
+	var flagUnit *ReceiverUnit
 	if defaultReceiver.OutTemplate != "" || defaultReceiver.AppendPath != "" {
-		rs.configs[""] = &defaultReceiver
+		flagUnit = &defaultReceiver
+		rs.configs[defaultUnitName] = flagUnit
+	} else if set := unitFlagsSet(flag.CommandLine); len(set) != 0 {
+		// they would configure a unit that doesn't exist
+		fmt.Fprintf(os.Stderr, "%s given but no -out or -append for the unit they configure\n", strings.Join(set, ", "))
+		flag.Usage()
+		os.Exit(1)
+	}
+	if len(rs.configs) == 0 {
+		slog.Warn("no units, nothing will be stored; set -out or -append, or -cfg")
 	}
+	err := checkMaxUnits(rs.configs, *maxUnits)
+	maybefail(err, "%s\n", err)
 	for name, cfg := range rs.configs {
 		err := cfg.sane()
 		maybefail(err, "config[%#v]: %s", name, err)
+		cfg.setup(&rs, name)
+		if cfg.Public {
+			slog.Warn("public unit, no secret required", "cfg", name)
+		}
 		// write back any config cleanup
 		rs.configs[name] = cfg
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/favicon.ico", faviconHandler)
-	mux.Handle("/", &rs)
+	err = checkSharedAppendPaths(rs.configs)
+	maybefail(err, "%s\n", err)
+	err = checkSharedSecrets(rs.configs)
+	maybefail(err, "%s\n", err)
 
-	server := &http.Server{
-		Addr:    *serveAddr,
-		Handler: mux,
+	if *staleTempAge > 0 {
+		rs.sweepUnitTemps(*staleTempAge)
+	}
+
+	if *fsyncInterval > 0 {
+		rs.syncAllLoop(*fsyncInterval)
+	}
+
+	if configPath != "" {
+		rs.reloadOnHUP(configPath, flagUnit, *maxUnits)
+	}
+
+	var gs *grpc.Server
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		maybefail(err, "%s: %s\n", *grpcAddr, err)
+		gs = rs.newGRPCServer()
+		go func() {
+			slog.Info("grpc serving on", "addr", *grpcAddr)
+			slog.Info("grpc exiting", "err", gs.Serve(lis))
+		}()
 	}
+
+	server := rs.newHTTPServer(*serveAddr, *adminSecret, *noKeepAlive)
+	if (*tlsCert == "") != (*tlsKey == "") {
+		maybefail(errors.New("tls"), "-tls-cert and -tls-key go together\n")
+	}
+	if *tlsClientCA != "" {
+		if *tlsCert == "" {
+			maybefail(errors.New("tls"), "-tls-client-ca needs -tls-cert and -tls-key\n")
+		}
+		server.TLSConfig, err = clientCATLSConfig(*tlsClientCA)
+		maybefail(err, "%s: %s\n", *tlsClientCA, err)
+	}
+	lc := net.ListenConfig{KeepAlive: *tcpKeepAlive}
+	ln, err := lc.Listen(context.Background(), "tcp", *serveAddr)
+	maybefail(err, "%s: %s\n", *serveAddr, err)
+	rs.logStartupSummary(*serveAddr, *grpcAddr)
+	go rs.waitReady()
 	slog.Info("serving on", "addr", *serveAddr)
-	slog.Info("exiting", "err", server.ListenAndServe())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		if *tlsCert != "" {
+			serveErr <- server.ServeTLS(ln, *tlsCert, *tlsKey)
+		} else {
+			serveErr <- server.Serve(ln)
+		}
+	}()
+	select {
+	case err = <-serveErr:
+		slog.Error("exiting", "err", err)
+		rs.closeAppendFiles()
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+	slog.Info("shutting down")
+	rs.shutdown(server, gs, *shutdownTimeout)
+	slog.Info("exiting")
 }
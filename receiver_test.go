@@ -0,0 +1,1426 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bolson.org/receiver/data"
+	cbor "github.com/brianolson/cbor_go"
+)
+
+// newTestServer sanes and sets up units as main does. They are retired,
+// closing their files, when the test ends.
+func newTestServer(t *testing.T, configs map[string]*ReceiverUnit) *receiverServer {
+	t.Helper()
+	rs := &receiverServer{configs: configs, tarpit: newTarpit()}
+	for name, cfg := range configs {
+		err := cfg.sane()
+		if err != nil {
+			t.Fatalf("config[%#v]: %s", name, err)
+		}
+		cfg.setup(rs, name)
+	}
+	t.Cleanup(func() {
+		for _, cfg := range rs.units() {
+			cfg.retire()
+		}
+	})
+	return rs
+}
+
+// testRequest is a request to ServeHTTP from testRemoteAddr
+func testRequest(method, target, contentType string, body []byte) *http.Request {
+	request := httptest.NewRequest(method, target, bytes.NewReader(body))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	request.RemoteAddr = testRemoteAddr
+	return request
+}
+
+const testRemoteAddr = "192.0.2.1:1234"
+
+// serve runs one request through rs
+func serve(rs *receiverServer, request *http.Request) *httptest.ResponseRecorder {
+	out := httptest.NewRecorder()
+	rs.ServeHTTP(out, request)
+	return out
+}
+
+// post sends body to target, text/plain
+func post(rs *receiverServer, target, body string) *httptest.ResponseRecorder {
+	return serve(rs, testRequest("POST", target, "text/plain", []byte(body)))
+}
+
+// wantStatus fails the test if out isn't status
+func wantStatus(t *testing.T, out *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if out.Code != status {
+		t.Fatalf("status %d, want %d: %q", out.Code, status, out.Body.String())
+	}
+}
+
+// readRecords decodes every CBOR record in a file
+func readRecords(t *testing.T, path string) []ReceiverRecord {
+	t.Helper()
+	fin, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fin.Close()
+	return decodeRecords(t, fin)
+}
+
+func decodeRecords(t *testing.T, r io.Reader) []ReceiverRecord {
+	t.Helper()
+	dec := cbor.NewDecoder(r)
+	var recs []ReceiverRecord
+	for {
+		var rec ReceiverRecord
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return recs
+		}
+		if err != nil {
+			t.Fatalf("record %d: %s", len(recs), err)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// listFiles is the names of the regular files under dir, sorted
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dir, path)
+			names = append(names, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readFile is the contents of path
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(blob)
+}
+
+func gzipBytes(t *testing.T, blob []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(blob)
+	err := gz.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTruncatedGzipBody(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), DecodeContentEncoding: true}},
+	})
+	body := gzipBytes(t, bytes.Repeat([]byte("hello world "), 1000))
+	request := testRequest("POST", "/a/sa", "text/plain", body[:len(body)/2])
+	request.Header.Set("Content-Encoding", "gzip")
+	wantStatus(t, serve(rs, request), 400)
+	if n := rs.configs["a"].aborted.Load(); n != 0 {
+		t.Fatalf("aborted %d", n)
+	}
+	if files := listFiles(t, dir); len(files) != 0 {
+		t.Fatalf("stored %v", files)
+	}
+}
+
+func TestClientAbort(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	server := httptest.NewServer(rs)
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// promise 100 bytes, send 5 and hang up
+	conn.Write([]byte("POST /a/sa HTTP/1.1\r\nHost: x\r\nContent-Length: 100\r\n\r\nhello"))
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for rs.configs["a"].aborted.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("abort not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if files := listFiles(t, dir); len(files) != 0 {
+		t.Fatalf("stored %v", files)
+	}
+}
+
+// abortingReader is a body whose client hangs up after some bytes
+type abortingReader struct {
+	body []byte
+}
+
+func (ar *abortingReader) Read(p []byte) (int, error) {
+	if len(ar.body) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, ar.body)
+	ar.body = ar.body[n:]
+	return n, nil
+}
+
+func TestClientAbortLeavesNoFile(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: filepath.Join(dir, "o", "%T.cbor")}},
+		// spilled to a temp file before the abort
+		"s": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "ss", OutTemplate: filepath.Join(dir, "s", "%T.bin"), Raw: true, SpillThreshold: 10}},
+	})
+	for _, unit := range []string{"o", "s"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		request := httptest.NewRequest("POST", "/"+unit+"/s"+unit, &abortingReader{body: bytes.Repeat([]byte("partial "), 100)}).WithContext(ctx)
+		request.ContentLength = 10000
+		cancel()
+		out := serve(rs, request)
+		// nobody to answer
+		if out.Body.Len() != 0 {
+			t.Errorf("%s: answered %d %q", unit, out.Code, out.Body.String())
+		}
+		if n := rs.units()[unit].aborted.Load(); n != 1 {
+			t.Errorf("%s: aborted %d", unit, n)
+		}
+	}
+	if files := listFiles(t, dir); len(files) != 0 {
+		t.Fatalf("left %v", files)
+	}
+}
+
+func TestReadBodySizeHint(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 20000)
+	for _, hint := range []int64{0, 1, int64(len(body)), int64(len(body)) * 2} {
+		got, err := readBody(bytes.NewReader(body), hint, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Fatalf("hint %d: got %d bytes", hint, len(got))
+		}
+	}
+	// the hint is capped at maxSize
+	got, err := readBody(bytes.NewReader(body[:100]), 1<<40, 1000)
+	if err != nil || !bytes.Equal(got, body[:100]) {
+		t.Fatalf("got %d bytes, err %v", len(got), err)
+	}
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	body := bytes.Repeat([]byte("0123456789"), 20000)
+	for _, bc := range []struct {
+		name string
+		hint int64
+	}{
+		{"ReadAll", 0},
+		{"ReadBufferSize", int64(len(body))},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for b.Loop() {
+				_, err := readBody(bytes.NewReader(body), bc.hint, 1<<20)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteChecksum(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", OutTemplate: filepath.Join(dir, "a-%T"), WriteChecksum: true}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", OutTemplate: filepath.Join(dir, "b-%T"), Raw: true, WriteChecksum: true}},
+	})
+	wantStatus(t, post(rs, "/a/sa", "hello"), 200)
+	wantStatus(t, post(rs, "/b/sb", "world"), 200)
+	files := listFiles(t, dir)
+	if len(files) != 4 {
+		t.Fatalf("files %v", files)
+	}
+	for _, name := range files {
+		if filepath.Ext(name) == ".sha256" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		sum := sha256.Sum256([]byte(readFile(t, path)))
+		want := hex.EncodeToString(sum[:]) + "  " + name + "\n"
+		if got := readFile(t, path+".sha256"); got != want {
+			t.Errorf("%s.sha256 is %q, want %q", name, got, want)
+		}
+	}
+	if got := readFile(t, filepath.Join(dir, files[2])); got != "world" {
+		t.Fatalf("raw file %q", got)
+	}
+}
+
+func TestFormatOverride(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", OutTemplate: filepath.Join(dir, "a", "%T"), AllowFormatOverride: true}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", OutTemplate: filepath.Join(dir, "b", "%T")}},
+		"c": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sc", AppendPath: filepath.Join(dir, "c.cbor"), AllowFormatOverride: true}},
+	})
+	second := int64(0)
+	rs.now = func() time.Time {
+		// a file name each
+		second++
+		return time.Unix(1772600000+second, 0)
+	}
+	postFormat := func(target, format string) *httptest.ResponseRecorder {
+		request := testRequest("POST", target, "text/plain", []byte("x"))
+		if format != "" {
+			request.Header.Set("X-Receiver-Format", format)
+		}
+		return serve(rs, request)
+	}
+	for _, format := range []string{"", "raw", "cbor", "json", "jsonl"} {
+		wantStatus(t, postFormat("/a/sa", format), 200)
+	}
+	var got []string
+	for _, name := range listFiles(t, filepath.Join(dir, "a")) {
+		got = append(got, readFile(t, filepath.Join(dir, "a", name)))
+	}
+	if len(got) != 5 {
+		t.Fatalf("files %q", got)
+	}
+	// default cbor, raw, cbor, then two lines of JSON
+	if got[1] != "x" {
+		t.Errorf("raw file %q", got[1])
+	}
+	for _, blob := range []string{got[0], got[2]} {
+		recs := decodeRecords(t, strings.NewReader(blob))
+		if len(recs) != 1 || string(recs[0].Data) != "x" {
+			t.Errorf("cbor file %q", blob)
+		}
+	}
+	for _, blob := range got[3:] {
+		var rec ReceiverRecord
+		err := json.Unmarshal([]byte(blob), &rec)
+		if err != nil || string(rec.Data) != "x" {
+			t.Errorf("json file %q: %v", blob, err)
+		}
+	}
+	wantStatus(t, postFormat("/a/sa", "xml"), 400)
+	wantStatus(t, postFormat("/b/sb", "raw"), 400)
+	wantStatus(t, postFormat("/b/sb", ""), 200)
+	// raw needs a file of its own
+	wantStatus(t, postFormat("/c/sc", "raw"), 400)
+	wantStatus(t, postFormat("/c/sc", "cbor"), 200)
+}
+
+func TestFallbackRaw(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), FallbackRaw: true}},
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: filepath.Join(dir, "o-%T"), FallbackRaw: true}},
+		"n": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sn", AppendPath: filepath.Join(dir, "n.cbor")}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	rs.encodeFn = func(*ReceiverRecord, string, map[string]string) ([]byte, error) {
+		return nil, errors.New("pathological record")
+	}
+	wantStatus(t, post(rs, "/a/sa", "body a"), 200)
+	wantStatus(t, post(rs, "/o/so", "body o"), 200)
+	wantStatus(t, post(rs, "/n/sn", "body n"), 500)
+	stamp := when.Format(timestampFormat)
+	want := map[string]string{
+		"a.cbor." + stamp + ".raw": "body a",
+		"o-" + stamp + ".raw":      "body o",
+	}
+	files := listFiles(t, dir)
+	if len(files) != len(want) {
+		t.Fatalf("files %v", files)
+	}
+	for name, body := range want {
+		if got := readFile(t, filepath.Join(dir, name)); got != body {
+			t.Errorf("%s: %q, want %q", name, got, body)
+		}
+	}
+}
+
+func TestFallbackRawEncrypted(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"e": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "se", OutTemplate: filepath.Join(dir, "e-%T"), FallbackRaw: true, EncryptKey: key}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	rs.encodeFn = func(*ReceiverRecord, string, map[string]string) ([]byte, error) {
+		return nil, errors.New("pathological record")
+	}
+	var temps int
+	rs.createTempFn = func(dir, pattern string) (*os.File, error) {
+		temps++
+		return os.CreateTemp(dir, pattern)
+	}
+	wantStatus(t, post(rs, "/e/se", "plain text body"), 200)
+	if temps != 1 {
+		t.Errorf("fallback made %d temp files through createTemp", temps)
+	}
+	// sealed as a raw file is, the nonce then the ciphertext
+	blob := []byte(readFile(t, filepath.Join(dir, "e-"+when.Format(timestampFormat)+".raw")))
+	if bytes.Contains(blob, []byte("plain")) {
+		t.Fatalf("fallback stored plaintext %q", blob)
+	}
+	aead, _ := data.ParseKey(key)
+	plain, err := aead.Open(nil, blob[:aead.NonceSize()], blob[aead.NonceSize():], nil)
+	if err != nil || string(plain) != "plain text body" {
+		t.Fatalf("decrypted %q, err %v", plain, err)
+	}
+}
+
+func TestMaxSizeByContentType(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{
+			Secret:     "sa",
+			AppendPath: filepath.Join(dir, "a.cbor"),
+			MaxSize:    1000,
+			MaxSizeByContentType: map[string]int64{
+				"image/":           100000,
+				"image/x-tiny":     10,
+				"application/json": 100,
+			},
+		}},
+	})
+	big := bytes.Repeat([]byte("x"), 5000)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "image/jpeg", big)), 200)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "image/x-tiny", big[:11])), 413)
+	jsonBody := []byte(`"` + string(big[:200]) + `"`)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "application/json", jsonBody)), 413)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "application/json", jsonBody[190:])), 200)
+	// falls back to MaxSize
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "text/plain", big[:1000])), 200)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "text/plain", big[:1001])), 413)
+	rs.configs["a"].retire()
+	if n := len(readRecords(t, filepath.Join(dir, "a.cbor"))); n != 3 {
+		t.Fatalf("stored %d records, want 3", n)
+	}
+}
+
+func TestUnitSelection(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"Name":  {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "s1", AppendPath: filepath.Join(dir, "Name.cbor"), CaseInsensitiveNames: true}},
+		"exact": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "s2", AppendPath: filepath.Join(dir, "exact.cbor")}},
+		"abc":   {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "s3", AppendPath: filepath.Join(dir, "abc.cbor"), CaseInsensitiveNames: true}},
+		"ABC":   {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "s4", AppendPath: filepath.Join(dir, "ABC.cbor")}},
+	})
+	for _, tc := range []struct {
+		target string
+		status int
+	}{
+		{"/Name/s1", 200},
+		{"/name/s1/", 200},
+		{"//NAME//s1", 200},
+		{"/x/nAmE/s1", 200},
+		{"/?d=name", 403},
+		{"/s1?d=name", 200},
+		{"/exact/s2", 200},
+		{"/exact/s2/", 200},
+		{"///exact///s2", 200},
+		{"/Exact/s2", 404},
+		{"/EXACT/s2", 404},
+		// an exact match wins over a case-insensitive one
+		{"/ABC/s4", 200},
+		{"/ABC/s3", 403},
+		{"/abc/s3", 200},
+		{"/Abc/s3", 200},
+		{"/", 404},
+		{"//", 404},
+	} {
+		if out := post(rs, tc.target, tc.target); out.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.target, out.Code, tc.status)
+		}
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	for name, want := range map[string]int{"Name.cbor": 5, "exact.cbor": 3, "abc.cbor": 2, "ABC.cbor": 1} {
+		if n := len(readRecords(t, filepath.Join(dir, name))); n != want {
+			t.Errorf("%s: %d records, want %d", name, n, want)
+		}
+	}
+}
+
+// wantSaneErr fails the test unless ruc.sane() fails mentioning want
+func wantSaneErr(t *testing.T, ruc ReceiverUnitConfig, want string) {
+	t.Helper()
+	err := ruc.sane()
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("%+v: sane() = %v, want error about %q", ruc, err, want)
+	}
+}
+
+func TestPublicUnit(t *testing.T) {
+	// an empty secret is only allowed on purpose
+	wantSaneErr(t, ReceiverUnitConfig{AppendPath: "a.cbor"}, `"public": true`)
+	wantSaneErr(t, ReceiverUnitConfig{AppendPath: "a.cbor", Public: true, Secret: "s", ContentType: "text/plain"}, "must not have a secret")
+	wantSaneErr(t, ReceiverUnitConfig{AppendPath: "a.cbor", Public: true, HMACSecret: "h", ContentType: "text/plain"}, "hmac-secret")
+	wantSaneErr(t, ReceiverUnitConfig{AppendPath: "a.cbor", Public: true}, "content-types")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"p": {ReceiverUnitConfig: ReceiverUnitConfig{Public: true, ContentTypes: []string{"text/plain"}, AppendPath: filepath.Join(dir, "p.cbor")}},
+	})
+	wantStatus(t, post(rs, "/p", "anyone"), 200)
+	wantStatus(t, serve(rs, testRequest("POST", "/p", "image/png", []byte("x"))), 400)
+	rs.configs["p"].retire()
+	if n := len(readRecords(t, filepath.Join(dir, "p.cbor"))); n != 1 {
+		t.Fatalf("stored %d records, want 1", n)
+	}
+}
+
+func TestSharedAppendPaths(t *testing.T) {
+	unit := func(appendPath string) *ReceiverUnit {
+		return &ReceiverUnit{ReceiverUnitConfig: ReceiverUnitConfig{AppendPath: appendPath}}
+	}
+	for _, tc := range []struct {
+		paths []string
+		ok    bool
+	}{
+		{[]string{"/d/a.cbor", "/d/b.cbor"}, true},
+		{[]string{"/d/a.cbor", "/d/a.cbor"}, false},
+		{[]string{"/d/a.cbor", "/d/./x/../a.cbor"}, false},
+		{[]string{"/d/%T.cbor", "/d/%T.cbor"}, false},
+		{[]string{"-", "-"}, true},
+		{[]string{"", "", "/d/a.cbor"}, true},
+	} {
+		configs := make(map[string]*ReceiverUnit)
+		for i, path := range tc.paths {
+			configs[fmt.Sprintf("u%d", i)] = unit(path)
+		}
+		err := checkSharedAppendPaths(configs)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: err %v", tc.paths, err)
+		}
+	}
+}
+
+func TestMethodActions(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", OutTemplate: "x/%T", MethodActions: map[string]string{"DELETE": "explode"}}, "unknown action")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", MethodActions: map[string]string{"DELETE": actionRemoveLatest}}, "requires output template")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{
+			Secret:        "sa",
+			OutTemplate:   filepath.Join(dir, "%T"),
+			WriteChecksum: true,
+			MethodActions: map[string]string{"PUT": actionStore, "DELETE": actionRemoveLatest},
+		}},
+	})
+	second := int64(0)
+	rs.now = func() time.Time {
+		second++
+		return time.Unix(1772600000+second, 0)
+	}
+	request := func(method, target string) *httptest.ResponseRecorder {
+		return serve(rs, testRequest(method, target, "text/plain", []byte(method)))
+	}
+	wantStatus(t, request("DELETE", "/a/sa"), 404)
+	wantStatus(t, request("POST", "/a/sa"), 200)
+	wantStatus(t, request("PUT", "/a/sa"), 200)
+	if files := listFiles(t, dir); len(files) != 4 {
+		t.Fatalf("files %v", files)
+	}
+	// auth is checked for actions too
+	wantStatus(t, request("DELETE", "/a/wrong"), 403)
+	wantStatus(t, request("DELETE", "/a/sa"), 200)
+	files := listFiles(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("files after delete %v", files)
+	}
+	recs := readRecords(t, filepath.Join(dir, files[0]))
+	if len(recs) != 1 || string(recs[0].Data) != "POST" {
+		t.Fatalf("kept %+v, want the POST", recs)
+	}
+	// only the latest, once
+	wantStatus(t, request("DELETE", "/a/sa"), 404)
+	out := request("GET", "/a/sa")
+	wantStatus(t, out, 405)
+	if allow := out.Header().Get("Allow"); allow != "DELETE, POST, PUT" {
+		t.Fatalf("Allow %q", allow)
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Public: true, AppendPath: "a.cbor"}, "content-types")
+	wantSaneErr(t, ReceiverUnitConfig{Public: true, AppendPath: "a.cbor", ContentTypes: []string{"text/"}}, "content-types[0]")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"p": {ReceiverUnitConfig: ReceiverUnitConfig{Public: true, AppendPath: filepath.Join(dir, "p.cbor"), ContentTypes: []string{"application/json", "Text/Plain; charset=utf-8"}, AllowBatch: true}},
+	})
+	for _, tc := range []struct {
+		contentType string
+		status      int
+	}{
+		{"application/json", 200},
+		{"text/plain", 200},
+		{"text/plain; charset=utf-8", 200},
+		{"TEXT/PLAIN", 200},
+		{"", 400},
+		{"application/octet-stream", 400},
+		{"image/png", 400},
+		{"text/plainx", 400},
+		{"not a media type", 400},
+	} {
+		out := serve(rs, testRequest("POST", "/p", tc.contentType, []byte(`{}`)))
+		if out.Code != tc.status {
+			t.Errorf("%q: status %d, want %d", tc.contentType, out.Code, tc.status)
+		}
+	}
+	// each batch item is held to it too
+	out := serve(rs, testRequest("POST", "/p/batch", "application/json", []byte(`[{"contentType":"text/plain","dataBase64":"eA=="},{"contentType":"application/zip","dataBase64":"eA=="}]`)))
+	wantStatus(t, out, 200)
+	if got := strings.TrimSpace(out.Body.String()); got != `[{"status":200},{"status":400,"error":"unacceptable content-type"}]` {
+		t.Fatalf("batch %s", got)
+	}
+	rs.configs["p"].retire()
+	if n := len(readRecords(t, filepath.Join(dir, "p.cbor"))); n != 5 {
+		t.Fatalf("stored %d records, want 5", n)
+	}
+}
+
+// captureStdout redirects os.Stdout until the returned func, which
+// gives back what was written
+func captureStdout(t *testing.T) func() string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	got := make(chan string)
+	go func() {
+		blob, _ := io.ReadAll(r)
+		got <- string(blob)
+	}()
+	return func() string {
+		os.Stdout = saved
+		w.Close()
+		return <-got
+	}
+}
+
+func TestTeeStdout(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, TeeStdout: true}},
+	})
+	stdout := captureStdout(t)
+	const n = 20
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			post(rs, "/a/sa", fmt.Sprintf("record %d %s", i, strings.Repeat("x", 5000)))
+		})
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSuffix(stdout(), "\n"), "\n")
+	if len(lines) != n {
+		t.Fatalf("%d lines on stdout, want %d", len(lines), n)
+	}
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		var rec ReceiverRecord
+		err := json.Unmarshal([]byte(line), &rec)
+		if err != nil {
+			t.Fatalf("stdout line %q: %s", line[:50], err)
+		}
+		seen[string(rec.Data)] = true
+	}
+	rs.configs["a"].retire()
+	recs := readRecords(t, path)
+	if len(recs) != n {
+		t.Fatalf("stored %d records, want %d", len(recs), n)
+	}
+	for _, rec := range recs {
+		if !seen[string(rec.Data)] {
+			t.Fatalf("stored record not on stdout: %q", rec.Data[:20])
+		}
+	}
+}
+
+func TestValidateJSON(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, ValidateJSON: true, AllowBatch: true}},
+	})
+	for _, tc := range []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"application/json", `{"a": [1, 2, {"b": null}]}`, 200},
+		{"application/json; charset=utf-8", `"just a string"`, 200},
+		{"application/ld+json", `{}`, 200},
+		{"application/json", `{"a": 1`, 400},
+		{"application/json", `{"a": 1} {"b": 2}`, 400},
+		{"application/json", ``, 400},
+		{"application/geo+json", `nope`, 400},
+		// other types aren't checked
+		{"text/plain", `{"a": 1`, 200},
+	} {
+		out := serve(rs, testRequest("POST", "/a/sa", tc.contentType, []byte(tc.body)))
+		if out.Code != tc.status {
+			t.Errorf("%s %q: status %d, want %d", tc.contentType, tc.body, out.Code, tc.status)
+		}
+	}
+	out := serve(rs, testRequest("POST", "/a/sa/batch", "application/json", []byte(`[{"contentType":"application/json","dataBase64":"e30="},{"contentType":"application/json","dataBase64":"ew=="}]`)))
+	if got := strings.TrimSpace(out.Body.String()); got != `[{"status":200},{"status":400,"error":"invalid JSON"}]` {
+		t.Fatalf("batch %s", got)
+	}
+	rs.configs["a"].retire()
+	if n := len(readRecords(t, path)); n != 5 {
+		t.Fatalf("stored %d records, want 5", n)
+	}
+}
+
+func TestNoKeepAlive(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	for _, noKeepAlive := range []bool{false, true} {
+		server := httptest.NewUnstartedServer(nil)
+		server.Config = rs.newHTTPServer("", "", noKeepAlive)
+		server.Start()
+		for _, target := range []string{"/a/sa", "/healthz"} {
+			response, err := server.Client().Post(server.URL+target, "text/plain", strings.NewReader("x"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			if response.StatusCode != 200 {
+				t.Errorf("%s: status %d", target, response.StatusCode)
+			}
+			if response.Close != noKeepAlive {
+				t.Errorf("no-keepalive %v, %s: Connection %q", noKeepAlive, target, response.Header.Get("Connection"))
+			}
+		}
+		server.Close()
+	}
+}
+
+func TestEncryptAtRest(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", EncryptKey: "c2hvcnQ="}, "encrypt-key")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, EncryptKey: key}},
+		"r": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", OutTemplate: filepath.Join(dir, "r-%T"), Raw: true, EncryptKey: key}},
+	})
+	wantStatus(t, post(rs, "/a/sa", "plain text one"), 200)
+	wantStatus(t, post(rs, "/r/sr", "plain text two"), 200)
+	rs.configs["a"].retire()
+	aead, _ := data.ParseKey(key)
+	recs := readRecords(t, path)
+	if len(recs) != 1 || bytes.Contains(recs[0].Data, []byte("plain")) {
+		t.Fatalf("stored %+v", recs)
+	}
+	err := recs[0].Decrypt(aead)
+	if err != nil || string(recs[0].Data) != "plain text one" {
+		t.Fatalf("decrypted %q, err %v", recs[0].Data, err)
+	}
+	// raw files are the nonce then the ciphertext
+	raw, _ := filepath.Glob(filepath.Join(dir, "r-*"))
+	if len(raw) != 1 {
+		t.Fatalf("raw files %v", raw)
+	}
+	blob := []byte(readFile(t, raw[0]))
+	nonce, sealed := blob[:aead.NonceSize()], blob[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil || string(plain) != "plain text two" {
+		t.Fatalf("raw decrypted %q, err %v", plain, err)
+	}
+}
+
+func TestFileHeader(t *testing.T) {
+	dir := t.TempDir()
+	configs := func() map[string]*ReceiverUnit {
+		return map[string]*ReceiverUnit{
+			"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), FileHeader: true, MaxFileBytes: 60}},
+		}
+	}
+	rs := newTestServer(t, configs())
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	for _, body := range []string{"one", "two", "three"} {
+		wantStatus(t, post(rs, "/a/sa", body), 200)
+	}
+	rs.configs["a"].retire()
+	// reopening the last file after a restart doesn't add another header
+	rs = newTestServer(t, configs())
+	rs.now = func() time.Time { return when }
+	wantStatus(t, post(rs, "/a/sa", "four"), 200)
+	rs.configs["a"].retire()
+
+	names := listFiles(t, dir)
+	if len(names) < 2 {
+		t.Fatalf("no rotation: %v", names)
+	}
+	var got []string
+	for _, name := range names {
+		blob, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, rest, _ := bytes.Cut(blob, []byte("\n"))
+		var fh data.FileHeader
+		err = json.Unmarshal(line, &fh)
+		if err != nil || fh.Version != data.FileHeaderVersion || fh.Unit != "a" || fh.Created != when.UnixMilli() {
+			t.Fatalf("%s header %q: %v", name, line, err)
+		}
+		if bytes.Contains(rest, data.FileHeaderMagic) {
+			t.Errorf("%s has a second header", name)
+		}
+		for _, rec := range decodeRecords(t, bytes.NewReader(rest)) {
+			got = append(got, string(rec.Data))
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "four,one,three,two" {
+		t.Fatalf("records %v in %v", got, names)
+	}
+}
+
+func TestRawMeta(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", OutTemplate: filepath.Join(dir, "a-%T"), Raw: true, RawMeta: true}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", OutTemplate: filepath.Join(dir, "b-%T"), Raw: true, RawContentType: "image/png"}},
+		"c": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sc", OutTemplate: filepath.Join(dir, "c-%T"), Raw: true}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "application/json", []byte(`{"a":1}`))), 200)
+	wantStatus(t, post(rs, "/b/sb", "png bytes"), 200)
+	wantStatus(t, post(rs, "/c/sc", "no meta"), 200)
+
+	for _, tc := range []struct{ unit, contentType string }{{"a", "application/json"}, {"b", "image/png"}} {
+		matches, _ := filepath.Glob(filepath.Join(dir, tc.unit+"-*"+data.RawMetaSuffix))
+		if len(matches) != 1 {
+			t.Fatalf("unit %s sidecars %v", tc.unit, matches)
+		}
+		var meta data.RawMeta
+		err := json.Unmarshal([]byte(readFile(t, matches[0])), &meta)
+		if err != nil || meta.ContentType != tc.contentType || meta.When != when.UnixMilli() {
+			t.Errorf("unit %s meta %+v, err %v", tc.unit, meta, err)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "c-*"+data.RawMetaSuffix)); len(matches) != 0 {
+		t.Errorf("sidecar without RawMeta: %v", matches)
+	}
+}
+
+func TestURLEncodedBody(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", AppendPath: filepath.Join(dir, "b.cbor")}},
+	})
+	// a "d" field in the body doesn't pick the unit, only the URL's does
+	const body = "d=b&msg=hello%20world&n=1"
+	const ct = "application/x-www-form-urlencoded"
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", ct, []byte(body))), 200)
+	wantStatus(t, serve(rs, testRequest("POST", "/sa?d=a", ct, []byte(body))), 200)
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	recs := readRecords(t, filepath.Join(dir, "a.cbor"))
+	if len(recs) != 2 {
+		t.Fatalf("stored %d records", len(recs))
+	}
+	for _, rec := range recs {
+		if string(rec.Data) != body || rec.ContentType != ct {
+			t.Errorf("stored %q %q", rec.Data, rec.ContentType)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.cbor")); err == nil {
+		t.Error("body field selected unit b")
+	}
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+		// rotating while the posts race
+		"r": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", AppendPath: filepath.Join(dir, "r", "r.cbor"), MaxFileBytes: 500}},
+	})
+	const n = 100
+	var wg sync.WaitGroup
+	codes := make(chan int, 2*n)
+	for i := 0; i < n; i++ {
+		for _, target := range []string{"/a/sa", "/r/sr"} {
+			wg.Add(1)
+			go func(target, body string) {
+				defer wg.Done()
+				codes <- post(rs, target, body).Code
+			}(target, fmt.Sprintf("record %03d", i))
+		}
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != 200 {
+			t.Fatalf("status %d", code)
+		}
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+
+	want := make([]string, n)
+	for i := range want {
+		want[i] = fmt.Sprintf("record %03d", i)
+	}
+	gotData := func(recs []ReceiverRecord) []string {
+		var got []string
+		for _, rec := range recs {
+			got = append(got, string(rec.Data))
+		}
+		sort.Strings(got)
+		return got
+	}
+	if got := gotData(readRecords(t, filepath.Join(dir, "a.cbor"))); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("append file has %d records: %v", len(got), got)
+	}
+	var rotated []ReceiverRecord
+	names := listFiles(t, filepath.Join(dir, "r"))
+	for _, name := range names {
+		rotated = append(rotated, readRecords(t, filepath.Join(dir, "r", name))...)
+	}
+	if len(names) < 2 {
+		t.Errorf("no rotation: %v", names)
+	}
+	if got := gotData(rotated); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("rotated files have %d records: %v", len(got), got)
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), DefaultContentType: "text/plain"}},
+		// the default is held to ContentTypes like a sent header
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", AppendPath: filepath.Join(dir, "b.cbor"), DefaultContentType: "text/plain", ContentTypes: []string{"text/plain"}}},
+		"c": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sc", AppendPath: filepath.Join(dir, "c.cbor")}},
+	})
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "", []byte("no header"))), 200)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "application/json", []byte("{}"))), 200)
+	wantStatus(t, serve(rs, testRequest("POST", "/b/sb", "", []byte("no header"))), 200)
+	wantStatus(t, serve(rs, testRequest("POST", "/b/sb", "application/json", []byte("{}"))), 400)
+	wantStatus(t, serve(rs, testRequest("POST", "/c/sc", "", []byte("no header"))), 200)
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	for _, tc := range []struct {
+		unit string
+		want []string
+	}{
+		{"a", []string{"text/plain", "application/json"}},
+		{"b", []string{"text/plain"}},
+		{"c", []string{""}},
+	} {
+		var got []string
+		for _, rec := range readRecords(t, filepath.Join(dir, tc.unit+".cbor")) {
+			got = append(got, rec.ContentType)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("unit %s content types %q, want %q", tc.unit, got, tc.want)
+		}
+	}
+}
+
+func TestRecordName(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), RecordName: true}},
+		"j": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sj", AppendPath: filepath.Join(dir, "j.jsonl"), RecordName: true, Format: formatJSONL}},
+		"n": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sn", AppendPath: filepath.Join(dir, "n.cbor")}},
+	})
+	for _, unit := range []string{"a", "j", "n"} {
+		wantStatus(t, post(rs, "/"+unit+"/s"+unit, "x"), 200)
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	if recs := readRecords(t, filepath.Join(dir, "a.cbor")); len(recs) != 1 || recs[0].Name != "a" {
+		t.Errorf("a stored %+v", recs)
+	}
+	if recs := readRecords(t, filepath.Join(dir, "n.cbor")); len(recs) != 1 || recs[0].Name != "" {
+		t.Errorf("n stored %+v", recs)
+	}
+	if line := readFile(t, filepath.Join(dir, "j.jsonl")); !strings.Contains(line, `"name":"j"`) {
+		t.Errorf("jsonl record %s", line)
+	}
+}
+
+func TestCaptureHeaders(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		// names are canonicalized by sane()
+		"h": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sh", AppendPath: filepath.Join(dir, "h.cbor"), Headers: []string{"x-github-event", "User-Agent", "X-Absent"}}},
+		"n": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sn", AppendPath: filepath.Join(dir, "n.cbor")}},
+	})
+	for _, target := range []string{"/h/sh", "/n/sn"} {
+		request := testRequest("POST", target, "text/plain", []byte("x"))
+		request.Header.Set("X-GitHub-Event", "push")
+		request.Header.Set("User-Agent", "hook/1")
+		request.Header.Add("User-Agent", "proxy/2")
+		request.Header.Set("Cookie", "session=s3kr1t")
+		wantStatus(t, serve(rs, request), 200)
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	recs := readRecords(t, filepath.Join(dir, "h.cbor"))
+	want := map[string]string{"X-Github-Event": "push", "User-Agent": "hook/1, proxy/2"}
+	if len(recs) != 1 || !reflect.DeepEqual(recs[0].Headers, want) {
+		t.Errorf("h stored %+v", recs)
+	}
+	if recs := readRecords(t, filepath.Join(dir, "n.cbor")); len(recs) != 1 || recs[0].Headers != nil {
+		t.Errorf("n stored %+v", recs)
+	}
+	// records without headers encode as before
+	blob := readFile(t, filepath.Join(dir, "n.cbor"))
+	if strings.Contains(blob, "headers") {
+		t.Errorf("empty headers encoded: %q", blob)
+	}
+}
+
+func TestCaptureQuery(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"q": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sq", AppendPath: filepath.Join(dir, "q.cbor"), CaptureQuery: true, CapturePath: true}},
+		"n": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sn", AppendPath: filepath.Join(dir, "n.cbor")}},
+	})
+	// the unit is picked by d, which isn't kept, and the secret is masked
+	wantStatus(t, post(rs, "/sq/push?d=q&source=gh&tag=a&tag=b", "x"), 200)
+	wantStatus(t, post(rs, "/sn/push?d=n&source=gh", "x"), 200)
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	recs := readRecords(t, filepath.Join(dir, "q.cbor"))
+	if len(recs) != 1 {
+		t.Fatalf("q stored %d records", len(recs))
+	}
+	want := map[string][]string{"source": {"gh"}, "tag": {"a", "b"}}
+	if !reflect.DeepEqual(recs[0].Query, want) || recs[0].Path != "/-/push" {
+		t.Errorf("q stored query %v path %q", recs[0].Query, recs[0].Path)
+	}
+	if recs := readRecords(t, filepath.Join(dir, "n.cbor")); len(recs) != 1 || recs[0].Query != nil || recs[0].Path != "" {
+		t.Errorf("n stored %+v", recs)
+	}
+}
+
+func TestTimePrecision(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", TimePrecision: "micro"}, "time-precision")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"m": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sm", AppendPath: filepath.Join(dir, "m.cbor")}},
+		"n": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sn", AppendPath: filepath.Join(dir, "n.cbor"), TimePrecision: timePrecisionNano, CaptureRemote: true}},
+	})
+	// three requests within one millisecond
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	for i := 0; i < 3; i++ {
+		wantStatus(t, post(rs, "/m/sm", "x"), 200)
+		wantStatus(t, post(rs, "/n/sn", "x"), 200)
+		when = when.Add(200 * time.Microsecond)
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	milli := readRecords(t, filepath.Join(dir, "m.cbor"))
+	nano := readRecords(t, filepath.Join(dir, "n.cbor"))
+	if len(milli) != 3 || len(nano) != 3 {
+		t.Fatalf("stored %d and %d records", len(milli), len(nano))
+	}
+	for i := range nano {
+		if milli[i].When != 1772600000000 || milli[i].RemoteAddr != "" {
+			t.Errorf("milli record %d: %+v", i, milli[i])
+		}
+		if i > 0 && nano[i].When <= nano[i-1].When {
+			t.Errorf("nano records out of order: %d then %d", nano[i-1].When, nano[i].When)
+		}
+		if nano[i].RemoteAddr != "192.0.2.1" {
+			t.Errorf("nano record RemoteAddr %q", nano[i].RemoteAddr)
+		}
+		// either precision reads back as the same instant
+		if got := nano[i].Time().Truncate(time.Millisecond); !got.Equal(milli[i].Time()) {
+			t.Errorf("record %d: %s and %s", i, got, milli[i].Time())
+		}
+	}
+}
+
+func TestJSONLFormat(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.xml", Format: "xml"}, "want cbor or jsonl")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", OutTemplate: "/tmp/%T", Raw: true, Format: formatJSONL}, "exclusive")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.jsonl")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, Format: formatJSONL}},
+	})
+	bodies := []string{"plain text", "\x00\xff binary\n", `{"k": [1, 2]}`}
+	for _, body := range bodies {
+		wantStatus(t, post(rs, "/a/sa", body), 200)
+	}
+	rs.units()["a"].retire()
+	lines := strings.SplitAfter(readFile(t, path), "\n")
+	if len(lines) != len(bodies)+1 || lines[len(bodies)] != "" {
+		t.Fatalf("lines %q", lines)
+	}
+	for i, body := range bodies {
+		var rec ReceiverRecord
+		err := json.Unmarshal([]byte(lines[i]), &rec)
+		if err != nil {
+			t.Fatalf("line %d %q: %v", i, lines[i], err)
+		}
+		if string(rec.Data) != body || rec.ContentType != "text/plain" || rec.When == 0 {
+			t.Errorf("line %d: %+v", i, rec)
+		}
+		// Data is base64, whatever the body
+		if !strings.Contains(lines[i], base64.StdEncoding.EncodeToString([]byte(body))) {
+			t.Errorf("line %d: %s", i, lines[i])
+		}
+	}
+}
+
+func TestFieldNames(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.jsonl", Format: formatJSONL, FieldNames: map[string]string{"t": "d"}}, "would both be")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.jsonl", Format: formatJSONL, FieldNames: map[string]string{"when": "timestamp"}}, "unknown field")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.jsonl")
+	names := map[string]string{"t": "timestamp", "d": "payload", "Content-Type": "type"}
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, Format: formatJSONL, FieldNames: names}},
+	})
+	rs.now = func() time.Time { return time.UnixMilli(1772600000123) }
+	wantStatus(t, post(rs, "/a/sa", "hello"), 200)
+	rs.units()["a"].retire()
+	line := readFile(t, path)
+	if want := `{"timestamp":1772600000123,"payload":"aGVsbG8=","type":"text/plain"}` + "\n"; line != want {
+		t.Fatalf("stored %s", line)
+	}
+	var rec ReceiverRecord
+	err := data.UnmarshalJSONFields([]byte(line), names, &rec)
+	if err != nil || rec.When != 1772600000123 || string(rec.Data) != "hello" || rec.ContentType != "text/plain" {
+		t.Errorf("read back %+v, %v", rec, err)
+	}
+}
+
+func TestReservedMethods(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", Methods: []string{"post", "trace"}}, "TRACE can't store")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", MethodActions: map[string]string{"connect": actionStore}}, "CONNECT can't have an action")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, Methods: []string{"POST", "PUT"}}},
+	})
+	for _, tc := range []struct {
+		method, target string
+		status         int
+	}{
+		// with the secret, and for no unit at all
+		{"TRACE", "/a/sa", 405},
+		{"TRACE", "/nowhere", 405},
+		{"CONNECT", "/a/sa", 405},
+		// preflight has no credentials
+		{"OPTIONS", "/a", 204},
+		{"GET", "/a/sa", 405},
+		{"PUT", "/a/sa", 200},
+	} {
+		out := serve(rs, testRequest(tc.method, tc.target, "text/plain", []byte(tc.method)))
+		if out.Code != tc.status {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.target, out.Code, tc.status)
+		}
+		if tc.method == "OPTIONS" && out.Header().Get("Allow") != "POST, PUT, OPTIONS" {
+			t.Errorf("OPTIONS Allow %q", out.Header().Get("Allow"))
+		}
+	}
+	rs.units()["a"].retire()
+	// only the PUT was stored
+	if recs := readRecords(t, path); len(recs) != 1 || string(recs[0].Data) != "PUT" {
+		t.Errorf("stored %+v", recs)
+	}
+}
+
+func TestMaxPathLen(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	rs.maxPathLen = 64
+	wantStatus(t, post(rs, "/a/sa/"+strings.Repeat("x", 58), "fits"), 200)
+	// rejected before any unit or secret is looked at
+	wantStatus(t, post(rs, "/a/sa/"+strings.Repeat("x", 59), "too long"), 414)
+	wantStatus(t, post(rs, "/"+strings.Repeat("a/", 100000), "many parts"), 414)
+	rs.maxPathLen = 0
+	wantStatus(t, post(rs, "/a/sa/"+strings.Repeat("x", 5000), "no limit"), 200)
+}
+
+func TestTags(t *testing.T) {
+	dir := t.TempDir()
+	tags := map[string]string{"site": "nyc", "rack": "4"}
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"t": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "st", AppendPath: filepath.Join(dir, "t.cbor"), Tags: tags}},
+		"n": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sn", AppendPath: filepath.Join(dir, "n.cbor")}},
+	})
+	for _, target := range []string{"/t/st", "/t/st", "/n/sn"} {
+		wantStatus(t, post(rs, target, "x"), 200)
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	recs := readRecords(t, filepath.Join(dir, "t.cbor"))
+	if len(recs) != 2 || !reflect.DeepEqual(recs[0].Tags, tags) || !reflect.DeepEqual(recs[1].Tags, tags) {
+		t.Errorf("t stored %+v", recs)
+	}
+	if recs := readRecords(t, filepath.Join(dir, "n.cbor")); len(recs) != 1 || recs[0].Tags != nil {
+		t.Errorf("n stored %+v", recs)
+	}
+	if blob := readFile(t, filepath.Join(dir, "n.cbor")); strings.Contains(blob, "tags") {
+		t.Errorf("empty tags encoded: %q", blob)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), RateLimit: 0.5, RateBurst: 2}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", AppendPath: filepath.Join(dir, "b.cbor")}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	// failed auth doesn't use up the rate
+	for i := 0; i < 5; i++ {
+		wantStatus(t, post(rs, "/a/wrong", "x"), 403)
+	}
+	wantStatus(t, post(rs, "/a/sa", "1"), 200)
+	wantStatus(t, post(rs, "/a/sa", "2"), 200)
+	out := post(rs, "/a/sa", "3")
+	wantStatus(t, out, 429)
+	if got := out.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After %q, want 2", got)
+	}
+	// other units have their own rate
+	wantStatus(t, post(rs, "/b/sb", "other"), 200)
+	// a refused request doesn't use up the rate either
+	when = when.Add(2 * time.Second)
+	wantStatus(t, post(rs, "/a/sa", "4"), 200)
+	wantStatus(t, post(rs, "/a/sa", "5"), 429)
+	rs.configs["a"].retire()
+	if n := len(readRecords(t, filepath.Join(dir, "a.cbor"))); n != 3 {
+		t.Fatalf("stored %d records, want 3", n)
+	}
+}
+
+func TestDefaultUnit(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "cfg.json")
+	err := os.WriteFile(cfgPath, []byte(`{
+  "": {"secret": "sd", "append": "`+filepath.Join(dir, "d.cbor")+`"},
+  "x": {"secret": "sx", "append": "`+filepath.Join(dir, "x.cbor")+`"}
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "" in a config file is the default unit
+	configs, err := readConfigFile(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, some := configs[""]; some {
+		t.Fatal(`"" kept as a unit name`)
+	}
+	rs := newTestServer(t, configs)
+	for _, name := range []string{"", defaultUnitName} {
+		if _, some := rs.lookupUnit(name); some {
+			t.Errorf("lookupUnit(%q) found the default unit", name)
+		}
+	}
+	for _, tc := range []struct {
+		target string
+		status int
+	}{
+		{"/sd", 200},
+		{"//sd", 200},
+		{"///sd//", 200},
+		{"/sd?d=", 200},
+		// naming it doesn't select it, but nothing else is named
+		{"/" + defaultUnitName + "/sd", 200},
+		{"/x/sx", 200},
+		// a named unit doesn't fall back to the default's secret
+		{"/x/sd", 403},
+		{"//x//sx", 200},
+	} {
+		if out := post(rs, tc.target, tc.target); out.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.target, out.Code, tc.status)
+		}
+	}
+	// with no secret or name, "/" and "//" go to the default unit and are refused
+	wantStatus(t, post(rs, "/", "x"), 403)
+	wantStatus(t, post(rs, "//", "x"), 403)
+	request := testRequest("POST", "//", "text/plain", []byte("token"))
+	request.Header.Set("X-Receiver-Token", "sd")
+	wantStatus(t, serve(rs, request), 200)
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	if n := len(readRecords(t, filepath.Join(dir, "d.cbor"))); n != 6 {
+		t.Errorf("default unit stored %d records, want 6", n)
+	}
+	if n := len(readRecords(t, filepath.Join(dir, "x.cbor"))); n != 2 {
+		t.Errorf("x stored %d records, want 2", n)
+	}
+}
+
+func TestUnitFlagsSet(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"-addr", ":80", "-out", "/tmp/%T"}, nil},
+		// -secret and -raw with nowhere to store is the mistake main refuses
+		{[]string{"-secret", "s", "-raw"}, []string{"-raw", "-secret"}},
+		{[]string{"-public", "-max", "100", "-content-type", "text/plain", "-checksum"}, []string{"-checksum", "-content-type", "-max", "-public"}},
+		// given, even as the default
+		{[]string{"-raw=false"}, []string{"-raw"}},
+	} {
+		var ruc ReceiverUnitConfig
+		fs := flag.NewFlagSet("receiver", flag.ContinueOnError)
+		fs.String("addr", ":8777", "")
+		fs.StringVar(&ruc.Secret, "secret", "", "")
+		fs.BoolVar(&ruc.Public, "public", false, "")
+		fs.StringVar(&ruc.OutTemplate, "out", "", "")
+		fs.Int64Var(&ruc.MaxSize, "max", 10_000_000, "")
+		fs.BoolVar(&ruc.Raw, "raw", false, "")
+		fs.StringVar(&ruc.ContentType, "content-type", "", "")
+		fs.BoolVar(&ruc.WriteChecksum, "checksum", false, "")
+		err := fs.Parse(tc.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := unitFlagsSet(fs); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor.gz")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, Compress: compressGzip}},
+	})
+	// the slow record is still being written when shutdown starts
+	started := make(chan struct{})
+	rs.writeFn = func(w io.Writer, blob []byte) (int, error) {
+		if bytes.Contains(blob, []byte("slow")) {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+		}
+		return w.Write(blob)
+	}
+	server := rs.newHTTPServer("", "", false)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	url := "http://" + ln.Addr().String() + "/a/sa"
+	postStatus := func(body string) (int, error) {
+		response, err := http.Post(url, "text/plain", strings.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		response.Body.Close()
+		return response.StatusCode, nil
+	}
+	if status, err := postStatus("fast"); status != 200 {
+		t.Fatalf("status %d, err %v", status, err)
+	}
+	slow := make(chan int)
+	go func() {
+		status, _ := postStatus("slow")
+		slow <- status
+	}()
+	<-started
+	rs.shutdown(server, nil, 5*time.Second)
+	if status := <-slow; status != 200 {
+		t.Fatalf("in-flight request: status %d", status)
+	}
+	if _, err := postStatus("after"); err == nil {
+		t.Error("request accepted after shutdown")
+	}
+	// closed, so the gzip stream is complete
+	recs := readGzipRecords(t, path)
+	if len(recs) != 2 || string(recs[1].Data) != "slow" {
+		t.Fatalf("stored %d records", len(recs))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// units is the current name to unit map. A map is never changed once
+// installed, reload swaps in a new one, so callers can range over it
+// without holding the lock.
+func (rs *receiverServer) units() map[string]*ReceiverUnit {
+	rs.cl.RLock()
+	defer rs.cl.RUnlock()
+	return rs.configs
+}
+
+// defaultUnit is the unit used when a request doesn't name one
+func (rs *receiverServer) defaultUnit() (*ReceiverUnit, bool) {
+	cfg, some := rs.units()[defaultUnitName]
+	return cfg, some
+}
+
+// readConfigFile loads the units of a -cfg file, not yet sane()
+func readConfigFile(configPath string) (map[string]*ReceiverUnit, error) {
+	fin, err := os.Open(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	var configs map[string]*ReceiverUnit
+	err = json.NewDecoder(fin).Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad json, %w", configPath, err)
+	}
+	if configs == nil {
+		configs = make(map[string]*ReceiverUnit, 1)
+	}
+	if cfg, some := configs[""]; some {
+		delete(configs, "")
+		configs[defaultUnitName] = cfg
+	}
+	return configs, nil
+}
+
+// checkMaxUnits refuses more units than -max-units, 0 for no limit
+func checkMaxUnits(configs map[string]*ReceiverUnit, maxUnits int) error {
+	if maxUnits > 0 && len(configs) > maxUnits {
+		return fmt.Errorf("%d units configured, more than -max-units %d", len(configs), maxUnits)
+	}
+	return nil
+}
+
+// sameConfig compares the settings of two units that have been sane()
+func sameConfig(a, b *ReceiverUnitConfig) bool {
+	ab, aerr := json.Marshal(a)
+	bb, berr := json.Marshal(b)
+	return aerr == nil && berr == nil && bytes.Equal(ab, bb)
+}
+
+// reloadOnHUP calls reload on each SIGHUP until stop is called
+func (rs *receiverServer) reloadOnHUP(configPath string, flagUnit *ReceiverUnit, maxUnits int) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("SIGHUP, reloading", "cfg", configPath)
+			rs.reload(configPath, flagUnit, maxUnits)
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(hup)
+	}
+}
+
+// reload re-reads configPath on SIGHUP and swaps in the new units.
+// Units whose settings didn't change are kept as they are, open files
+// and all. Removed and changed units are retired. On any error the
+// running config stays. The gRPC max message size is not updated.
+func (rs *receiverServer) reload(configPath string, flagUnit *ReceiverUnit, maxUnits int) {
+	next, err := readConfigFile(configPath)
+	if err != nil {
+		slog.Error("reload", "err", err)
+		return
+	}
+	for name, cfg := range next {
+		err = cfg.sane()
+		if err != nil {
+			slog.Error("reload", "cfg", name, "err", err)
+			return
+		}
+	}
+	if flagUnit != nil {
+		next[defaultUnitName] = flagUnit
+	}
+	err = checkMaxUnits(next, maxUnits)
+	if err == nil {
+		err = checkSharedAppendPaths(next)
+	}
+	if err == nil {
+		err = checkSharedSecrets(next)
+	}
+	if err != nil {
+		slog.Error("reload", "err", err)
+		return
+	}
+
+	rs.cl.Lock()
+	prev := rs.configs
+	var added, removed, changed []string
+	var retire []*ReceiverUnit
+	for name, cfg := range next {
+		old, some := prev[name]
+		if some && (old == cfg || sameConfig(&old.ReceiverUnitConfig, &cfg.ReceiverUnitConfig)) {
+			next[name] = old
+			continue
+		}
+		cfg.setup(rs, name)
+		if some {
+			changed = append(changed, name)
+			retire = append(retire, old)
+		} else {
+			added = append(added, name)
+		}
+	}
+	for name, old := range prev {
+		if _, some := next[name]; !some {
+			removed = append(removed, name)
+			retire = append(retire, old)
+		}
+	}
+	rs.configs = next
+	rs.cl.Unlock()
+
+	// requests already holding a retired unit get 503 from it
+	for _, old := range retire {
+		old.retire()
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	slog.Info("reload", "units", len(next), "added", added, "removed", removed, "changed", changed)
+}
+
+// retire stops a unit that a reload replaced or removed, closing its files
+func (ru *ReceiverUnit) retire() {
+	ru.paused.Store(true)
+	for _, stripe := range ru.stripes {
+		stripe.retire()
+	}
+	ru.l.Lock()
+	defer ru.l.Unlock()
+	if ru.retired {
+		return
+	}
+	ru.retired = true
+	ru.sink.Close()
+	if ru.tlout != nil {
+		ru.tlout.Close()
+		ru.tlout = nil
+	}
+	close(ru.done)
+}
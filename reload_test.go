@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a -cfg file
+func writeConfig(t *testing.T, path, text string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte(text), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxUnits(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "cfg.json")
+	writeConfig(t, cfgPath, `{
+  "a": {"secret": "sa", "append": "`+filepath.Join(dir, "a.cbor")+`"},
+  "b": {"secret": "sb", "append": "`+filepath.Join(dir, "b.cbor")+`"},
+  "c": {"secret": "sc", "append": "`+filepath.Join(dir, "c.cbor")+`"}
+}`)
+	configs, err := readConfigFile(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkMaxUnits(configs, 2)
+	if err == nil || !strings.Contains(err.Error(), "more than -max-units 2") {
+		t.Fatalf("3 units, max 2: %v", err)
+	}
+	for _, maxUnits := range []int{0, 3} {
+		if err := checkMaxUnits(configs, maxUnits); err != nil {
+			t.Errorf("max %d: %s", maxUnits, err)
+		}
+	}
+
+	// a reload past the limit keeps the running units
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	rs.reload(cfgPath, nil, 2)
+	if n := len(rs.units()); n != 1 {
+		t.Fatalf("%d units after refused reload", n)
+	}
+	rs.reload(cfgPath, nil, 3)
+	if n := len(rs.units()); n != 3 {
+		t.Fatalf("%d units after reload", n)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "cfg.json")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"keep":   {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sk", AppendPath: filepath.Join(dir, "keep.cbor")}},
+		"change": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sc", AppendPath: filepath.Join(dir, "change.cbor")}},
+		"remove": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", AppendPath: filepath.Join(dir, "remove.cbor")}},
+	})
+	before := rs.units()
+	for _, target := range []string{"/keep/sk", "/change/sc", "/remove/sr"} {
+		wantStatus(t, post(rs, target, "before"), 200)
+	}
+
+	// a config that doesn't pass sane() changes nothing
+	writeConfig(t, cfgPath, `{"bad": {"append": "`+filepath.Join(dir, "bad.cbor")+`"}}`)
+	rs.reload(cfgPath, nil, 0)
+	if !reflect.DeepEqual(rs.units(), before) {
+		t.Fatalf("bad config replaced units: %v", rs.units())
+	}
+
+	writeConfig(t, cfgPath, `{
+  "keep": {"secret": "sk", "append": "`+filepath.Join(dir, "keep.cbor")+`"},
+  "change": {"secret": "sc2", "append": "`+filepath.Join(dir, "change.cbor")+`"},
+  "add": {"secret": "sa", "append": "`+filepath.Join(dir, "add.cbor")+`"}
+}`)
+	rs.reload(cfgPath, nil, 0)
+	after := rs.units()
+	if after["keep"] != before["keep"] || before["keep"].retired {
+		t.Error("unchanged unit was replaced")
+	}
+	if after["change"] == before["change"] || !before["change"].retired {
+		t.Error("changed unit was kept")
+	}
+	if _, some := after["remove"]; some || !before["remove"].retired {
+		t.Error("removed unit was kept")
+	}
+	wantStatus(t, post(rs, "/add/sa", "after"), 200)
+	wantStatus(t, post(rs, "/keep/sk", "after"), 200)
+	wantStatus(t, post(rs, "/change/sc", "after"), 403)
+	wantStatus(t, post(rs, "/change/sc2", "after"), 200)
+	wantStatus(t, post(rs, "/remove/sr", "after"), 404)
+
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	// the kept unit's file stayed open across the reload
+	for name, want := range map[string]int{"keep": 2, "change": 2, "remove": 1, "add": 1} {
+		if n := len(readRecords(t, filepath.Join(dir, name+".cbor"))); n != want {
+			t.Errorf("%s: %d records, want %d", name, n, want)
+		}
+	}
+}
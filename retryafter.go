@@ -0,0 +1,22 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// setRetryAfter sets the Retry-After header for a 429 or 503, wait
+// rounded up to whole seconds and at least RetryAfterSeconds.
+// With neither there is no header.
+func (ruc *ReceiverUnitConfig) setRetryAfter(out http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < ruc.RetryAfterSeconds {
+		seconds = ruc.RetryAfterSeconds
+	}
+	if seconds <= 0 {
+		return
+	}
+	out.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", RetryAfterSeconds: -1}, "retry-after-seconds")
+
+	for _, tc := range []struct {
+		wait  time.Duration
+		least int
+		want  string
+	}{
+		{0, 0, ""},
+		{1500 * time.Millisecond, 0, "2"},
+		{2 * time.Second, 0, "2"},
+		{0, 30, "30"},
+		{1500 * time.Millisecond, 30, "30"},
+		{time.Minute, 30, "60"},
+	} {
+		out := httptest.NewRecorder()
+		ruc := ReceiverUnitConfig{RetryAfterSeconds: tc.least}
+		ruc.setRetryAfter(out, tc.wait)
+		if got := out.Header().Get("Retry-After"); got != tc.want {
+			t.Errorf("wait %s, least %d: Retry-After %q, want %q", tc.wait, tc.least, got, tc.want)
+		}
+	}
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"r": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", AppendPath: filepath.Join(dir, "r.cbor"), RateLimit: 1, RateBurst: 1, RetryAfterSeconds: 10}},
+		"p": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sp", AppendPath: filepath.Join(dir, "p.cbor"), RetryAfterSeconds: 7}},
+		"q": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sq", AppendPath: filepath.Join(dir, "q.cbor")}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	wantStatus(t, post(rs, "/r/sr", "1"), 200)
+	// the limiter's wait is 1s, the configured least is longer
+	out := post(rs, "/r/sr", "2")
+	wantStatus(t, out, 429)
+	if got := out.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("rate limited: Retry-After %q, want 10", got)
+	}
+	rs.units()["p"].paused.Store(true)
+	rs.units()["q"].paused.Store(true)
+	for target, want := range map[string]string{"/p/sp": "7", "/q/sq": ""} {
+		out := post(rs, target, "x")
+		wantStatus(t, out, 503)
+		if got := out.Header().Get("Retry-After"); got != want {
+			t.Errorf("paused %s: Retry-After %q, want %q", target, got, want)
+		}
+	}
+}
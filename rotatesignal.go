@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultRotateSignalInterval = 10 * time.Second
+
+func isSignalURL(signal string) bool {
+	return strings.HasPrefix(signal, "http://") || strings.HasPrefix(signal, "https://")
+}
+
+// checkRotateSignal reports whether downstream is ready for a new file.
+// A sentinel file is removed once seen so that each one rotates once.
+func (ru *ReceiverUnit) checkRotateSignal(client *http.Client) (bool, error) {
+	if isSignalURL(ru.RotateOnSignal) {
+		resp, err := client.Get(ru.RotateOnSignal)
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK, nil
+	}
+	err := os.Remove(ru.RotateOnSignal)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// watchRotateSignal polls RotateOnSignal and sets rotateReady for
+// storeRecord, which rotates on the next write
+func (ru *ReceiverUnit) watchRotateSignal() {
+	interval := time.Duration(ru.RotateSignalInterval)
+	if interval == 0 {
+		interval = defaultRotateSignalInterval
+	}
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ru.done:
+			return
+		}
+		if ru.rotateReady.Load() {
+			// not consumed yet, don't eat another sentinel
+			continue
+		}
+		ready, err := ru.checkRotateSignal(client)
+		if err != nil {
+			slog.Debug("rotate signal", "cfg", ru.name, "signal", ru.RotateOnSignal, "err", err)
+			continue
+		}
+		if ready {
+			slog.Debug("rotate signal ready", "cfg", ru.name)
+			ru.rotateReady.Store(true)
+		}
+	}
+}
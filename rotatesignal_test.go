@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond for up to a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRotateOnSentinel(t *testing.T) {
+	dir := t.TempDir()
+	sentinel := filepath.Join(dir, "ready")
+	apath := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: apath, RotateOnSignal: sentinel, RotateSignalInterval: Duration(10 * time.Millisecond)}},
+	})
+	cfg := rs.configs["a"]
+	wantStatus(t, post(rs, "/a/sa", "1"), 200)
+	time.Sleep(30 * time.Millisecond)
+	// no signal, no rotation however long it has been
+	wantStatus(t, post(rs, "/a/sa", "2"), 200)
+
+	err := os.WriteFile(sentinel, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "ready signal", cfg.rotateReady.Load)
+	if _, err := os.Stat(sentinel); !os.IsNotExist(err) {
+		t.Errorf("sentinel not removed: %v", err)
+	}
+	wantStatus(t, post(rs, "/a/sa", "3"), 200)
+	wantStatus(t, post(rs, "/a/sa", "4"), 200)
+	cfg.retire()
+
+	if n := len(readRecords(t, apath)); n != 2 {
+		t.Errorf("first file has %d records", n)
+	}
+	if n := len(readRecords(t, rotatedPath(apath, 1))); n != 2 {
+		t.Errorf("second file has %d records", n)
+	}
+}
+
+func TestRotateOnURL(t *testing.T) {
+	var ready atomic.Bool
+	downstream := httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, request *http.Request) {
+		if !ready.Load() {
+			http.Error(out, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		out.WriteHeader(http.StatusOK)
+	}))
+	defer downstream.Close()
+	ru := &ReceiverUnit{ReceiverUnitConfig: ReceiverUnitConfig{RotateOnSignal: downstream.URL}}
+	ok, err := ru.checkRotateSignal(downstream.Client())
+	if ok || err != nil {
+		t.Fatalf("busy downstream: %v, %v", ok, err)
+	}
+	ready.Store(true)
+	ok, err = ru.checkRotateSignal(downstream.Client())
+	if !ok || err != nil {
+		t.Fatalf("ready downstream: %v, %v", ok, err)
+	}
+	downstream.Close()
+	if ok, err := ru.checkRotateSignal(downstream.Client()); ok || err == nil {
+		t.Fatalf("downstream gone: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// s3Scheme starts an OutTemplate or AppendPath that is stored in S3,
+// "s3://bucket/prefix/%T.cbor"
+const s3Scheme = "s3://"
+
+// s3Timeout bounds one S3 request
+const s3Timeout = 2 * time.Minute
+
+func isS3Path(p string) bool {
+	return strings.HasPrefix(p, s3Scheme)
+}
+
+// splitS3Path splits "s3://bucket/key" into bucket and key
+func splitS3Path(p string) (bucket, key string) {
+	bucket, key, _ = strings.Cut(strings.TrimPrefix(p, s3Scheme), "/")
+	return bucket, key
+}
+
+// s3Dir is path.Dir for an s3:// path, which filepath.Dir would mangle
+func s3Dir(p string) string {
+	return s3Scheme + path.Dir(strings.TrimPrefix(p, s3Scheme))
+}
+
+// usesS3 is true if the unit stores to S3
+func (ruc *ReceiverUnitConfig) usesS3() bool {
+	return isS3Path(ruc.OutTemplate) || isS3Path(ruc.AppendPath)
+}
+
+// newS3Client makes a client from the standard AWS environment and
+// config files. AWS_ENDPOINT_URL_S3 points it at another S3-compatible
+// service, which usually also wants pathStyle.
+func newS3Client(pathStyle bool) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = pathStyle
+	}), nil
+}
+
+// s3Object is an outFile that collects the records of one object,
+// which is uploaded on Close. For an append path that is when the file
+// would rotate, or on shutdown; until then the records are only in memory.
+type s3Object struct {
+	client *s3.Client
+	bucket string
+	key    string
+
+	// noClobber fails the upload with errFileExists if the object exists
+	noClobber bool
+
+	buf bytes.Buffer
+}
+
+func (ru *ReceiverUnit) newS3Object(p string, noClobber bool) *s3Object {
+	bucket, key := splitS3Path(p)
+	return &s3Object{client: ru.s3client, bucket: bucket, key: key, noClobber: noClobber}
+}
+
+func (obj *s3Object) Write(blob []byte) error {
+	obj.buf.Write(blob)
+	return nil
+}
+
+func (obj *s3Object) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	in := &s3.PutObjectInput{
+		Bucket:        aws.String(obj.bucket),
+		Key:           aws.String(obj.key),
+		Body:          bytes.NewReader(obj.buf.Bytes()),
+		ContentLength: aws.Int64(int64(obj.buf.Len())),
+	}
+	if obj.noClobber {
+		in.IfNoneMatch = aws.String("*")
+	}
+	_, err := obj.client.PutObject(ctx, in)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+		return errFileExists
+	}
+	if err != nil {
+		return fmt.Errorf("upload %d bytes to s3://%s/%s: %w", obj.buf.Len(), obj.bucket, obj.key, err)
+	}
+	return nil
+}
+
+// s3Exists checks whether an object is already at p
+func (ru *ReceiverUnit) s3Exists(p string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	bucket, key := splitS3Path(p)
+	_, err := ru.s3client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// s3Conflicts names a setting that needs a local file, which an S3
+// unit doesn't have, or "" if there is none
+func (ruc *ReceiverUnitConfig) s3Conflicts() string {
+	switch {
+	case ruc.Fsync || ruc.FsyncInterval > 0:
+		return "fsync"
+	case ruc.Compress != "":
+		return "compress"
+	case ruc.RotateOnSignal != "":
+		return "rotate-on-signal"
+	case ruc.Stripes > 0:
+		return "stripes"
+	case ruc.MaintainLatestSymlink:
+		return "latest-symlink"
+	case ruc.WriteChecksum:
+		return "write-checksum"
+	case ruc.RawMeta || ruc.RawContentType != "":
+		return "raw-meta"
+	case ruc.Preallocate:
+		return "preallocate"
+	case ruc.SpillThreshold > 0:
+		return "spill-threshold"
+	case ruc.FallbackRaw:
+		return "fallback-raw"
+	case ruc.CollisionStrategy == collisionSuffix:
+		return "collision-strategy suffix"
+	}
+	return ""
+}
+
+// freeS3Path is the first rotatedPath from seq on with no object yet,
+// so that an append object from before a restart isn't replaced
+func (ru *ReceiverUnit) freeS3Path(base string, seq int) (string, int, error) {
+	for ; seq <= maxCollisionSuffix; seq++ {
+		p := rotatedPath(base, seq)
+		found, err := ru.s3Exists(p)
+		if err != nil {
+			return "", 0, err
+		}
+		if !found {
+			return p, seq, nil
+		}
+	}
+	return "", 0, errFileExists
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockS3 is enough of S3 for HeadBucket, HeadObject and PutObject,
+// path style
+type mockS3 struct {
+	l       sync.Mutex
+	objects map[string][]byte
+	// buckets HeadBucket finds, "/bucket"
+	buckets map[string]bool
+	// denyPuts answers PutObject with AccessDenied
+	denyPuts bool
+}
+
+func (m *mockS3) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	_, found := m.objects[request.URL.Path]
+	if strings.Count(strings.TrimSuffix(request.URL.Path, "/"), "/") == 1 {
+		found = m.buckets[strings.TrimSuffix(request.URL.Path, "/")]
+	}
+	switch request.Method {
+	case "HEAD":
+		if !found {
+			out.WriteHeader(404)
+		}
+	case "PUT":
+		if m.denyPuts {
+			out.Header().Set("Content-Type", "application/xml")
+			out.WriteHeader(403)
+			io.WriteString(out, `<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+			return
+		}
+		if found && request.Header.Get("If-None-Match") == "*" {
+			out.Header().Set("Content-Type", "application/xml")
+			out.WriteHeader(412)
+			io.WriteString(out, `<Error><Code>PreconditionFailed</Code><Message>exists</Message></Error>`)
+			return
+		}
+		blob, err := io.ReadAll(request.Body)
+		if err != nil {
+			out.WriteHeader(500)
+			return
+		}
+		m.objects[request.URL.Path] = blob
+	default:
+		out.WriteHeader(405)
+	}
+}
+
+// keys lists the objects, "/bucket/key"
+func (m *mockS3) keys() []string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	var keys []string
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *mockS3) get(key string) []byte {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.objects[key]
+}
+
+// newMockS3 points the AWS environment at a mock S3 for this test
+func newMockS3(t *testing.T) *mockS3 {
+	m := &mockS3{objects: make(map[string][]byte), buckets: make(map[string]bool)}
+	server := httptest.NewServer(m)
+	t.Cleanup(server.Close)
+	dir := t.TempDir()
+	for k, v := range map[string]string{
+		"AWS_ENDPOINT_URL_S3":              server.URL,
+		"AWS_REGION":                       "us-east-1",
+		"AWS_ACCESS_KEY_ID":                "test",
+		"AWS_SECRET_ACCESS_KEY":            "test",
+		"AWS_CONFIG_FILE":                  filepath.Join(dir, "config"),
+		"AWS_SHARED_CREDENTIALS_FILE":      filepath.Join(dir, "credentials"),
+		"AWS_EC2_METADATA_DISABLED":        "true",
+		"AWS_REQUEST_CHECKSUM_CALCULATION": "when_required",
+	} {
+		t.Setenv(k, v)
+	}
+	return m
+}
+
+func TestS3Sink(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "s3://bucket-only"}, "needs a bucket and key")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "s3://b/a.cbor", Compress: compressGzip}, "s3 output can't be used with compress")
+	// held in memory until uploaded, so something has to rotate it
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "s3://b/a.cbor"}, "s3 append needs")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "s3://b/a.cbor", AppendMod: 3600}, "s3 append needs")
+
+	m := newMockS3(t)
+	// an object from before a restart is not replaced
+	m.objects["/b/a/a.cbor"] = []byte("old")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: "s3://b/a/a.cbor", MaxFileBytes: 150, S3PathStyle: true}},
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: "s3://b/o/%Y.bin", Raw: true, CollisionStrategy: collisionReject, S3PathStyle: true}},
+	})
+	rs.now = func() time.Time { return time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC) }
+
+	wantStatus(t, post(rs, "/a/sa", "one"+strings.Repeat(".", 100)), 200)
+	// records are held until the object rotates
+	if keys := m.keys(); !reflect.DeepEqual(keys, []string{"/b/a/a.cbor"}) {
+		t.Fatalf("objects before rotation %v", keys)
+	}
+	wantStatus(t, post(rs, "/a/sa", "two"+strings.Repeat(".", 100)), 200)
+	if keys := m.keys(); !reflect.DeepEqual(keys, []string{"/b/a/a.1.cbor", "/b/a/a.cbor"}) {
+		t.Fatalf("objects after rotation %v", keys)
+	}
+	rs.units()["a"].retire()
+	for key, want := range map[string]string{"/b/a/a.1.cbor": "one", "/b/a/a.2.cbor": "two"} {
+		recs := decodeRecords(t, strings.NewReader(string(m.get(key))))
+		if len(recs) != 1 || !strings.HasPrefix(string(recs[0].Data), want) {
+			t.Errorf("%s: %+v", key, recs)
+		}
+	}
+	if got := string(m.get("/b/a/a.cbor")); got != "old" {
+		t.Errorf("old object replaced with %q", got)
+	}
+
+	// an out object is put whole, once
+	wantStatus(t, post(rs, "/o/so", "first"), 200)
+	wantStatus(t, post(rs, "/o/so", "second"), 409)
+	if got := string(m.get("/b/o/2026.bin")); got != "first" {
+		t.Errorf("out object %q", got)
+	}
+}
+
+func TestS3AppendUploadFails(t *testing.T) {
+	m := newMockS3(t)
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: "s3://b/a-%T.cbor", AppendMod: 3600, S3PathStyle: true}},
+	})
+	wantStatus(t, post(rs, "/a/sa", "held"), 200)
+	m.l.Lock()
+	m.denyPuts = true
+	m.l.Unlock()
+	buf := captureLog(t)
+	rs.units()["a"].retire()
+	// the records are gone, but not quietly
+	var logged struct {
+		Level string
+		Msg   string
+		Err   string
+	}
+	err := json.Unmarshal(buf.Bytes(), &logged)
+	if err != nil || logged.Level != "ERROR" || !strings.Contains(logged.Err, "upload") || !strings.Contains(logged.Err, "AccessDenied") {
+		t.Errorf("logged %s", buf)
+	}
+	if keys := m.keys(); len(keys) != 0 {
+		t.Errorf("objects %v", keys)
+	}
+}
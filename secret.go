@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// secretEqual compares in constant time for a given length.
+// An empty secret never matches.
+func secretEqual(got, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(secret)) == 1
+}
+
+// authorizationToken is the credential part of an Authorization header,
+// "Bearer {token}" or any other "{scheme} {token}", or a bare token
+func authorizationToken(request *http.Request) string {
+	auth := strings.TrimSpace(request.Header.Get("Authorization"))
+	_, token, found := strings.Cut(auth, " ")
+	if !found {
+		return auth
+	}
+	return strings.TrimSpace(token)
+}
+
+// tokenOK checks the secret in X-Receiver-Token or Authorization
+func tokenOK(request *http.Request, secret string) bool {
+	return secretEqual(request.Header.Get("X-Receiver-Token"), secret) || secretEqual(authorizationToken(request), secret)
+}
+
+// checkSharedSecrets rejects units with the same Secret or HMACSecret,
+// where a secret found in the path could authorize the wrong unit,
+// unless they are in the same SecretGroup. The secret isn't in the error.
+func checkSharedSecrets(configs map[string]*ReceiverUnit) error {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bySecret := make(map[string]string, len(configs))
+	for _, name := range names {
+		cfg := configs[name]
+		for _, secret := range []string{cfg.Secret, cfg.HMACSecret} {
+			if secret == "" {
+				continue
+			}
+			other, some := bySecret[secret]
+			if some && other != name && (cfg.SecretGroup == "" || configs[other].SecretGroup != cfg.SecretGroup) {
+				return fmt.Errorf("config[%#v] and config[%#v] have the same secret, give them the same secret-group if that is intended", other, name)
+			}
+			bySecret[secret] = name
+		}
+	}
+	return nil
+}
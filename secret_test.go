@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretEqual(t *testing.T) {
+	for _, tc := range []struct {
+		got, secret string
+		want        bool
+	}{
+		{"hunter2", "hunter2", true},
+		{"hunter", "hunter2", false},
+		{"hunter22", "hunter2", false},
+		{"", "", false},
+		{"x", "", false},
+	} {
+		if got := secretEqual(tc.got, tc.secret); got != tc.want {
+			t.Errorf("secretEqual(%q, %q) = %v", tc.got, tc.secret, got)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"u": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "a", AppendPath: filepath.Join(dir, "u.cbor")}},
+	})
+	for _, tc := range []struct {
+		name, header, value string
+		status              int
+	}{
+		{"bearer", "Authorization", "Bearer a", 200},
+		{"other scheme", "Authorization", "Token a", 200},
+		{"bare", "Authorization", "a", 200},
+		{"token header", "X-Receiver-Token", "a", 200},
+		// any header containing an "a" used to pass
+		{"substring", "Authorization", "Basic YWJj", 403},
+		{"containing", "Authorization", "Bearer abc", 403},
+		{"prefix", "X-Receiver-Token", "ab", 403},
+		{"missing", "X-Receiver-Token", "", 403},
+		{"scheme only", "Authorization", "Bearer", 403},
+	} {
+		request := testRequest("POST", "/u", "text/plain", []byte("x"))
+		if tc.value != "" {
+			request.Header.Set(tc.header, tc.value)
+		}
+		if out := serve(rs, request); out.Code != tc.status {
+			t.Errorf("%s %q: status %d, want %d", tc.name, tc.value, out.Code, tc.status)
+		}
+	}
+	// path parts are matched whole, not as substrings
+	wantStatus(t, post(rs, "/u/abc", "x"), 403)
+	wantStatus(t, post(rs, "/u/a", "x"), 200)
+}
+
+func TestSharedSecrets(t *testing.T) {
+	units := func(groupA, groupB string) map[string]*ReceiverUnit {
+		return map[string]*ReceiverUnit{
+			"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "s3kr1t", SecretGroup: groupA}},
+			"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "other", HMACSecret: "s3kr1t", SecretGroup: groupB}},
+		}
+	}
+	err := checkSharedSecrets(units("", ""))
+	if err == nil || strings.Contains(err.Error(), "s3kr1t") || !strings.Contains(err.Error(), "secret-group") {
+		t.Errorf("shared secret: %v", err)
+	}
+	if err := checkSharedSecrets(units("g", "h")); err == nil {
+		t.Error("different groups allowed")
+	}
+	if err := checkSharedSecrets(units("g", "g")); err != nil {
+		t.Errorf("same group: %s", err)
+	}
+
+	// nor can a reload bring in a shared secret
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "cfg.json")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "s3kr1t", AppendPath: filepath.Join(dir, "a.cbor")}},
+	})
+	writeConfig(t, cfgPath, `{
+  "a": {"secret": "s3kr1t", "append": "`+filepath.Join(dir, "a.cbor")+`"},
+  "b": {"secret": "s3kr1t", "append": "`+filepath.Join(dir, "b.cbor")+`"}
+}`)
+	rs.reload(cfgPath, nil, 0)
+	if n := len(rs.units()); n != 1 {
+		t.Errorf("%d units after reload with a shared secret", n)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// checkSignature verifies X-Receiver-Signature, hex HMAC-SHA256 of the
+// body keyed with HMACSecret, optionally prefixed "sha256=" as GitHub
+// webhooks send it
+func (ru *ReceiverUnit) checkSignature(request *http.Request, body []byte) bool {
+	sig := strings.TrimPrefix(request.Header.Get("X-Receiver-Signature"), "sha256=")
+	got, err := hex.DecodeString(sig)
+	if sig == "" || err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(ru.HMACSecret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// bodyAuthOK runs the auth checks that need the body: NonceAuth and
+// HMACSecret. Requests without a body check against an empty one.
+func (ru *ReceiverUnit) bodyAuthOK(request *http.Request, body []byte, now time.Time) bool {
+	if ru.HMACSecret != "" && !ru.checkSignature(request, body) {
+		return false
+	}
+	if ru.NonceAuth && !ru.checkNonceAuth(request, body, now) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// signedPost posts body to target with X-Receiver-Signature sig, none if ""
+func signedPost(rs *receiverServer, target, sig, body string) int {
+	request := testRequest("POST", target, "text/plain", []byte(body))
+	if sig != "" {
+		request.Header.Set("X-Receiver-Signature", sig)
+	}
+	return serve(rs, request).Code
+}
+
+func hmacHex(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHMACSignature(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		// signature only
+		"h": {ReceiverUnitConfig: ReceiverUnitConfig{HMACSecret: "hk", AppendPath: filepath.Join(dir, "h.cbor")}},
+		// signature and secret both required
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", HMACSecret: "hb", AppendPath: filepath.Join(dir, "b.cbor")}},
+	})
+	for _, tc := range []struct {
+		name, target, sig, body string
+		status                  int
+	}{
+		{"valid", "/h", hmacHex("hk", "one"), "one", 200},
+		{"github style", "/h", "sha256=" + hmacHex("hk", "two"), "two", 200},
+		{"tampered body", "/h", hmacHex("hk", "original"), "tampered", 403},
+		{"wrong key", "/h", hmacHex("nope", "x"), "x", 403},
+		{"missing header", "/h", "", "x", 403},
+		{"not hex", "/h", "zz", "x", 403},
+		{"both", "/b/sb", hmacHex("hb", "three"), "three", 200},
+		{"signature without secret", "/b", hmacHex("hb", "x"), "x", 403},
+		{"secret without signature", "/b/sb", "", "x", 403},
+	} {
+		if status := signedPost(rs, tc.target, tc.sig, tc.body); status != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, status, tc.status)
+		}
+	}
+	for _, cfg := range rs.units() {
+		cfg.retire()
+	}
+	if n := len(readRecords(t, filepath.Join(dir, "h.cbor"))); n != 2 {
+		t.Errorf("h stored %d records", n)
+	}
+	if recs := readRecords(t, filepath.Join(dir, "b.cbor")); len(recs) != 1 || string(recs[0].Data) != "three" {
+		t.Errorf("b stored %d records", len(recs))
+	}
+}
+
+func TestHMACBodyless(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{HMACSecret: "h", AppendPath: "a.cbor", Stream: true}, "stream needs a secret")
+	wantSaneErr(t, ReceiverUnitConfig{HMACSecret: "h", OutTemplate: "/tmp/%T", MethodActions: map[string]string{"DELETE": actionRemoveLatest}}, "remove-latest needs a secret")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", HMACSecret: "hb", OutTemplate: filepath.Join(dir, "b-%T"), Stream: true, MethodActions: map[string]string{"DELETE": actionRemoveLatest}}},
+	})
+	if status := signedPost(rs, "/b/sb", hmacHex("hb", "keep"), "keep"); status != 200 {
+		t.Fatalf("post: status %d", status)
+	}
+	// the signature of no body is the same every time, alone it is refused
+	for _, request := range []*http.Request{testRequest("DELETE", "/b", "", nil), testRequest("GET", "/b/stream", "", nil)} {
+		request.Header.Set("X-Receiver-Signature", hmacHex("hb", ""))
+		if status := serve(rs, request).Code; status != 403 {
+			t.Errorf("replayed %s %s: status %d", request.Method, request.URL.Path, status)
+		}
+	}
+	if files := listFiles(t, dir); len(files) != 1 {
+		t.Fatalf("files %v", files)
+	}
+	request := testRequest("DELETE", "/b/sb", "", nil)
+	request.Header.Set("X-Receiver-Signature", hmacHex("hb", ""))
+	wantStatus(t, serve(rs, request), 200)
+	if files := listFiles(t, dir); len(files) != 0 {
+		t.Fatalf("files %v after remove-latest", files)
+	}
+}
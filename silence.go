@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// silenceAlert is POSTed to SilenceWebhook when a unit goes quiet
+type silenceAlert struct {
+	Unit string `json:"unit"`
+	// LastWrite is unix milliseconds of the last stored record, or of
+	// startup if there hasn't been one
+	LastWrite int64  `json:"last-write"`
+	Silence   string `json:"silence"`
+}
+
+// noteWrite records that a record was stored, for MaxSilence
+func (ru *ReceiverUnit) noteWrite(now time.Time) {
+	ru.lastWrite.Store(now.UnixNano())
+}
+
+// silence is how long it has been since the last stored record
+func (ru *ReceiverUnit) silence(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, ru.lastWrite.Load()))
+}
+
+// checkSilence alerts once when the unit has been quiet longer than
+// MaxSilence, and logs when records come again. It returns the alert to
+// send, nil if there is nothing new to say.
+func (ru *ReceiverUnit) checkSilence(now time.Time) *silenceAlert {
+	silence := ru.silence(now)
+	if silence <= time.Duration(ru.MaxSilence) {
+		if ru.silent.Swap(false) {
+			slog.Info("silence over", "cfg", ru.name)
+		}
+		return nil
+	}
+	if ru.silent.Swap(true) {
+		// already said so
+		return nil
+	}
+	silence = silence.Truncate(time.Second)
+	slog.Warn("silence", "cfg", ru.name, "since", time.Unix(0, ru.lastWrite.Load()), "silence", silence)
+	return &silenceAlert{
+		Unit:      ru.name,
+		LastWrite: ru.lastWrite.Load() / int64(time.Millisecond),
+		Silence:   silence.String(),
+	}
+}
+
+// postSilenceAlert sends an alert to SilenceWebhook
+func (ru *ReceiverUnit) postSilenceAlert(client *http.Client, alert *silenceAlert) error {
+	blob, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(ru.SilenceWebhook, "application/json", bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// silenceLoop checks for MaxSilence a few times per interval
+func (ru *ReceiverUnit) silenceLoop(rs *receiverServer) {
+	interval := time.Duration(ru.MaxSilence) / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ru.done:
+			return
+		}
+		alert := ru.checkSilence(rs.clock())
+		if alert == nil || ru.SilenceWebhook == "" {
+			continue
+		}
+		err := ru.postSilenceAlert(client, alert)
+		if err != nil {
+			slog.Warn("silence webhook", "cfg", ru.name, "url", ru.SilenceWebhook, "err", err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxSilence(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", SilenceWebhook: "http://x/"}, "max-silence")
+
+	alerts := make(chan silenceAlert, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, request *http.Request) {
+		var alert silenceAlert
+		blob, _ := io.ReadAll(request.Body)
+		if json.Unmarshal(blob, &alert) != nil {
+			out.WriteHeader(400)
+			return
+		}
+		alerts <- alert
+	}))
+	defer hook.Close()
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), MaxSilence: Duration(time.Minute), SilenceWebhook: hook.URL}},
+	})
+	handler := rs.newHTTPServer("", "adm", false).Handler
+	cfg := rs.units()["a"]
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	// as setup() does, on the injected clock
+	cfg.noteWrite(when)
+
+	when = when.Add(50 * time.Second)
+	if alert := cfg.checkSilence(when); alert != nil {
+		t.Fatalf("alert before MaxSilence: %+v", alert)
+	}
+	wantStatus(t, post(rs, "/a/sa", "x"), 200)
+	lastWrite := when
+	when = when.Add(90 * time.Second)
+	alert := cfg.checkSilence(when)
+	if alert == nil || alert.Unit != "a" || alert.Silence != "1m30s" || alert.LastWrite != lastWrite.UnixMilli() {
+		t.Fatalf("alert %+v", alert)
+	}
+	// once per silence
+	if again := cfg.checkSilence(when.Add(time.Minute)); again != nil {
+		t.Errorf("alerted again: %+v", again)
+	}
+	if !unitStatuses(t, handler)["a"].Silent {
+		t.Error("/status doesn't show silent")
+	}
+	err := cfg.postSilenceAlert(hook.Client(), alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-alerts; got != *alert {
+		t.Errorf("webhook got %+v", got)
+	}
+
+	// records again end it
+	wantStatus(t, post(rs, "/a/sa", "y"), 200)
+	if alert := cfg.checkSilence(when); alert != nil {
+		t.Errorf("alert after a write: %+v", alert)
+	}
+	if unitStatuses(t, handler)["a"].Silent {
+		t.Error("/status still silent")
+	}
+}
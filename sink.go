@@ -0,0 +1,281 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bolson.org/receiver/data"
+)
+
+// Sink stores a unit's encoded records, so storeRecord doesn't need to
+// know where they go. Store and Close are called with ru.l held.
+type Sink interface {
+	// Store writes one record, already encoded to blob. rec and
+	// format are for anything written alongside it, e.g. raw meta.
+	Store(blob []byte, rec *ReceiverRecord, format string, now time.Time, vars *pathVars) error
+
+	// Close finishes any open output, e.g. on shutdown
+	Close()
+}
+
+// newSink is the Sink for the unit's AppendPath or OutTemplate
+func (ru *ReceiverUnit) newSink(rs *receiverServer) Sink {
+	if ru.AppendPath != "" {
+		return &appendFileSink{rs: rs, ru: ru}
+	}
+	return &oneShotFileSink{rs: rs, ru: ru}
+}
+
+// outFile is one open output: a local file, or an S3 object being
+// collected to upload on Close
+type outFile interface {
+	Write(blob []byte) error
+	Close() error
+}
+
+// localFile is an outFile over a local file
+type localFile struct {
+	rs *receiverServer
+	w  io.WriteCloser
+}
+
+func (lf *localFile) Write(blob []byte) error {
+	return lf.rs.write(lf.w, blob)
+}
+
+// Sync fsyncs the file if it can be
+func (lf *localFile) Sync() error {
+	if f, ok := lf.w.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+func (lf *localFile) Close() error {
+	return lf.w.Close()
+}
+
+// appendFileSink appends records to AppendPath, rotating as configured.
+// The open file state is kept in the ReceiverUnit, see ReceiverUnit.l.
+type appendFileSink struct {
+	rs *receiverServer
+	ru *ReceiverUnit
+}
+
+func (s *appendFileSink) Store(blob []byte, rec *ReceiverRecord, format string, now time.Time, vars *pathVars) error {
+	ru := s.ru
+	if ru.BlobPrefix != "" || ru.BlobSuffix != "" {
+		framed := make([]byte, 0, len(ru.BlobPrefix)+len(blob)+len(ru.BlobSuffix))
+		framed = append(framed, ru.BlobPrefix...)
+		framed = append(framed, blob...)
+		blob = append(framed, ru.BlobSuffix...)
+	}
+	if ru.AppendPath == "-" {
+		err := s.rs.write(os.Stdout, blob)
+		if err != nil {
+			slog.Debug("write", "path", ru.AppendPath, "err", err)
+		}
+		return err
+	}
+	err := s.open(int64(len(blob)), now, vars)
+	if err != nil {
+		slog.Debug("open", "path", ru.fpath, "err", err)
+		return err
+	}
+	err = ru.fout.Write(blob)
+	if err != nil {
+		slog.Debug("write", "path", ru.fpath, "err", err)
+		return err
+	}
+	ru.fbytes += int64(len(blob))
+	ru.unsynced = true
+	if ru.Fsync && ru.FsyncInterval == 0 {
+		err = ru.syncAppend()
+		if err != nil {
+			slog.Debug("fsync", "path", ru.fpath, "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// open makes ru.fout the file for a record of size bytes at now,
+// rotating to a new one if it is time to
+func (s *appendFileSink) open(size int64, now time.Time, vars *pathVars) error {
+	ru := s.ru
+	base := ru.GenerateAppendPath(now, vars)
+	seq := ru.fseq
+	if ru.RotateOnSignal != "" {
+		// keep the open file until downstream is ready for a new one
+		if ru.fout == nil {
+			if base != ru.fbase {
+				seq = 0
+			}
+		} else if ru.rotateReady.Swap(false) {
+			if base == ru.fbase {
+				seq++
+			} else {
+				seq = 0
+			}
+		} else {
+			base = ru.fbase
+		}
+	} else if base != ru.fbase {
+		seq = 0
+	} else if ru.MaxFileAge > 0 && now.Sub(ru.fopened) >= time.Duration(ru.MaxFileAge) {
+		seq++
+	} else if ru.MaxFileBytes > 0 && ru.fout != nil && ru.fbytes > 0 && ru.fbytes+size > ru.MaxFileBytes {
+		// rotate before the write, a record is never split
+		seq++
+	}
+	nfpath := rotatedPath(base, seq)
+	if nfpath == ru.fpath && ru.fout != nil {
+		return nil
+	}
+	ru.closeAppend()
+	if isS3Path(nfpath) {
+		var err error
+		nfpath, seq, err = ru.freeS3Path(base, seq)
+		if err != nil {
+			return err
+		}
+		obj := ru.newS3Object(nfpath, false)
+		if ru.FileHeader {
+			err = ru.writeFileHeader(&obj.buf, nil, now)
+			if err != nil {
+				return err
+			}
+		}
+		ru.setAppendFile(obj, nfpath, base, seq, now, int64(obj.buf.Len()))
+		return nil
+	}
+	f, err := s.rs.openFileDir(nfpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	ru.chownFile(f)
+	var w io.WriteCloser = f
+	if ru.Compress == compressGzip {
+		w = newGzipFile(f)
+	}
+	if ru.FileHeader {
+		err = ru.writeFileHeader(w, f, now)
+		if err != nil {
+			w.Close()
+			return err
+		}
+	}
+	// a reopened file may already have data
+	var size0 int64
+	if fi, serr := f.Stat(); serr == nil {
+		size0 = fi.Size()
+	}
+	ru.setAppendFile(&localFile{rs: s.rs, w: w}, nfpath, base, seq, now, size0)
+	if ru.MaintainLatestSymlink {
+		lerr := updateLatestSymlink(nfpath)
+		if lerr != nil {
+			slog.Warn("latest symlink", "path", nfpath, "err", lerr)
+		}
+	}
+	return nil
+}
+
+// setAppendFile records a newly opened append file. Caller holds ru.l.
+func (ru *ReceiverUnit) setAppendFile(fout outFile, fpath, base string, seq int, now time.Time, size int64) {
+	ru.fout = fout
+	ru.fpath = fpath
+	ru.fbase = base
+	ru.fseq = seq
+	ru.fopened = now
+	ru.fbytes = size
+}
+
+func (s *appendFileSink) Close() {
+	s.ru.closeAppend()
+}
+
+// oneShotFileSink writes each record to its own OutTemplate file
+type oneShotFileSink struct {
+	rs *receiverServer
+	ru *ReceiverUnit
+}
+
+func (s *oneShotFileSink) Store(blob []byte, rec *ReceiverRecord, format string, now time.Time, vars *pathVars) error {
+	ru := s.ru
+	fpath := formatTemplateString(ru.OutTemplate, now, ru.outTimeLayout(), vars)
+	if isS3Path(fpath) {
+		// uploaded whole, so there is never a partial object
+		obj := ru.newS3Object(fpath, ru.CollisionStrategy == collisionReject)
+		obj.Write(blob)
+		err := obj.Close()
+		if err != nil {
+			slog.Debug("s3 put", "path", fpath, "err", err)
+		}
+		return err
+	}
+	// write to a temp file and rename it into place so that
+	// watchers of the output directory never see a partial file
+	fpath, err := ru.outPath(fpath)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := s.rs.createTempDir(filepath.Dir(fpath), filepath.Base(fpath)+".*"+tempSuffix)
+	if err == nil {
+		ru.chownFile(tmpFile)
+		defer discardTemp(tmpFile)
+		if ru.Preallocate && len(blob) >= preallocateMin {
+			err = preallocate(tmpFile, int64(len(blob)))
+		}
+	}
+	if err != nil {
+		slog.Debug("open", "path", fpath, "err", err)
+		return err
+	}
+	err = s.rs.write(tmpFile, blob)
+	if err != nil {
+		slog.Debug("write", "path", fpath, "err", err)
+		return err
+	}
+	if ru.Fsync {
+		err = tmpFile.Sync()
+		if err != nil {
+			slog.Debug("fsync", "path", fpath, "err", err)
+			return err
+		}
+	}
+	if ru.CollisionStrategy == collisionOverwrite || ru.CollisionStrategy == "" {
+		err = commitTemp(tmpFile, fpath)
+	} else {
+		err = commitTempNoClobber(tmpFile, fpath)
+	}
+	if err != nil {
+		slog.Debug("rename", "path", fpath, "err", err)
+		return err
+	}
+	// after the rename, a rejected collision leaves the existing
+	// file's checksum alone
+	if ru.WriteChecksum {
+		err = ru.writeChecksumFile(fpath, blob)
+		if err != nil {
+			slog.Debug("checksum", "path", fpath, "err", err)
+			return err
+		}
+		ru.chownPath(fpath + ru.checksumSuffix())
+	}
+	if format == formatRaw && (ru.RawMeta || ru.RawContentType != "") {
+		err = ru.writeRawMeta(fpath, rec)
+		if err != nil {
+			slog.Debug("raw meta", "path", fpath, "err", err)
+			return err
+		}
+		ru.chownPath(fpath + data.RawMetaSuffix)
+	}
+	ru.lastPath = fpath
+	return nil
+}
+
+// Close has nothing to do, each file is closed as it is written
+func (s *oneShotFileSink) Close() {}
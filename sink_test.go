@@ -0,0 +1,312 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cbor "github.com/brianolson/cbor_go"
+)
+
+func TestRotatedPath(t *testing.T) {
+	for _, tc := range []struct {
+		base string
+		seq  int
+		want string
+	}{
+		{"/d/a.cbor", 0, "/d/a.cbor"},
+		{"/d/a.cbor", 1, "/d/a.1.cbor"},
+		{"/d/a.cbor.gz", 2, "/d/a.cbor.2.gz"},
+		{"/d.x/a", 3, "/d.x/a.3"},
+		{"s3://b/k/a.cbor", 1, "s3://b/k/a.1.cbor"},
+	} {
+		if got := rotatedPath(tc.base, tc.seq); got != tc.want {
+			t.Errorf("rotatedPath(%q, %d) = %q, want %q", tc.base, tc.seq, got, tc.want)
+		}
+	}
+}
+
+// readGzipRecords decodes the CBOR records of a gzipped append file
+func readGzipRecords(t *testing.T, path string) []ReceiverRecord {
+	t.Helper()
+	fin, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fin.Close()
+	gz, err := gzip.NewReader(fin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decodeRecords(t, gz)
+}
+
+func TestMaxFileAge(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", MaxFileAge: -1}, "max-file-age")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, MaxFileAge: Duration(time.Hour)}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	wantStatus(t, post(rs, "/a/sa", "one"), 200)
+	when = when.Add(59 * time.Minute)
+	wantStatus(t, post(rs, "/a/sa", "two"), 200)
+	// an hour after the file was opened, not after the last write
+	when = when.Add(time.Minute)
+	wantStatus(t, post(rs, "/a/sa", "three"), 200)
+	rs.configs["a"].retire()
+
+	if names := listFiles(t, dir); !reflect.DeepEqual(names, []string{"a.1.cbor", "a.cbor"}) {
+		t.Fatalf("files %v", names)
+	}
+	for seq, want := range [][]string{{"one", "two"}, {"three"}} {
+		var got []string
+		for _, rec := range readRecords(t, rotatedPath(path, seq)) {
+			got = append(got, string(rec.Data))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("file %d: %q, want %q", seq, got, want)
+		}
+	}
+}
+
+func TestMaxFileBytes(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", AppendPath: "a.cbor", MaxFileBytes: -1}, "negative")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", OutTemplate: "/tmp/%T", MaxFileBytes: 100}, "needs an append file")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), MaxFileBytes: 200}},
+	})
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, "record "+strconv.Itoa(i))
+	}
+	// bigger than a whole file, it gets one to itself
+	want = append(want, strings.Repeat("x", 300))
+	want = append(want, "after")
+	for _, body := range want {
+		wantStatus(t, post(rs, "/a/sa", body), 200)
+	}
+	rs.configs["a"].retire()
+	var got []string
+	for seq := 0; ; seq++ {
+		path := rotatedPath(filepath.Join(dir, "a.cbor"), seq)
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			if seq < 5 {
+				t.Fatalf("only %d files", seq)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every file is whole records, never split
+		recs := readRecords(t, path)
+		if info.Size() > 200 && len(recs) != 1 {
+			t.Errorf("%s: %d bytes in %d records", path, info.Size(), len(recs))
+		}
+		for _, rec := range recs {
+			got = append(got, string(rec.Data))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records %q, want %q", got, want)
+	}
+}
+
+// legacyRecord is ReceiverRecord before it had optional fields, as
+// records were written before there was a Sink
+type legacyRecord struct {
+	When        int64  `json:"t"`
+	Data        []byte `json:"d"`
+	ContentType string `json:"Content-Type"`
+}
+
+func TestSinkBytes(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor")}},
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: filepath.Join(dir, "o", "%T.cbor")}},
+		"r": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sr", OutTemplate: filepath.Join(dir, "r", "%T.bin"), Raw: true}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	var appended []byte
+	for _, body := range []string{"one", `{"two":2}`} {
+		for _, unit := range []string{"a", "o", "r"} {
+			wantStatus(t, serve(rs, testRequest("POST", "/"+unit+"/s"+unit, "text/plain", []byte(body))), 200)
+		}
+		legacy, err := cbor.Dumps(legacyRecord{When: when.UnixMilli(), Data: []byte(body), ContentType: "text/plain"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		appended = append(appended, legacy...)
+		name := when.Local().Format("20060102_150405")
+		if got := readFile(t, filepath.Join(dir, "o", name+".cbor")); got != string(legacy) {
+			t.Errorf("out file %x, want %x", got, legacy)
+		}
+		if got := readFile(t, filepath.Join(dir, "r", name+".bin")); got != body {
+			t.Errorf("raw file %q, want %q", got, body)
+		}
+		when = when.Add(time.Second)
+	}
+	rs.units()["a"].retire()
+	if got := readFile(t, filepath.Join(dir, "a.cbor")); got != string(appended) {
+		t.Errorf("append file %x, want %x", got, appended)
+	}
+}
+
+func TestRotateCompressedKeepsExtension(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor.gz"), Compress: compressGzip, MaxFileBytes: 150}},
+	})
+	for _, body := range []string{"one", "two", "three"} {
+		wantStatus(t, post(rs, "/a/sa", body+strings.Repeat(".", 100)), 200)
+	}
+	rs.configs["a"].retire()
+	files := listFiles(t, dir)
+	want := []string{"a.cbor.1.gz", "a.cbor.2.gz", "a.cbor.gz"}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("files %v, want %v", files, want)
+	}
+	for i, name := range []string{"a.cbor.gz", "a.cbor.1.gz", "a.cbor.2.gz"} {
+		recs := readGzipRecords(t, filepath.Join(dir, name))
+		if len(recs) != 1 || !strings.HasPrefix(string(recs[0].Data), []string{"one", "two", "three"}[i]) {
+			t.Fatalf("%s: %+v", name, recs)
+		}
+	}
+}
+
+func TestBlobFraming(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, BlobPrefix: "REC>", BlobSuffix: "<END\n"}},
+	})
+	wantStatus(t, post(rs, "/a/sa", "one"), 200)
+	wantStatus(t, post(rs, "/a/sa", "two"), 200)
+	rs.configs["a"].retire()
+	blob := readFile(t, path)
+	for _, want := range []string{"one", "two"} {
+		if !strings.HasPrefix(blob, "REC>") {
+			t.Fatalf("no prefix at %q", blob)
+		}
+		blob = blob[len("REC>"):]
+		end := strings.Index(blob, "<END\n")
+		if end < 0 {
+			t.Fatalf("no suffix in %q", blob)
+		}
+		recs := decodeRecords(t, strings.NewReader(blob[:end]))
+		if len(recs) != 1 || string(recs[0].Data) != want {
+			t.Fatalf("framed records %+v, want %q", recs, want)
+		}
+		blob = blob[end+len("<END\n"):]
+	}
+	if blob != "" {
+		t.Fatalf("left over %q", blob)
+	}
+}
+
+func TestLatestSymlink(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a-%T.cbor"), AppendMod: 60, MaxFileBytes: 150, MaintainLatestSymlink: true}},
+	})
+	when := time.Unix(1772600040, 0)
+	rs.now = func() time.Time { return when }
+	latest := func() string {
+		t.Helper()
+		target, err := os.Readlink(filepath.Join(dir, "latest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return target
+	}
+	wantStatus(t, post(rs, "/a/sa", "one"), 200)
+	if got := latest(); got != "a-1772600040.cbor" {
+		t.Fatalf("latest -> %q", got)
+	}
+	// the next AppendMod bucket
+	when = when.Add(time.Minute)
+	wantStatus(t, post(rs, "/a/sa", "two"), 200)
+	if got := latest(); got != "a-1772600100.cbor" {
+		t.Fatalf("latest -> %q", got)
+	}
+	// MaxFileBytes rotation within the bucket
+	wantStatus(t, post(rs, "/a/sa", strings.Repeat("y", 100)), 200)
+	if got := latest(); got != "a-1772600100.1.cbor" {
+		t.Fatalf("latest -> %q", got)
+	}
+	recs := readRecords(t, filepath.Join(dir, "latest"))
+	if len(recs) != 1 || recs[0].Data[0] != 'y' {
+		t.Fatalf("latest has %d records", len(recs))
+	}
+	want := []string{"a-1772600040.cbor", "a-1772600100.1.cbor", "a-1772600100.cbor"}
+	if files := listFiles(t, dir); !reflect.DeepEqual(files, want) {
+		t.Fatalf("files %v, want %v", files, want)
+	}
+}
+
+func TestConcurrentTimeRotation(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a-%T.cbor"), AppendMod: 10}},
+	})
+	// each request a second later, so the posts race across buckets
+	const start = 1772600000
+	var tick atomic.Int64
+	rs.now = func() time.Time { return time.Unix(start+tick.Add(1), 0) }
+	const n = 100
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
+			if post(rs, "/a/sa", body).Code != 200 {
+				failed.Add(1)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	if failed.Load() != 0 {
+		t.Fatalf("%d posts failed", failed.Load())
+	}
+	rs.configs["a"].retire()
+
+	seen := make(map[string]bool)
+	names := listFiles(t, dir)
+	if len(names) < n/10 {
+		t.Fatalf("files %v", names)
+	}
+	for _, name := range names {
+		bucket, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "a-"), ".cbor"), 10, 64)
+		if err != nil {
+			t.Fatalf("file %s: %s", name, err)
+		}
+		// every record is in the file for its time, none went to a
+		// file that had been rotated away from and closed
+		for _, rec := range readRecords(t, filepath.Join(dir, name)) {
+			if sec := rec.When / 1000; sec < bucket || sec >= bucket+10 {
+				t.Errorf("%s has a record from %d", name, sec)
+			}
+			seen[string(rec.Data)] = true
+		}
+	}
+	if len(seen) != n {
+		t.Fatalf("%d of %d records stored", len(seen), n)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bolson.org/receiver/data"
+)
+
+// spillFile is a raw body bigger than SpillThreshold, written to a temp
+// file next to where it will be stored instead of held in memory
+type spillFile struct {
+	f    *os.File
+	size int64
+	// sum is the HashAlgo digest of the body if WriteChecksum
+	sum []byte
+}
+
+// spillConflicts names a setting that needs the whole body in memory
+func (ruc *ReceiverUnitConfig) spillConflicts() string {
+	switch {
+	case ruc.EncryptKey != "":
+		return "encrypt-key"
+	case ruc.HMACSecret != "":
+		return "hmac-secret"
+	case ruc.NonceAuth:
+		return "nonce-auth"
+	case ruc.ValidateJSON:
+		return "validate-json"
+	case ruc.Stream:
+		return "stream"
+	case ruc.TeeStdout:
+		return "tee-stdout"
+	case ruc.TextLog != "":
+		return "text-log"
+	case ruc.StoreOnChange:
+		return "store-on-change"
+	case ruc.JSONWrap:
+		return "json-wrap"
+	case strings.Contains(ruc.OutTemplate, jsonDirectivePrefix):
+		return "%{json:} in out"
+	}
+	return ""
+}
+
+// readBodySpill reads up to SpillThreshold bytes of body into memory.
+// A longer body goes to a spillFile instead and data is nil.
+// expect is the body size if known (Content-Length), else -1.
+func (rs *receiverServer) readBodySpill(ru *ReceiverUnit, r io.Reader, expect int64, method string, now time.Time) (body []byte, spill *spillFile, err error) {
+	head, err := io.ReadAll(io.LimitReader(r, ru.SpillThreshold+1))
+	if err != nil || int64(len(head)) <= ru.SpillThreshold {
+		return head, nil, err
+	}
+	// same directory as the final file so it can be renamed into place
+	fpath := formatTemplateString(ru.OutTemplate, now, ru.outTimeLayout(), newPathVars(method, nil))
+	f, err := rs.createTempDir(filepath.Dir(fpath), filepath.Base(fpath)+".*"+tempSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	ru.chownFile(f)
+	if ru.Preallocate && expect >= preallocateMin {
+		err = preallocate(f, expect)
+		if err != nil {
+			discardTemp(f)
+			return nil, nil, err
+		}
+	}
+	var w io.Writer = f
+	var sum hash.Hash
+	if ru.WriteChecksum {
+		sum = ru.newHash()
+		w = io.MultiWriter(f, sum)
+	}
+	_, err = w.Write(head)
+	var size int64
+	if err == nil {
+		size, err = io.Copy(w, r)
+		size += int64(len(head))
+	}
+	if err == nil && ru.Preallocate && size < expect {
+		// don't keep the preallocated tail of a short body
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		discardTemp(f)
+		return nil, nil, err
+	}
+	spill = &spillFile{f: f, size: size}
+	if sum != nil {
+		spill.sum = sum.Sum(nil)
+	}
+	return nil, spill, nil
+}
+
+// commitSpill stores a spilled body, through the unit's write queue if it has one
+func (rs *receiverServer) commitSpill(cfg *ReceiverUnit, spill *spillFile, rec *ReceiverRecord, method string, now time.Time) error {
+	if cfg.paused.Load() {
+		return errUnitPaused
+	}
+	if cfg.writeQueue == nil {
+		return rs.storeSpill(cfg, spill, rec, method, now)
+	}
+	return cfg.writeQueue.enqueue(&writeJob{
+		rec:    rec,
+		format: formatRaw,
+		method: method,
+		now:    now,
+		spill:  spill,
+	})
+}
+
+// storeSpill renames a spilled body into place as storeRecord would a
+// raw OutTemplate file
+func (rs *receiverServer) storeSpill(cfg *ReceiverUnit, spill *spillFile, rec *ReceiverRecord, method string, now time.Time) error {
+	cfg.l.Lock()
+	defer cfg.l.Unlock()
+	if cfg.retired {
+		return errUnitPaused
+	}
+	fpath, err := cfg.outPath(formatTemplateString(cfg.OutTemplate, now, cfg.outTimeLayout(), newPathVars(method, rec)))
+	if err != nil {
+		return err
+	}
+	if cfg.Fsync {
+		err = spill.f.Sync()
+		if err != nil {
+			slog.Debug("fsync", "path", fpath, "err", err)
+			return err
+		}
+	}
+	if cfg.CollisionStrategy == collisionOverwrite || cfg.CollisionStrategy == "" {
+		err = commitTemp(spill.f, fpath)
+	} else {
+		err = commitTempNoClobber(spill.f, fpath)
+	}
+	if err != nil {
+		slog.Debug("rename", "path", fpath, "err", err)
+		return err
+	}
+	if cfg.WriteChecksum {
+		err = cfg.writeChecksumLine(fpath, spill.sum)
+		if err != nil {
+			slog.Debug("checksum", "path", fpath, "err", err)
+			return err
+		}
+		cfg.chownPath(fpath + cfg.checksumSuffix())
+	}
+	if cfg.RawMeta || cfg.RawContentType != "" {
+		err = cfg.writeRawMeta(fpath, rec)
+		if err != nil {
+			slog.Debug("raw meta", "path", fpath, "err", err)
+			return err
+		}
+		cfg.chownPath(fpath + data.RawMetaSuffix)
+	}
+	cfg.lastPath = fpath
+	cfg.noteWrite(now)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// allocated is how many bytes f allocates
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestSpillThreshold(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", OutTemplate: "/tmp/%T", Raw: true, SpillThreshold: 1024, EncryptKey: "x"}, "encrypt-key")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"s": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "ss", OutTemplate: filepath.Join(dir, "s", "%T.bin"), Raw: true, SpillThreshold: 1024, WriteChecksum: true, MaxSize: 64 << 20}},
+		"m": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sm", OutTemplate: filepath.Join(dir, "m", "%T.bin"), Raw: true, MaxSize: 64 << 20}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	spilled := allocated(func() {
+		wantStatus(t, serve(rs, testRequest("POST", "/s/ss", "application/octet-stream", big)), 200)
+	})
+	inMemory := allocated(func() {
+		wantStatus(t, serve(rs, testRequest("POST", "/m/sm", "application/octet-stream", big)), 200)
+	})
+	// the body is 16MB; spilled it goes through small buffers
+	if spilled > 1<<20 || inMemory < uint64(len(big)) {
+		t.Errorf("allocated %d spilling, %d in memory, for a %d byte body", spilled, inMemory, len(big))
+	}
+	// under the threshold a body isn't spilled
+	when = when.Add(time.Second)
+	wantStatus(t, serve(rs, testRequest("POST", "/s/ss", "application/octet-stream", []byte("small"))), 200)
+
+	names := listFiles(t, filepath.Join(dir, "s"))
+	if len(names) != 4 {
+		t.Fatalf("files %v", names)
+	}
+	bigPath := filepath.Join(dir, "s", names[0])
+	got, err := os.ReadFile(bigPath)
+	if err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("spilled body: %d bytes, err %v", len(got), err)
+	}
+	sum := sha256.Sum256(big)
+	if line := readFile(t, bigPath+".sha256"); !strings.HasPrefix(line, hex.EncodeToString(sum[:])+"  ") {
+		t.Errorf("checksum %q", line)
+	}
+	if got := readFile(t, filepath.Join(dir, "s", names[2])); got != "small" {
+		t.Errorf("small body %q", got)
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, tempSuffix) {
+			t.Errorf("temp file left: %s", name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how many recent events are kept for Last-Event-ID resume
+const streamHistory = 1000
+
+// events buffered per subscriber before it is considered too slow and
+// is disconnected (it can reconnect and resume with Last-Event-ID)
+const streamSubscriberBuffer = 100
+
+const streamKeepalive = 30 * time.Second
+
+type streamEvent struct {
+	id   uint64
+	data []byte
+}
+
+// recordStream fans out newly stored records to Server-Sent Events clients
+type recordStream struct {
+	l sync.Mutex
+
+	lastID uint64
+
+	// recent events, oldest first
+	recent []streamEvent
+
+	subs map[chan streamEvent]bool
+}
+
+func newRecordStream() *recordStream {
+	return &recordStream{
+		subs: make(map[chan streamEvent]bool),
+	}
+}
+
+func (rs *recordStream) publish(rec *ReceiverRecord) {
+	blob, err := json.Marshal(rec)
+	if err != nil {
+		slog.Debug("stream json", "err", err)
+		return
+	}
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.lastID++
+	ev := streamEvent{id: rs.lastID, data: blob}
+	if len(rs.recent) >= streamHistory {
+		copy(rs.recent, rs.recent[1:])
+		rs.recent = rs.recent[:len(rs.recent)-1]
+	}
+	rs.recent = append(rs.recent, ev)
+	for ch := range rs.subs {
+		select {
+		case ch <- ev:
+		default:
+			slog.Debug("stream subscriber too slow, dropping")
+			delete(rs.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns any retained events after lastID and a channel of
+// new events. The channel is closed if the subscriber falls behind.
+func (rs *recordStream) subscribe(lastID uint64) ([]streamEvent, chan streamEvent) {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	var backlog []streamEvent
+	for _, ev := range rs.recent {
+		if ev.id > lastID {
+			backlog = append(backlog, ev)
+		}
+	}
+	ch := make(chan streamEvent, streamSubscriberBuffer)
+	rs.subs[ch] = true
+	return backlog, ch
+}
+
+func (rs *recordStream) unsubscribe(ch chan streamEvent) {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	if rs.subs[ch] {
+		delete(rs.subs, ch)
+		close(ch)
+	}
+}
+
+func writeStreamEvent(out http.ResponseWriter, ev streamEvent) error {
+	_, err := fmt.Fprintf(out, "id: %d\ndata: %s\n\n", ev.id, ev.data)
+	return err
+}
+
+// ServeHTTP sends text/event-stream until the client goes away.
+// Auth has already been checked by receiverServer.
+func (rs *recordStream) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	flusher, ok := out.(http.Flusher)
+	if !ok {
+		http.Error(out, "streaming not supported", 500)
+		return
+	}
+	// without Last-Event-ID only new events are sent
+	rs.l.Lock()
+	lastID := rs.lastID
+	rs.l.Unlock()
+	if lei := request.Header.Get("Last-Event-ID"); lei != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lei, 10, 64)
+		if err != nil {
+			http.Error(out, "bad Last-Event-ID", 400)
+			return
+		}
+	}
+	backlog, ch := rs.subscribe(lastID)
+	defer rs.unsubscribe(ch)
+
+	out.Header().Set("Content-Type", "text/event-stream")
+	out.Header().Set("Cache-Control", "no-cache")
+	out.WriteHeader(http.StatusOK)
+	for _, ev := range backlog {
+		if writeStreamEvent(out, ev) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if writeStreamEvent(out, ev) != nil {
+				return
+			}
+		case <-keepalive.C:
+			_, err := out.Write([]byte(": keepalive\n\n"))
+			if err != nil {
+				return
+			}
+		case <-request.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readEvent reads one server-sent event, skipping keepalives
+func readEvent(t *testing.T, br *bufio.Reader) (id string, rec ReceiverRecord) {
+	t.Helper()
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "data: "):
+			err = json.Unmarshal([]byte(line[len("data: "):]), &rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+		case line == "" && id != "":
+			return id, rec
+		}
+	}
+}
+
+func getStream(t *testing.T, url, lastID string) *http.Response {
+	t.Helper()
+	request, _ := http.NewRequest("GET", url, nil)
+	if lastID != "" {
+		request.Header.Set("Last-Event-ID", lastID)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+func TestStream(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), Stream: true}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sb", AppendPath: filepath.Join(dir, "b.cbor")}},
+	})
+	server := httptest.NewServer(rs)
+	// cleanups run last first, so stream bodies are closed before this
+	t.Cleanup(server.Close)
+	wantStatus(t, post(rs, "/a/sa", "before"), 200)
+
+	response := getStream(t, server.URL+"/a/sa/stream", "")
+	if response.StatusCode != 200 || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, Content-Type %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	br := bufio.NewReader(response.Body)
+	wantStatus(t, post(rs, "/a/sa", "one"), 200)
+	wantStatus(t, post(rs, "/a/sa", "two"), 200)
+	// only records stored since connecting
+	id, rec := readEvent(t, br)
+	if id != "2" || string(rec.Data) != "one" {
+		t.Fatalf("event %s %q", id, rec.Data)
+	}
+	id, rec = readEvent(t, br)
+	if id != "3" || string(rec.Data) != "two" {
+		t.Fatalf("event %s %q", id, rec.Data)
+	}
+
+	// resume
+	response = getStream(t, server.URL+"/a/sa/stream", "1")
+	br = bufio.NewReader(response.Body)
+	for _, want := range []string{"one", "two"} {
+		_, rec = readEvent(t, br)
+		if string(rec.Data) != want {
+			t.Fatalf("resumed %q, want %q", rec.Data, want)
+		}
+	}
+
+	if response := getStream(t, server.URL+"/a/wrong/stream", ""); response.StatusCode != 403 {
+		t.Errorf("wrong secret: status %d", response.StatusCode)
+	}
+	if response := getStream(t, server.URL+"/a/sa/stream", "x"); response.StatusCode != 400 {
+		t.Errorf("bad Last-Event-ID: status %d", response.StatusCode)
+	}
+	// no stream, a GET is just a method that isn't allowed
+	if response := getStream(t, server.URL+"/b/sb/stream", ""); response.StatusCode != 405 {
+		t.Errorf("unit without stream: status %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stripePath is the AppendPath of stripe i, "a.cbor" -> "a.s0.cbor"
+func stripePath(path string, i int) string {
+	ext := filepath.Ext(path)
+	if strings.Contains(ext, "%") {
+		ext = ""
+	}
+	return strings.TrimSuffix(path, ext) + ".s" + strconv.Itoa(i) + ext
+}
+
+// setupStripes makes a unit for each stripe that only writes its file.
+// Everything else about a record is done once by the unit itself.
+func (ru *ReceiverUnit) setupStripes(rs *receiverServer) {
+	ru.stripes = make([]*ReceiverUnit, ru.Stripes)
+	for i := range ru.stripes {
+		stripe := &ReceiverUnit{ReceiverUnitConfig: ru.ReceiverUnitConfig}
+		stripe.AppendPath = stripePath(ru.AppendPath, i)
+		stripe.Stripes = 0
+		stripe.TextLog = ""
+		stripe.Stream = false
+		stripe.TeeStdout = false
+		stripe.MaxWritesPerSecond = 0
+		stripe.RateLimit = 0
+		stripe.RequestBudget = 0
+		stripe.NonceAuth = false
+		stripe.MaxSilence = 0
+		stripe.StoreOnChange = false
+		if stripe.appendCache != nil {
+			// the cache is of the path, which differs
+			stripe.appendCache = new(atomic.Pointer[appendPathBucket])
+		}
+		stripe.setup(rs, ru.name)
+		ru.stripes[i] = stripe
+	}
+}
+
+// storeStriped writes rec to the next stripe
+func (rs *receiverServer) storeStriped(cfg *ReceiverUnit, rec *ReceiverRecord, format, method string, now time.Time) error {
+	i := (cfg.nextStripe.Add(1) - 1) % uint64(len(cfg.stripes))
+	err := rs.storeRecord(cfg.stripes[i], rec, format, method, now)
+	if err != nil {
+		return err
+	}
+	cfg.l.Lock()
+	defer cfg.l.Unlock()
+	cfg.afterStore(rec, now, newPathVars(method, rec))
+	return nil
+}
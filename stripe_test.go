@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestStripePath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		i    int
+		want string
+	}{
+		{"a.cbor", 0, "a.s0.cbor"},
+		{"/d/a.cbor.gz", 3, "/d/a.cbor.s3.gz"},
+		{"/d/a", 1, "/d/a.s1"},
+		{"/d/a-%T", 2, "/d/a-%T.s2"},
+	} {
+		if got := stripePath(tc.path, tc.i); got != tc.want {
+			t.Errorf("stripePath(%q, %d) = %q, want %q", tc.path, tc.i, got, tc.want)
+		}
+	}
+}
+
+func TestStripesBalanced(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), Stripes: 4, TextLog: filepath.Join(dir, "a.log")}},
+	})
+	const writers, each = 8, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Go(func() {
+			for i := range each {
+				out := post(rs, "/a/sa", fmt.Sprintf("%d-%d", w, i))
+				if out.Code != 200 {
+					t.Errorf("status %d: %q", out.Code, out.Body.String())
+				}
+			}
+		})
+	}
+	wg.Wait()
+	rs.configs["a"].retire()
+	seen := make(map[string]bool)
+	for i := range 4 {
+		recs := readRecords(t, filepath.Join(dir, "a.s"+strconv.Itoa(i)+".cbor"))
+		// records go to stripes in turn, so they come out even
+		if len(recs) != writers*each/4 {
+			t.Errorf("stripe %d has %d records, want %d", i, len(recs), writers*each/4)
+		}
+		for _, rec := range recs {
+			seen[string(rec.Data)] = true
+		}
+	}
+	if len(seen) != writers*each {
+		t.Fatalf("%d distinct records, want %d", len(seen), writers*each)
+	}
+	if files := listFiles(t, dir); len(files) != 5 {
+		t.Fatalf("files %v", files)
+	}
+}
+
+func BenchmarkStripes(b *testing.B) {
+	body := string(make([]byte, 200))
+	for _, fsync := range []bool{false, true} {
+		for _, stripes := range []int{0, 4} {
+			b.Run(fmt.Sprintf("fsync=%v/stripes=%d", fsync, stripes), func(b *testing.B) {
+				dir := b.TempDir()
+				cfg := &ReceiverUnit{ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), Stripes: stripes, Fsync: fsync}}
+				err := cfg.sane()
+				if err != nil {
+					b.Fatal(err)
+				}
+				rs := &receiverServer{configs: map[string]*ReceiverUnit{"a": cfg}, tarpit: newTarpit()}
+				cfg.setup(rs, "a")
+				defer cfg.retire()
+				b.SetParallelism(8)
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						post(rs, "/a/sa", body)
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// outputRoot is the fixed directory a unit writes under, the part of
+// its template before anything that gets expanded
+func (ruc *ReceiverUnitConfig) outputRoot() string {
+	tmpl := ruc.OutTemplate
+	if ruc.AppendPath != "" {
+		tmpl = ruc.AppendPath
+	}
+	if tmpl == "-" {
+		return "stdout"
+	}
+	return templateRoot(tmpl)
+}
+
+// templateRoot is the deepest directory of a path template that doesn't
+// depend on the request, "/data" for "/data/%Y/%m/%T.cbor"
+func templateRoot(tmpl string) string {
+	dirFn := filepath.Dir
+	if isS3Path(tmpl) {
+		dirFn = s3Dir
+	}
+	dir := dirFn(tmpl)
+	if i := strings.IndexByte(dir, '%'); i >= 0 {
+		dir = dirFn(dir[:i] + "x")
+	}
+	return dir
+}
+
+// storeMode is e.g. "append cbor" or "out raw"
+func (ruc *ReceiverUnitConfig) storeMode() string {
+	if ruc.AppendPath != "" {
+		return "append " + ruc.defaultFormat()
+	}
+	return "out " + ruc.defaultFormat()
+}
+
+// logStartupSummary logs the effective configuration in one line so an
+// operator can check it at a glance. No secrets.
+func (rs *receiverServer) logStartupSummary(addr, grpcAddr string) {
+	current := rs.units()
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	units := make([]any, 0, len(names))
+	for _, name := range names {
+		cfg := current[name]
+		auth := "secret"
+		if cfg.Public {
+			auth = "public"
+		} else if cfg.NonceAuth {
+			auth = "nonce"
+		} else if cfg.Secret == "" {
+			auth = "hmac"
+		}
+		units = append(units, slog.Group(name,
+			"mode", cfg.storeMode(),
+			"root", cfg.outputRoot(),
+			"auth", auth,
+		))
+	}
+	attrs := []any{"addr", addr, "units", len(names)}
+	if grpcAddr != "" {
+		attrs = append(attrs, "grpc-addr", grpcAddr)
+	}
+	attrs = append(attrs, slog.Group("unit", units...))
+	slog.Info("startup", attrs...)
+}
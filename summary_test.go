@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// captureLog sends slog to a JSON buffer until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	return &buf
+}
+
+func TestStartupSummary(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "hunter2", AppendPath: filepath.Join(dir, "%Y", "a.cbor")}},
+		"b": {ReceiverUnitConfig: ReceiverUnitConfig{Public: true, ContentTypes: []string{"image/png"}, OutTemplate: filepath.Join(dir, "b", "%T.bin"), Raw: true}},
+	})
+	buf := captureLog(t)
+	rs.logStartupSummary(":8080", ":9090")
+
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("summary logs a secret: %s", buf)
+	}
+	var got map[string]any
+	err := json.Unmarshal(buf.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("%s: %v", buf, err)
+	}
+	delete(got, "time")
+	want := map[string]any{
+		"level":     "INFO",
+		"msg":       "startup",
+		"addr":      ":8080",
+		"grpc-addr": ":9090",
+		"units":     2.0,
+		"unit": map[string]any{
+			"a": map[string]any{"mode": "append cbor", "root": dir, "auth": "secret"},
+			"b": map[string]any{"mode": "out raw", "root": filepath.Join(dir, "b"), "auth": "public"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary %v\nwant %v", got, want)
+	}
+}
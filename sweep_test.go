@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeAged writes a file under dir with its mtime age ago
+func writeAged(t *testing.T, dir, name string, age time.Duration) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(name), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Now().Add(-age)
+	os.Chtimes(path, when, when)
+}
+
+func TestSweepStaleTemps(t *testing.T) {
+	dir := t.TempDir()
+	writeAged(t, dir, "a.cbor", 2*time.Hour)
+	writeAged(t, dir, "old.cbor.123"+tempSuffix, 2*time.Hour)
+	writeAged(t, dir, "new.cbor.456"+tempSuffix, time.Minute)
+	writeAged(t, dir, "sub/deep.cbor.789"+tempSuffix, 2*time.Hour)
+	count, err := sweepStaleTemps(dir, time.Hour)
+	if err != nil || count != 1 {
+		t.Fatalf("count %d, err %v", count, err)
+	}
+	want := []string{"a.cbor", "new.cbor.456" + tempSuffix, "sub/deep.cbor.789" + tempSuffix}
+	if got := listFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("left %v, want %v", got, want)
+	}
+}
+
+func TestSweepUnitTempsTemplated(t *testing.T) {
+	dir := t.TempDir()
+	writeAged(t, dir, "2026/10/14/a.cbor", 2*time.Hour)
+	writeAged(t, dir, "2026/10/14/a.cbor.1"+tempSuffix, 2*time.Hour)
+	writeAged(t, dir, "2026/10/15/b.cbor.2"+tempSuffix, 2*time.Hour)
+	writeAged(t, dir, "2026/10/15/c.cbor.3"+tempSuffix, time.Minute)
+	writeAged(t, dir, "plain/d.cbor.4"+tempSuffix, 2*time.Hour)
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", OutTemplate: filepath.Join(dir, "%Y/%m/%d/%T.cbor")}},
+	})
+	rs.sweepUnitTemps(time.Hour)
+	want := []string{"2026/10/14/a.cbor", "2026/10/15/c.cbor.3" + tempSuffix}
+	if got := listFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("left %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tarpit slows down clients that keep failing auth.
+// Each consecutive failure from an IP doubles the delay before the 403,
+// up to the unit's AuthFailTarpit.
+type tarpit struct {
+	l sync.Mutex
+
+	failures map[string]*tarpitEntry
+}
+
+type tarpitEntry struct {
+	count int
+	last  time.Time
+}
+
+const (
+	tarpitBaseDelay = 100 * time.Millisecond
+
+	// forget an IP this long after its last failure
+	tarpitForget = 10 * time.Minute
+
+	// bound memory, past this new IPs aren't tracked
+	tarpitMaxEntries = 10000
+)
+
+func newTarpit() *tarpit {
+	return &tarpit{failures: make(map[string]*tarpitEntry)}
+}
+
+// fail records an auth failure and returns how long to stall, up to maxDelay
+func (tp *tarpit) fail(ip string, now time.Time, maxDelay time.Duration) time.Duration {
+	tp.l.Lock()
+	defer tp.l.Unlock()
+	te, some := tp.failures[ip]
+	if some && now.Sub(te.last) > tarpitForget {
+		te.count = 0
+	}
+	if !some {
+		if len(tp.failures) >= tarpitMaxEntries {
+			tp.prune(now)
+			if len(tp.failures) >= tarpitMaxEntries {
+				return 0
+			}
+		}
+		te = &tarpitEntry{}
+		tp.failures[ip] = te
+	}
+	te.count++
+	te.last = now
+	delay := tarpitBaseDelay
+	for i := 1; i < te.count && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// succeed forgets an IP's failures
+func (tp *tarpit) succeed(ip string) {
+	tp.l.Lock()
+	defer tp.l.Unlock()
+	delete(tp.failures, ip)
+}
+
+func (tp *tarpit) prune(now time.Time) {
+	for ip, te := range tp.failures {
+		if now.Sub(te.last) > tarpitForget {
+			delete(tp.failures, ip)
+		}
+	}
+}
+
+// denyAuth answers 403, after a tarpit delay if the unit has one
+func (rs *receiverServer) denyAuth(out http.ResponseWriter, request *http.Request, cfg *ReceiverUnit) {
+	rs.authFailDelay(request.Context(), rs.clientIP(request), cfg)
+	http.Error(out, "nope", http.StatusForbidden)
+}
+
+// authFailDelay counts an auth failure from ip and waits out the tarpit
+// delay, if the unit has one, or until ctx is done
+func (rs *receiverServer) authFailDelay(ctx context.Context, ip string, cfg *ReceiverUnit) {
+	if cfg.AuthFailTarpit <= 0 {
+		return
+	}
+	delay := rs.tarpit.fail(ip, rs.clock(), time.Duration(cfg.AuthFailTarpit))
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+	}
+}
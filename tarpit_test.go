@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTarpitDelays(t *testing.T) {
+	tp := newTarpit()
+	when := time.Unix(1772600000, 0)
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, tp.fail("192.0.2.1", when, time.Second))
+	}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delays %v, want %v", got, want)
+		}
+	}
+	if d := tp.fail("192.0.2.2", when, time.Second); d != tarpitBaseDelay {
+		t.Errorf("other IP delay %s", d)
+	}
+	tp.succeed("192.0.2.1")
+	if d := tp.fail("192.0.2.1", when, time.Second); d != tarpitBaseDelay {
+		t.Errorf("delay after success %s", d)
+	}
+	if d := tp.fail("192.0.2.1", when.Add(tarpitForget+time.Second), time.Second); d != tarpitBaseDelay {
+		t.Errorf("delay after forgetting %s", d)
+	}
+}
+
+func TestTarpitHTTP(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), AuthFailTarpit: Duration(200 * time.Millisecond)}},
+	})
+	var took []time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		wantStatus(t, post(rs, "/a/wrong", "x"), 403)
+		took = append(took, time.Since(start))
+	}
+	if took[0] < 100*time.Millisecond || took[1] < 200*time.Millisecond || took[1] <= took[0] {
+		t.Errorf("failure delays %v don't grow", took)
+	}
+	// capped at AuthFailTarpit
+	if took[2] > time.Second {
+		t.Errorf("third failure took %s", took[2])
+	}
+	start := time.Now()
+	wantStatus(t, post(rs, "/a/sa", "ok"), 200)
+	if d := time.Since(start); d >= tarpitBaseDelay {
+		t.Errorf("good request delayed %s", d)
+	}
+	// success forgets the failures
+	start = time.Now()
+	wantStatus(t, post(rs, "/a/wrong", "x"), 403)
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Errorf("failure after success took %s", d)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFormatTemplateString(t *testing.T) {
+	when := time.Date(2026, 3, 4, 5, 6, 7, 890000000, time.UTC)
+	vars := newPathVars("post", nil)
+	for _, tc := range []struct {
+		tmpl string
+		want string
+	}{
+		{"%T", "20260304_050607.89"},
+		{"%Y", "2026"},
+		{"%m", "03"},
+		{"%d", "04"},
+		{"%H", "05"},
+		{"%i", "06"},
+		{"%S", "07"},
+		{"%M", "POST"},
+		{"/d/%Y/%m/%d/%H%i%S-%M.cbor", "/d/2026/03/04/050607-POST.cbor"},
+		{"%%Y %%M %%T", "%Y %M %T"},
+		{"100%%%Y", "100%2026"},
+	} {
+		if got := formatTemplateString(tc.tmpl, when, timestampFormat, vars); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.tmpl, got, tc.want)
+		}
+	}
+}
+
+func TestFormatAppendTemplateString(t *testing.T) {
+	const unix = 1772600767
+	local := time.Unix(unix, 0)
+	got := formatAppendTemplateString("/d/%Y/%m/%d/%H%i%S/%M-%T.cbor", unix, "", newPathVars("PUT", nil))
+	want := "/d/" + local.Format("2006/01/02/150405") + "/PUT-1772600767.cbor"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDatePartitionedDirs(t *testing.T) {
+	dir := t.TempDir()
+	when := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: filepath.Join(dir, "out/%Y/%m/%d/%H%i%S.cbor")}},
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "app/%Y/%m/%d/%M.cbor"), TextLog: filepath.Join(dir, "log/%Y/%m/t.log")}},
+	})
+	rs.now = func() time.Time { return when }
+	wantStatus(t, post(rs, "/o/so", "one"), 200)
+	wantStatus(t, post(rs, "/a/sa", "two"), 200)
+	rs.configs["a"].retire()
+	local := when.Local()
+	got := listFiles(t, dir)
+	want := []string{
+		"app/" + local.Format("2006/01/02") + "/POST.cbor",
+		"log/" + local.Format("2006/01") + "/t.log",
+		"out/" + when.Format("2006/01/02/150405") + ".cbor",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("files %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("files %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAppendBucket(t *testing.T) {
+	for _, tc := range []struct {
+		mod, offset, nowu, want int64
+	}{
+		{0, 0, 1772600000, 1772600000},
+		{3600, 0, 7200, 7200},
+		{3600, 0, 7199, 3600},
+		// buckets start at 10 past the hour
+		{3600, -600, 7800, 7800},
+		{3600, -600, 7799, 4200},
+		{3600, 600, 7199, 6600},
+		// an offset past the modulus is the same as its remainder
+		{3600, 7260, 7199, 7140},
+		{3600, -7260, 7199, 3660},
+		// before 1970
+		{3600, 0, -1, -3600},
+		{3600, -600, -3000, -3000},
+		// across a DST change in New York, buckets are in unix time
+		{3600, 0, 1772953200, 1772953200},
+		{3600, 0, 1772953199, 1772949600},
+	} {
+		ruc := ReceiverUnitConfig{AppendMod: tc.mod, AppendOffset: tc.offset}
+		if got := ruc.appendBucket(tc.nowu); got != tc.want {
+			t.Errorf("mod %d offset %d at %d: bucket %d, want %d", tc.mod, tc.offset, tc.nowu, got, tc.want)
+		}
+	}
+	// contiguous and monotonic through negative and positive offsets
+	for _, offset := range []int64{-7260, -600, 0, 600, 7260} {
+		ruc := ReceiverUnitConfig{AppendMod: 3600, AppendOffset: offset}
+		prev := ruc.appendBucket(-20000)
+		for nowu := int64(-20000); nowu < 20000; nowu += 7 {
+			bucket := ruc.appendBucket(nowu)
+			if bucket > nowu || nowu >= bucket+3600 || (bucket != prev && bucket != prev+3600) {
+				t.Fatalf("offset %d at %d: bucket %d after %d", offset, nowu, bucket, prev)
+			}
+			prev = bucket
+		}
+	}
+}
+
+func TestGenerateAppendPathCache(t *testing.T) {
+	cached := ReceiverUnitConfig{Secret: "s", AppendPath: "/d/%Y%m%d%H-%T.cbor", AppendMod: 3600}
+	err := cached.sane()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.appendCache == nil {
+		t.Fatal("time-only AppendPath not cached")
+	}
+	plain := cached
+	plain.appendCache = nil
+	vars := newPathVars("POST", nil)
+	start := time.Unix(1772600000, 0)
+	// back and forth over several hour boundaries
+	for _, s := range []int64{0, 1, 3599, 3600, 7300, 10, 7199, 7200, 86400} {
+		now := start.Add(time.Duration(s) * time.Second)
+		got := cached.GenerateAppendPath(now, vars)
+		want := plain.GenerateAppendPath(now, vars)
+		if got != want {
+			t.Fatalf("+%ds: cached %q, want %q", s, got, want)
+		}
+	}
+	method := ReceiverUnitConfig{Secret: "s", AppendPath: "/d/%M-%T.cbor", AppendMod: 3600}
+	err = method.sane()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method.appendCache != nil {
+		t.Fatal("AppendPath with %M cached")
+	}
+}
+
+func BenchmarkGenerateAppendPath(b *testing.B) {
+	ruc := ReceiverUnitConfig{Secret: "s", AppendPath: "/var/data/%Y/%m/%d/a-%T.cbor", AppendMod: 3600}
+	err := ruc.sane()
+	if err != nil {
+		b.Fatal(err)
+	}
+	vars := newPathVars("POST", nil)
+	now := time.Unix(1772600000, 0)
+	for _, bc := range []struct {
+		name  string
+		cache *atomic.Pointer[appendPathBucket]
+	}{
+		{"uncached", nil},
+		{"cached", ruc.appendCache},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ruc.appendCache = bc.cache
+			b.ReportAllocs()
+			for b.Loop() {
+				ruc.GenerateAppendPath(now, vars)
+			}
+		})
+	}
+}
+
+func TestSanitizeMethod(t *testing.T) {
+	for method, want := range map[string]string{
+		"POST":         "POST",
+		"put":          "PUT",
+		"M-SEARCH":     "M-SEARCH",
+		"../../etc":    "ETC",
+		"a/b\x00c d_e": "ABCD_E",
+	} {
+		if got := sanitizeMethod(method); got != want {
+			t.Errorf("sanitizeMethod(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
+
+func TestMethodDirective(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a-%M.cbor"), Methods: []string{"POST", "PUT"}}},
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: filepath.Join(dir, "%M", "%T"), Methods: []string{"POST", "PUT"}}},
+	})
+	for _, target := range []string{"/a/sa", "/o/so"} {
+		wantStatus(t, serve(rs, testRequest("POST", target, "text/plain", []byte("posted"))), 200)
+		wantStatus(t, serve(rs, testRequest("PUT", target, "text/plain", []byte("put"))), 200)
+		wantStatus(t, serve(rs, testRequest("DELETE", target, "text/plain", []byte("x"))), 405)
+	}
+	rs.configs["a"].retire()
+	files := listFiles(t, dir)
+	if len(files) != 4 {
+		t.Fatalf("files %v", files)
+	}
+	for _, name := range files {
+		recs := readRecords(t, filepath.Join(dir, name))
+		want := "posted"
+		if strings.Contains(name, "PUT") {
+			want = "put"
+		}
+		if len(recs) != 1 || string(recs[0].Data) != want {
+			t.Errorf("%s: %+v", name, recs)
+		}
+	}
+}
+
+func TestJSONFieldDirective(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"application/json", `{"device_id": "sensor-7", "site": {"id": 12}}`, "sensor-7/12"},
+		{"application/vnd.x+json", `{"device_id": true, "site": {"id": 1.5}}`, "true/1.5"},
+		{"application/json", `{"site": {"name": "x"}}`, "_missing/_missing"},
+		{"application/json", `{"device_id": null, "site": [1]}`, "_missing/_missing"},
+		{"application/json", `not json`, "_missing/_missing"},
+		{"text/plain", `{"device_id": "x", "site": {"id": 1}}`, "_missing/_missing"},
+		{"application/json", `{"device_id": "../../etc/passwd", "site": {"id": "a/b"}}`, "_.._etc_passwd/a_b"},
+		{"application/json", `{"device_id": "...", "site": {"id": "\u0000"}}`, "_missing/_"},
+		{"application/json", `{"device_id": "` + strings.Repeat("a", 300) + `", "site": {"id": 0}}`, strings.Repeat("a", 100) + "/0"},
+	} {
+		rec := &ReceiverRecord{ContentType: tc.contentType, Data: []byte(tc.body)}
+		got := newPathVars("POST", rec).expandJSON("%{json:device_id}/%{json:site.id}")
+		if got != tc.want {
+			t.Errorf("%s %s: got %q, want %q", tc.contentType, tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestJSONFieldPaths(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "%{json:device_id}.cbor")}},
+	})
+	for _, body := range []string{`{"device_id": "d1"}`, `{"device_id": "d2"}`, `{"device_id": "d1"}`, `{}`, `{"device_id": "../escape"}`} {
+		wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "application/json", []byte(body))), 200)
+	}
+	rs.configs["a"].retire()
+	want := []string{"_escape.cbor", "_missing.cbor", "d1.cbor", "d2.cbor"}
+	if files := listFiles(t, dir); !reflect.DeepEqual(files, want) {
+		t.Fatalf("files %v, want %v", files, want)
+	}
+	if n := len(readRecords(t, filepath.Join(dir, "d1.cbor"))); n != 2 {
+		t.Fatalf("d1.cbor has %d records", n)
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", OutTemplate: "/tmp/%T", TimeFormat: "no fields"}, "time-format")
+	wantSaneErr(t, ReceiverUnitConfig{Secret: "s", OutTemplate: "/tmp/%T", TimeFormat: "2006/01/02"}, "time-format")
+
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"o": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "so", OutTemplate: filepath.Join(dir, "o-%T.cbor"), TimeFormat: "2006-01-02T15-04-05"}},
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a-%T.cbor"), AppendMod: 3600, TimeFormat: "2006-01-02T15"}},
+		"d": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sd", OutTemplate: filepath.Join(dir, "d-%T.cbor")}},
+	})
+	when := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	rs.now = func() time.Time { return when }
+	wantStatus(t, post(rs, "/o/so", "1"), 200)
+	wantStatus(t, post(rs, "/a/sa", "2"), 200)
+	wantStatus(t, post(rs, "/d/sd", "3"), 200)
+	rs.configs["a"].retire()
+	// the append file is named for the start of its hour
+	want := []string{"a-" + when.Local().Format("2006-01-02T15") + ".cbor", "d-20260304_050607.cbor", "o-2026-03-04T05-06-07.cbor"}
+	if got := listFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("files %v, want %v", got, want)
+	}
+}
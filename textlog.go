@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTextLogBytes = 80
+
+// textLogPath is TextLog expanded like AppendPath, following the main
+// file's time bucket and rotation sequence
+func (ru *ReceiverUnit) textLogPath(now time.Time, vars *pathVars) string {
+	base := formatAppendTemplateString(ru.TextLog, ru.appendBucket(now.Unix()), ru.TimeFormat, vars)
+	if ru.AppendPath != "" {
+		return rotatedPath(base, ru.fseq)
+	}
+	return base
+}
+
+// textLogLine is "{RFC3339 time} {content type} {size} {snippet}".
+// The snippet is the first TextLogBytes of a text or JSON body, quoted,
+// or "-" for anything else.
+func (ru *ReceiverUnit) textLogLine(rec *ReceiverRecord) string {
+	snippet := "-"
+	if ru.aead == nil && (strings.HasPrefix(rec.ContentType, "text/") || isJSONContentType(rec.ContentType)) {
+		limit := ru.TextLogBytes
+		if limit == 0 {
+			limit = defaultTextLogBytes
+		}
+		d := rec.Data
+		if len(d) > limit {
+			d = d[:limit]
+		}
+		snippet = strconv.Quote(string(d))
+	}
+	contentType := rec.ContentType
+	if contentType == "" {
+		contentType = "-"
+	}
+	when := rec.Time().UTC().Format(time.RFC3339Nano)
+	return fmt.Sprintf("%s %s %d %s\n", when, strings.ReplaceAll(contentType, " ", ""), len(rec.Data), snippet)
+}
+
+// writeTextLog appends a line for a stored record. It is a secondary
+// record, failures are logged and don't fail the store.
+func (ru *ReceiverUnit) writeTextLog(rec *ReceiverRecord, now time.Time, vars *pathVars) {
+	tlpath := ru.textLogPath(now, vars)
+	if tlpath != ru.tlpath || ru.tlout == nil {
+		if ru.tlout != nil {
+			ru.tlout.Close()
+			ru.tlout = nil
+		}
+		f, err := createInDir(filepath.Dir(tlpath), func() (*os.File, error) {
+			return os.OpenFile(tlpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		})
+		if err != nil {
+			slog.Debug("text log open", "path", tlpath, "err", err)
+			return
+		}
+		ru.chownFile(f)
+		ru.tlout = f
+		ru.tlpath = tlpath
+	}
+	_, err := ru.tlout.Write([]byte(ru.textLogLine(rec)))
+	if err != nil {
+		slog.Debug("text log write", "path", tlpath, "err", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextLog(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), TextLog: filepath.Join(dir, "a.log"), TextLogBytes: 5, MaxFileBytes: 100}},
+	})
+	when := time.Unix(1772600000, 0)
+	rs.now = func() time.Time { return when }
+	wantStatus(t, post(rs, "/a/sa", "hello world"), 200)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "application/json", []byte(`{"k": "v"}`))), 200)
+	wantStatus(t, serve(rs, testRequest("POST", "/a/sa", "image/png", []byte("\x89PNG....."))), 200)
+	// past MaxFileBytes, both files rotate
+	wantStatus(t, post(rs, "/a/sa", strings.Repeat("x", 60)), 200)
+	rs.configs["a"].retire()
+
+	var stored []ReceiverRecord
+	var logged []string
+	for seq := 0; ; seq++ {
+		cpath := rotatedPath(filepath.Join(dir, "a.cbor"), seq)
+		if _, err := os.Stat(cpath); err != nil {
+			break
+		}
+		stored = append(stored, readRecords(t, cpath)...)
+		logged = append(logged, strings.SplitAfter(readFile(t, rotatedPath(filepath.Join(dir, "a.log"), seq)), "\n")...)
+	}
+	if len(listFiles(t, dir)) < 4 {
+		t.Fatalf("no rotation: %v", listFiles(t, dir))
+	}
+	var lines []string
+	for _, line := range logged {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(stored) != 4 || len(lines) != 4 {
+		t.Fatalf("%d records, %d log lines %q", len(stored), len(lines), lines)
+	}
+	stamp := when.UTC().Format(time.RFC3339Nano)
+	want := []string{
+		stamp + ` text/plain 11 "hello"` + "\n",
+		stamp + ` application/json 10 "{\"k\":"` + "\n",
+		stamp + " image/png 9 -\n",
+		stamp + ` text/plain 60 "xxxxx"` + "\n",
+	}
+	for i, rec := range stored {
+		if lines[i] != want[i] {
+			t.Errorf("line %d %q, want %q", i, lines[i], want[i])
+		}
+		if !strings.Contains(lines[i], fmt.Sprintf(" %s %d ", rec.ContentType, len(rec.Data))) {
+			t.Errorf("line %d %q doesn't match record %s %d", i, lines[i], rec.ContentType, len(rec.Data))
+		}
+	}
+}
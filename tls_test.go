@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert makes a certificate signed by parent, self-signed if parent is nil
+func testCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes one PEM block to path
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	_, err := clientCATLSConfig(filepath.Join(dir, "missing.pem"))
+	if err == nil {
+		t.Error("missing CA file accepted")
+	}
+	writeConfig(t, filepath.Join(dir, "empty.pem"), "not a certificate")
+	_, err = clientCATLSConfig(filepath.Join(dir, "empty.pem"))
+	if err == nil {
+		t.Error("CA file with no certificates accepted")
+	}
+
+	ca, caKey, _ := testCert(t, "ca", nil, nil)
+	_, serverKey, serverCert := testCert(t, "server", ca, caKey)
+	_, _, clientCert := testCert(t, "client", ca, caKey)
+	caPath := filepath.Join(dir, "ca.pem")
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writePEM(t, caPath, "CERTIFICATE", ca.Raw)
+	writePEM(t, certPath, "CERTIFICATE", serverCert.Certificate[0])
+	keyDER, err := x509.MarshalECPrivateKey(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+
+	apath := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: apath}},
+	})
+	server := rs.newHTTPServer("127.0.0.1:0", "", false)
+	server.TLSConfig, err = clientCATLSConfig(caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, certPath, keyPath)
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	httpsPost := func(certs []tls.Certificate, body string) (int, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		defer client.CloseIdleConnections()
+		response, err := client.Post("https://"+ln.Addr().String()+"/a/sa", "text/plain", bytes.NewReader([]byte(body)))
+		if err != nil {
+			return 0, err
+		}
+		response.Body.Close()
+		return response.StatusCode, nil
+	}
+	status, err := httpsPost([]tls.Certificate{clientCert}, "over tls")
+	if err != nil || status != 200 {
+		t.Fatalf("with client certificate: %d %v", status, err)
+	}
+	if _, err := httpsPost(nil, "no cert"); err == nil {
+		t.Error("accepted a client without a certificate")
+	}
+	// a certificate the CA didn't sign
+	_, _, strangerCert := testCert(t, "stranger", nil, nil)
+	if _, err := httpsPost([]tls.Certificate{strangerCert}, "stranger"); err == nil {
+		t.Error("accepted a client certificate from another CA")
+	}
+
+	rs.units()["a"].retire()
+	if recs := readRecords(t, apath); len(recs) != 1 || string(recs[0].Data) != "over tls" {
+		t.Errorf("stored %d records", len(recs))
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// clientCATLSConfig requires clients to present a certificate signed by
+// one of the CAs in caPath, for -tls-client-ca
+func clientCATLSConfig(caPath string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found")
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errWriteQueueFull = errors.New("write queue full")
+
+// writeJob is a record waiting in a writeQueue
+type writeJob struct {
+	rec    *ReceiverRecord
+	format string
+	method string
+	now    time.Time
+	// spill is set for a body stored by storeSpill
+	spill *spillFile
+	done  chan error
+}
+
+// writeQueue paces a unit's writes to MaxWritesPerSecond.
+// Bursts wait in the queue, up to WriteQueueSize of them.
+type writeQueue struct {
+	jobs     chan *writeJob
+	interval time.Duration
+	// done is the unit's, closed when it is retired
+	done <-chan struct{}
+}
+
+func newWriteQueue(writesPerSecond float64, size int, done <-chan struct{}) *writeQueue {
+	return &writeQueue{
+		jobs:     make(chan *writeJob, size),
+		interval: time.Duration(float64(time.Second) / writesPerSecond),
+		done:     done,
+	}
+}
+
+// run writes queued records one at a time, no faster than interval apart
+func (wq *writeQueue) run(rs *receiverServer, cfg *ReceiverUnit) {
+	var last time.Time
+	for {
+		var job *writeJob
+		select {
+		case job = <-wq.jobs:
+		case <-wq.done:
+			return
+		}
+		wait := time.Until(last.Add(wq.interval))
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		last = time.Now()
+		if job.spill != nil {
+			job.done <- rs.storeSpill(cfg, job.spill, job.rec, job.method, job.now)
+			continue
+		}
+		job.done <- rs.storeRecord(cfg, job.rec, job.format, job.method, job.now)
+	}
+}
+
+// enqueue waits for the record to be written,
+// or fails right away with errWriteQueueFull
+func (wq *writeQueue) enqueue(job *writeJob) error {
+	job.done = make(chan error, 1)
+	select {
+	case wq.jobs <- job:
+	case <-wq.done:
+		return errUnitPaused
+	default:
+		return errWriteQueueFull
+	}
+	select {
+	case err := <-job.done:
+		return err
+	case <-wq.done:
+		// run has stopped, storeRecord would have refused it anyway
+		return errUnitPaused
+	}
+}
+
+// commitRecord stores a record, through the unit's write queue if it has one
+func (rs *receiverServer) commitRecord(cfg *ReceiverUnit, rec *ReceiverRecord, format, method string, now time.Time) error {
+	if cfg.paused.Load() {
+		return errUnitPaused
+	}
+	if cfg.RecordName {
+		rec.Name = cfg.name
+	}
+	if len(cfg.Tags) != 0 {
+		rec.Tags = cfg.Tags
+	}
+	if cfg.JSONWrap {
+		data, err := wrapJSON(rec.Data)
+		if err != nil {
+			return err
+		}
+		rec.Data = data
+		rec.ContentType = jsonWrapContentType
+	}
+	if cfg.writeQueue == nil {
+		return rs.storeRecord(cfg, rec, format, method, now)
+	}
+	return cfg.writeQueue.enqueue(&writeJob{
+		rec:    rec,
+		format: format,
+		method: method,
+		now:    now,
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteCapRate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cbor")
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: path, MaxWritesPerSecond: 50, WriteQueueSize: 100}},
+	})
+	const n = 20
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() {
+			if out := post(rs, "/a/sa", "x"); out.Code != 200 {
+				t.Errorf("status %d", out.Code)
+			}
+		})
+	}
+	wg.Wait()
+	// 20ms apart, the first right away
+	if elapsed := time.Since(start); elapsed < (n-1)*20*time.Millisecond {
+		t.Fatalf("%d writes in %s, over 50/s", n, elapsed)
+	}
+	rs.configs["a"].retire()
+	if got := len(readRecords(t, path)); got != n {
+		t.Fatalf("stored %d records, want %d", got, n)
+	}
+}
+
+func TestWriteCapQueueFull(t *testing.T) {
+	dir := t.TempDir()
+	rs := newTestServer(t, map[string]*ReceiverUnit{
+		"a": {ReceiverUnitConfig: ReceiverUnitConfig{Secret: "sa", AppendPath: filepath.Join(dir, "a.cbor"), MaxWritesPerSecond: 2, WriteQueueSize: 2}},
+	})
+	const n = 8
+	codes := make([]int, n)
+	retryAfter := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			out := post(rs, "/a/sa", "x")
+			codes[i] = out.Code
+			retryAfter[i] = out.Header().Get("Retry-After")
+		})
+	}
+	wg.Wait()
+	var ok, full int
+	for i, code := range codes {
+		switch code {
+		case 200:
+			ok++
+		case 503:
+			full++
+			if retryAfter[i] == "" {
+				t.Errorf("503 without Retry-After")
+			}
+		default:
+			t.Errorf("status %d", code)
+		}
+	}
+	// one written, one waiting out the interval and two queued, the
+	// rest are turned away
+	if ok < 1 || ok > 4 || full != n-ok {
+		t.Fatalf("%d stored, %d refused", ok, full)
+	}
+}